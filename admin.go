@@ -0,0 +1,180 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Header required on admin requests changing state. Browsers only send it
+// from pages of the proxy itself, so other sites cannot use the Basic
+// credentials the browser sends along for them.
+const adminRequestHeader = "X-Mjpeg-Proxy-Admin"
+
+func adminAuthorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(adminUser)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(adminPassword)) == 1
+	return userOk && passwordOk
+}
+
+// adminHandler restricts access to the handler to the admin user.
+// Admin endpoints are not available unless an admin password is set.
+func adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminPassword == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mjpeg-proxy admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			r.Header.Get(adminRequestHeader) == "" {
+			http.Error(w, "Missing "+adminRequestHeader+" header", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// resetEndpoint sets the counters of one stream, or of all streams for
+// the bare path, to zero and returns their values from before the reset.
+func resetEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	streams := pubSubs
+	if r.URL.Path != "/admin/reset" {
+		pubSub := findPubSub(strings.TrimPrefix(r.URL.Path, "/admin/reset"))
+		if pubSub == nil {
+			http.NotFound(w, r)
+			return
+		}
+		streams = []*PubSub{pubSub}
+	}
+
+	data := make(map[string]StreamStatus)
+	for _, pubSub := range streams {
+		data[pubSub.id] = pubSub.ResetCounters()
+		logf("admin[%s]: counters reset by %s\n", pubSub.id, clientAddress(r))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// adminStream returns the stream named by the path below the prefix, or
+// answers the request itself if the method or the stream is wrong.
+func adminStream(w http.ResponseWriter, r *http.Request, prefix, method string) *PubSub {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	pubSub := findPubSub(strings.TrimPrefix(r.URL.Path, prefix))
+	if pubSub == nil {
+		http.NotFound(w, r)
+	}
+	return pubSub
+}
+
+// reconnectEndpoint reconnects a stream to its source and returns its
+// status.
+func reconnectEndpoint(w http.ResponseWriter, r *http.Request) {
+	pubSub := adminStream(w, r, "/admin/reconnect", http.MethodPost)
+	if pubSub == nil {
+		return
+	}
+
+	logf("admin[%s]: reconnect by %s\n", pubSub.id, clientAddress(r))
+	pubSub.Reconnect()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pubSub.Status())
+}
+
+// pauseEndpoint pauses or resumes a stream, depending on the path, and
+// returns its status.
+func pauseEndpoint(w http.ResponseWriter, r *http.Request) {
+	prefix, paused := "/admin/pause", true
+	if strings.HasPrefix(r.URL.Path, "/admin/resume/") {
+		prefix, paused = "/admin/resume", false
+	}
+	pubSub := adminStream(w, r, prefix, http.MethodPost)
+	if pubSub == nil {
+		return
+	}
+
+	logf("admin[%s]: %s by %s\n", pubSub.id, strings.TrimPrefix(prefix, "/admin/"), clientAddress(r))
+	pubSub.SetPaused(paused)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pubSub.Status())
+}
+
+// subscribersEndpoint lists the subscribers of a stream.
+func subscribersEndpoint(w http.ResponseWriter, r *http.Request) {
+	pubSub := adminStream(w, r, "/admin/subscribers", http.MethodGet)
+	if pubSub == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pubSub.Subscribers())
+}
+
+// kickEndpoint ends the response of the subscriber given by its id in
+// the subscriber parameter.
+func kickEndpoint(w http.ResponseWriter, r *http.Request) {
+	pubSub := adminStream(w, r, "/admin/kick", http.MethodPost)
+	if pubSub == nil {
+		return
+	}
+
+	id, err := strconv.ParseUint(r.FormValue("subscriber"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscriber", http.StatusBadRequest)
+		return
+	}
+	if !pubSub.Kick(id) {
+		http.Error(w, "Subscriber not found", http.StatusNotFound)
+		return
+	}
+
+	logf("admin[%s]: subscriber %d kicked by %s\n", pubSub.id, id, clientAddress(r))
+	w.WriteHeader(http.StatusNoContent)
+}
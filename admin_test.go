@@ -0,0 +1,338 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newAdminServer serves the admin endpoints as main does, with the admin
+// password set.
+func newAdminServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	oldUser, oldPassword := adminUser, adminPassword
+	adminUser, adminPassword = "admin", "secret"
+	t.Cleanup(func() { adminUser, adminPassword = oldUser, oldPassword })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reset", adminHandler(resetEndpoint))
+	mux.HandleFunc("/admin/reset/", adminHandler(resetEndpoint))
+	mux.HandleFunc("/admin/reconnect/", adminHandler(reconnectEndpoint))
+	mux.HandleFunc("/admin/pause/", adminHandler(pauseEndpoint))
+	mux.HandleFunc("/admin/resume/", adminHandler(pauseEndpoint))
+	mux.HandleFunc("/admin/subscribers/", adminHandler(subscribersEndpoint))
+	mux.HandleFunc("/admin/kick/", adminHandler(kickEndpoint))
+	mux.HandleFunc("/admin/", adminHandler(adminUIEndpoint))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func adminRequest(t *testing.T, method, url string, auth bool, header string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth {
+		req.SetBasicAuth("admin", "secret")
+	}
+	if header != "" {
+		req.Header.Set(adminRequestHeader, header)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminUIRequiresAuth(t *testing.T) {
+	server := newAdminServer(t)
+
+	resp := adminRequest(t, http.MethodGet, server.URL+"/admin/", false, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without credentials: got status %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("challenge: got %q", resp.Header.Get("WWW-Authenticate"))
+	}
+
+	resp = adminRequest(t, http.MethodGet, server.URL+"/admin/", true, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("with credentials: got status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the page sends the header its actions need
+	if !strings.Contains(string(body), adminRequestHeader) {
+		t.Errorf("page does not send the %s header", adminRequestHeader)
+	}
+	for _, endpoint := range []string{"/admin/reconnect", "/admin/pause", "/admin/resume",
+		"/admin/subscribers", "/admin/kick", "/admin/reset"} {
+		if !strings.Contains(string(body), endpoint) {
+			t.Errorf("page does not use %s", endpoint)
+		}
+	}
+}
+
+// Resets need the admin header besides the credentials, so other sites
+// cannot trigger them with the credentials the browser sends along.
+func TestAdminResetRequiresHeader(t *testing.T) {
+	pubSub := newTestStream(t, "/adminreset", configSource{Source: "http://127.0.0.1:1"})
+	setStreams(t, pubSub)
+	server := newAdminServer(t)
+
+	resp := adminRequest(t, http.MethodPost, server.URL+"/admin/reset", true, "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("without header: got status %d", resp.StatusCode)
+	}
+
+	resp = adminRequest(t, http.MethodPost, server.URL+"/admin/reset", false, "1")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without credentials: got status %d", resp.StatusCode)
+	}
+
+	resp = adminRequest(t, http.MethodPost, server.URL+"/admin/reset/adminreset", true, "1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("with header: got status %d", resp.StatusCode)
+	}
+	var data map[string]StreamStatus
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["/adminreset"]; !ok {
+		t.Errorf("reset streams: got %v", data)
+	}
+}
+
+// A reset returns the counters from before and starts them from zero.
+func TestAdminResetCounters(t *testing.T) {
+	frame := testJPEG(t, 8, 8, color.White)
+	source := newTestSource(t, frame, 10*time.Millisecond)
+	pubSub := newTestStream(t, "/counters", configSource{Source: source.URL})
+	setStreams(t, pubSub)
+	server := newAdminServer(t)
+
+	stream := httptest.NewServer(pubSub)
+	defer stream.Close()
+	resp, err := http.Get(stream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFrames(t, resp, 3)
+	resp.Body.Close()
+	stream.CloseClientConnections()
+
+	// wait for the stream to stop so no frames come in meanwhile
+	deadline := time.Now().Add(5 * time.Second)
+	for pubSub.Status().Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("stream not disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := pubSub.Status()
+
+	resp = adminRequest(t, http.MethodPost, server.URL+"/admin/reset", true, "1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	var data map[string]StreamStatus
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	prior := data["/counters"]
+	if prior.FramesPublished < 3 || prior.FramesPublished != before.FramesPublished {
+		t.Errorf("frames before reset: got %d, want %d", prior.FramesPublished, before.FramesPublished)
+	}
+	if prior.BytesPublished != prior.FramesPublished*uint64(len(frame)) {
+		t.Errorf("bytes before reset: got %d for %d frames", prior.BytesPublished, prior.FramesPublished)
+	}
+
+	after := pubSub.Status()
+	if after.FramesPublished != 0 || after.BytesPublished != 0 || after.FramesDropped != 0 {
+		t.Errorf("counters after reset: %+v", after)
+	}
+	for reason, count := range after.Disconnects {
+		if count != 0 {
+			t.Errorf("%s disconnects after reset: %d", reason, count)
+		}
+	}
+}
+
+// countingSource counts the connections to a source sending frames.
+func countingSource(t *testing.T, connects *int32) *httptest.Server {
+	t.Helper()
+
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 10*time.Millisecond)
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(connects, 1)
+		source.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		counting.CloseClientConnections()
+		counting.Close()
+	})
+	return counting
+}
+
+// The subscribers are listed with their ids, kicking one ends its stream.
+func TestAdminKick(t *testing.T) {
+	var connects int32
+	pubSub := newTestStream(t, "/kick", configSource{Source: countingSource(t, &connects).URL})
+	setStreams(t, pubSub)
+	server := newAdminServer(t)
+	stream := httptest.NewServer(pubSub)
+	defer stream.Close()
+
+	resp, err := http.Get(stream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	readFrames(t, resp, 1)
+
+	list := adminRequest(t, http.MethodGet, server.URL+"/admin/subscribers/kick", true, "")
+	var subscribers []SubscriberInfo
+	if err := json.NewDecoder(list.Body).Decode(&subscribers); err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribers) != 1 || !strings.HasPrefix(subscribers[0].Address, "127.0.0.1:") {
+		t.Fatalf("subscribers: got %+v", subscribers)
+	}
+	id := fmt.Sprint(subscribers[0].ID)
+
+	kicks := metricValue(t, disconnectCounter.WithLabelValues("/kick", disconnectKicked))
+	kick := adminRequest(t, http.MethodPost, server.URL+"/admin/kick/kick?subscriber="+id, true, "")
+	if kick.StatusCode != http.StatusForbidden {
+		t.Errorf("without header: got status %d", kick.StatusCode)
+	}
+	kick = adminRequest(t, http.MethodPost, server.URL+"/admin/kick/kick?subscriber="+id, true, "1")
+	if kick.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick: got status %d", kick.StatusCode)
+	}
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || !strings.HasSuffix(string(rest), "--\r\n") {
+		t.Errorf("stream not terminated after the kick: %v", err)
+	}
+	if got := metricValue(t, disconnectCounter.WithLabelValues("/kick", disconnectKicked)) - kicks; got != 1 {
+		t.Errorf("kicked disconnects: got %v", got)
+	}
+
+	kick = adminRequest(t, http.MethodPost, server.URL+"/admin/kick/kick?subscriber="+id, true, "1")
+	if kick.StatusCode != http.StatusNotFound {
+		t.Errorf("kicking again: got status %d", kick.StatusCode)
+	}
+}
+
+// Pausing disconnects the source and keeps the clients, resuming and
+// reconnecting connect it again.
+func TestAdminPauseAndReconnect(t *testing.T) {
+	var connects int32
+	pubSub := newTestStream(t, "/pause", configSource{Source: countingSource(t, &connects).URL})
+	setStreams(t, pubSub)
+	server := newAdminServer(t)
+	stream := httptest.NewServer(pubSub)
+	defer stream.Close()
+	defer stream.CloseClientConnections()
+
+	resp, err := http.Get(stream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	frames := make(chan struct{}, 100)
+	go func() {
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			ioutil.ReadAll(part)
+			frames <- struct{}{}
+		}
+	}()
+	waitFrame := func(what string) {
+		t.Helper()
+		select {
+		case <-frames:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no frame", what)
+		}
+	}
+	waitFrame("before pausing")
+
+	pause := adminRequest(t, http.MethodPost, server.URL+"/admin/pause/pause", true, "1")
+	var status StreamStatus
+	if err := json.NewDecoder(pause.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Paused || status.Connected || status.Subscribers != 1 {
+		t.Errorf("paused status: got %+v", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for len(frames) > 0 { // sent before the pause
+		<-frames
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(frames) > 0 {
+		t.Error("frames sent while paused")
+	}
+
+	adminRequest(t, http.MethodPost, server.URL+"/admin/resume/pause", true, "1")
+	waitFrame("after resuming")
+	if n := atomic.LoadInt32(&connects); n != 2 {
+		t.Errorf("connects after resuming: got %d, want 2", n)
+	}
+
+	adminRequest(t, http.MethodPost, server.URL+"/admin/reconnect/pause", true, "1")
+	for len(frames) > 0 {
+		<-frames
+	}
+	waitFrame("after reconnecting")
+	if n := atomic.LoadInt32(&connects); n != 3 {
+		t.Errorf("connects after reconnecting: got %d, want 3", n)
+	}
+	if status := pubSub.Status(); status.Paused || status.Subscribers != 1 {
+		t.Errorf("status: got %+v", status)
+	}
+}
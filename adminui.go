@@ -0,0 +1,166 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// adminPage lists the streams with their status and subscribers, updated
+// from /api/info and /admin/subscribers, and calls the admin endpoints with
+// the credentials the browser used for the page.
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mjpeg-proxy admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>mjpeg-proxy</h1>
+<p><button id="reset-all">Reset all counters</button> <span id="message"></span></p>
+<div id="streams"></div>
+<script>
+"use strict";
+
+function cell(row, text) {
+	const td = document.createElement("td");
+	td.textContent = text;
+	row.appendChild(td);
+	return td;
+}
+
+function button(label, action) {
+	const b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = action;
+	return b;
+}
+
+async function post(url, done) {
+	const resp = await fetch(url,
+		{method: "POST", headers: {"X-Mjpeg-Proxy-Admin": "1"}});
+	document.getElementById("message").textContent =
+		resp.ok ? done : "Failed: " + resp.status;
+	refresh();
+}
+
+function reset(id) {
+	post("/admin/reset" + id, "Counters reset");
+}
+
+function subscriberTable(id, subscribers) {
+	const table = document.createElement("table");
+	const head = table.insertRow();
+	for (const key of ["id", "address", "path", "since", ""]) {
+		cell(head, key);
+	}
+	for (const sub of subscribers) {
+		const row = table.insertRow();
+		cell(row, sub.id);
+		cell(row, sub.address + (sub.internal ? " (internal)" : ""));
+		cell(row, sub.path || "");
+		cell(row, sub.since);
+		const td = cell(row, "");
+		if (!sub.internal) {
+			td.appendChild(button("Kick", () =>
+				post("/admin/kick" + id + "?subscriber=" + sub.id, "Subscriber kicked")));
+		}
+	}
+	return table;
+}
+
+function render(info, subscribers) {
+	const streams = document.getElementById("streams");
+	streams.replaceChildren();
+	for (const id of Object.keys(info.status).sort()) {
+		const status = info.status[id];
+		const h = document.createElement("h2");
+		h.textContent = id;
+		streams.appendChild(h);
+
+		const table = document.createElement("table");
+		for (const key of ["connected", "paused", "frozen", "subscribers", "queued", "fps",
+				"frames_published", "frames_dropped", "drop_ratio", "uptime", "last_frame"]) {
+			const row = table.insertRow();
+			cell(row, key);
+			cell(row, status[key] === undefined ? "" : status[key]);
+		}
+		const actions = table.insertRow();
+		cell(actions, "actions");
+		const td = cell(actions, "");
+		td.appendChild(button("Reconnect", () => post("/admin/reconnect" + id, "Reconnected")));
+		if (status.paused) {
+			td.appendChild(button("Resume", () => post("/admin/resume" + id, "Resumed")));
+		} else {
+			td.appendChild(button("Pause", () => post("/admin/pause" + id, "Paused")));
+		}
+		td.appendChild(button("Reset counters", () => reset(id)));
+		const raw = document.createElement("a");
+		raw.href = "/debug/raw" + id;
+		raw.textContent = " raw source stream";
+		td.appendChild(raw);
+		streams.appendChild(table);
+		streams.appendChild(subscriberTable(id, subscribers[id] || []));
+	}
+}
+
+async function refresh() {
+	const resp = await fetch("/api/info");
+	if (!resp.ok) {
+		return;
+	}
+	const info = await resp.json();
+	const subscribers = {};
+	for (const id of Object.keys(info.status)) {
+		const list = await fetch("/admin/subscribers" + id);
+		if (list.ok) {
+			subscribers[id] = await list.json();
+		}
+	}
+	render(info, subscribers);
+}
+
+document.getElementById("reset-all").onclick = () => reset("");
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
+
+// adminUIEndpoint serves the admin page, only on its own path as it is
+// registered for the whole admin tree.
+func adminUIEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	io.WriteString(w, adminPage)
+}
@@ -0,0 +1,72 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	auditInterval       time.Duration
+	maxSubscribersPerIP int   // warn above this many subscriptions of one client
+	activeRequests      int64 // requests being handled by the server
+)
+
+// countRequests keeps track of the requests being handled, so the audit
+// can compare them with the subscribers of the streams.
+func countRequests(handler http.Handler) http.Handler {
+	if auditInterval <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// auditSubscribers periodically logs the subscribers of all streams.
+// Every client subscriber belongs to a request, so having more of them
+// than requests in flight means subscribers were not unsubscribed.
+func auditSubscribers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		subscribers, internal := 0, 0
+		for _, pubSub := range pubSubs {
+			status := pubSub.Status()
+			subscribers += status.Subscribers
+			internal += status.Internal
+		}
+		requests := atomic.LoadInt64(&activeRequests)
+
+		logf("audit: %d subscribers (%d internal), %d requests, %d goroutines\n",
+			subscribers, internal, requests, runtime.NumGoroutine())
+		if int64(subscribers-internal) > requests {
+			logf("audit: %d client subscribers without a request, possible leak\n",
+				int64(subscribers-internal)-requests)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Subscriptions are counted per host, whatever the client port, including
+// the queued ones.
+func TestSubscriptionsByHost(t *testing.T) {
+	pubSub := newTestPubSub(t, "/perhost", configSource{})
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.1:1001", "10.0.0.2:1000", "[::1]:80"} {
+		pubSub.subscribers[NewSubscriber(addr)] = struct{}{}
+	}
+	pubSub.queue = append(pubSub.queue, NewSubscriber("10.0.0.1:1002"))
+
+	for host, want := range map[string]int{"10.0.0.1": 3, "10.0.0.2": 1, "::1": 1, "10.0.0.3": 0} {
+		if got := pubSub.subscriptions(host); got != want {
+			t.Errorf("%s: got %d subscriptions, want %d", host, got, want)
+		}
+	}
+}
+
+// Internal subscribers are reported apart from the clients.
+func TestStatusInternalSubscribers(t *testing.T) {
+	pubSub := newTestPubSub(t, "/internal", configSource{})
+	pubSub.subscribers[NewSubscriber("10.0.0.1:1000")] = struct{}{}
+	sub := NewSubscriber("sample")
+	sub.internal = true
+	pubSub.subscribers[sub] = struct{}{}
+
+	if status := pubSub.doStatus(); status.Subscribers != 2 || status.Internal != 1 {
+		t.Errorf("got %d subscribers, %d internal", status.Subscribers, status.Internal)
+	}
+}
+
+func TestCountRequests(t *testing.T) {
+	old := auditInterval
+	auditInterval = time.Minute
+	defer func() { auditInterval = old }()
+
+	var during int64
+	handler := countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during = atomic.LoadInt64(&activeRequests)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if during != 1 {
+		t.Errorf("requests while handling: got %d", during)
+	}
+	if got := atomic.LoadInt64(&activeRequests); got != 0 {
+		t.Errorf("requests after handling: got %d", got)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// StreamCallbacks are notified about stream lifecycle events. They are
+// invoked from the pubsub loop of the stream, so calls for one stream
+// never overlap and arrive in event order. Callbacks must not block or
+// call back into the same PubSub; slow work belongs in a new goroutine.
+type StreamCallbacks struct {
+	// source connected and streaming started
+	OnConnect func(id string)
+	// source streaming stopped, err is nil for a requested stop
+	OnDisconnect func(id string, err error)
+	// source connect or read failed
+	OnError func(id string, err error)
+	// first client subscribed
+	OnFirstSubscriber func(id string)
+	// last client unsubscribed
+	OnLastSubscriber func(id string)
+}
+
+func (cb *StreamCallbacks) connect(id string) {
+	if cb.OnConnect != nil {
+		cb.OnConnect(id)
+	}
+}
+
+func (cb *StreamCallbacks) disconnect(id string, err error) {
+	if cb.OnDisconnect != nil {
+		cb.OnDisconnect(id, err)
+	}
+}
+
+func (cb *StreamCallbacks) failed(id string, err error) {
+	if cb.OnError != nil {
+		cb.OnError(id, err)
+	}
+}
+
+func (cb *StreamCallbacks) firstSubscriber(id string) {
+	if cb.OnFirstSubscriber != nil {
+		cb.OnFirstSubscriber(id)
+	}
+}
+
+func (cb *StreamCallbacks) lastSubscriber(id string) {
+	if cb.OnLastSubscriber != nil {
+		cb.OnLastSubscriber(id)
+	}
+}
+
+// Post stream lifecycle events as JSON to this URL, like a camera coming
+// online for a dashboard.
+var eventURL string
+
+const (
+	eventQueueLength = 32
+	eventTimeout     = 10 * time.Second
+)
+
+type streamEvent struct {
+	Stream string    `json:"stream"`
+	Event  string    `json:"event"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// postEvents returns callbacks posting the events of a stream to the URL.
+// Events are posted in order from a goroutine of their own, so a slow
+// receiver never holds up the stream; they are dropped when it falls
+// too far behind.
+func postEvents(url string) StreamCallbacks {
+	events := make(chan streamEvent, eventQueueLength)
+	client := &http.Client{Timeout: eventTimeout}
+
+	go func() {
+		for event := range events {
+			body, _ := json.Marshal(event)
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				logf("events[%s]: %s\n", event.Stream, err)
+				continue
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				logf("events[%s]: %s answered %s\n", event.Stream, url, resp.Status)
+			}
+		}
+	}()
+
+	post := func(id, name string, err error) {
+		event := streamEvent{Stream: id, Event: name, Time: time.Now()}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		select {
+		case events <- event:
+		default:
+			logf("events[%s]: queue full, dropping %s\n", id, name)
+		}
+	}
+
+	return StreamCallbacks{
+		OnConnect:         func(id string) { post(id, "connect", nil) },
+		OnDisconnect:      func(id string, err error) { post(id, "disconnect", err) },
+		OnError:           func(id string, err error) { post(id, "error", err) },
+		OnFirstSubscriber: func(id string) { post(id, "first_subscriber", nil) },
+		OnLastSubscriber:  func(id string) { post(id, "last_subscriber", nil) },
+	}
+}
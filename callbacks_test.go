@@ -0,0 +1,138 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// recordCallbacks returns callbacks sending the name of each event.
+func recordCallbacks(events chan string) StreamCallbacks {
+	return StreamCallbacks{
+		OnConnect:         func(id string) { events <- "connect" },
+		OnDisconnect:      func(id string, err error) { events <- "disconnect" },
+		OnError:           func(id string, err error) { events <- "error" },
+		OnFirstSubscriber: func(id string) { events <- "first_subscriber" },
+		OnLastSubscriber:  func(id string) { events <- "last_subscriber" },
+	}
+}
+
+func expectEvent(t *testing.T, events chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("event: got %s, want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", want)
+	}
+}
+
+// Tests run without -stopduration, so the source stops right after the
+// last subscriber leaves.
+func TestCallbacks(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	conf := configSource{Source: source.URL}
+	chunker, err := NewChunker("/callbacks", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := NewPubSub("/callbacks", chunker, conf)
+	events := make(chan string, 10)
+	pubSub.SetCallbacks(recordCallbacks(events))
+	pubSub.Start()
+
+	sub := NewSubscriber("test")
+	pubSub.Subscribe(sub)
+	if !<-sub.admitted {
+		t.Fatal("not admitted")
+	}
+	expectEvent(t, events, "first_subscriber")
+	expectEvent(t, events, "connect")
+
+	<-sub.ChunkChannel
+	pubSub.Unsubscribe(sub)
+	expectEvent(t, events, "last_subscriber")
+	expectEvent(t, events, "disconnect")
+}
+
+func TestCallbacksError(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer source.Close()
+
+	conf := configSource{Source: source.URL}
+	chunker, err := NewChunker("/callbacks-error", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := NewPubSub("/callbacks-error", chunker, conf)
+	events := make(chan string, 10)
+	pubSub.SetCallbacks(recordCallbacks(events))
+	pubSub.Start()
+
+	sub := NewSubscriber("test")
+	pubSub.Subscribe(sub)
+	<-sub.admitted
+	expectEvent(t, events, "first_subscriber")
+	expectEvent(t, events, "error")
+	pubSub.Unsubscribe(sub)
+}
+
+var errTest = errors.New("test failure")
+
+func TestPostEvents(t *testing.T) {
+	received := make(chan streamEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event streamEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+
+	callbacks := postEvents(receiver.URL)
+	callbacks.connect("/cam")
+	callbacks.failed("/cam", errTest)
+
+	for _, want := range []streamEvent{
+		{Stream: "/cam", Event: "connect"},
+		{Stream: "/cam", Event: "error", Error: errTest.Error()},
+	} {
+		select {
+		case event := <-received:
+			if event.Stream != want.Stream || event.Event != want.Event ||
+				event.Error != want.Error || event.Time.IsZero() {
+				t.Errorf("event: got %+v, want %+v", event, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event posted", want.Event)
+		}
+	}
+}
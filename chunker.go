@@ -20,6 +20,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -27,7 +29,9 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -48,57 +52,177 @@ import (
 */
 
 type Chunker struct {
-	id       string
-	source   *url.URL
-	username string
-	password string
-	digest   bool
-	resp     *http.Response
-	boundary string
-	stop     chan struct{}
-	rate     float64
-	cancel   context.CancelFunc
+	id             string
+	source         *url.URL
+	forward        url.Values
+	username       string
+	password       string
+	auth           string
+	authScheme     atomic.Value // scheme learned in auto mode, shared with /debug/raw
+	session        *sessionLogin
+	resp           *http.Response
+	boundary       string
+	stop           chan struct{}
+	rate           float64
+	cancel         context.CancelFunc
+	client         *http.Client
+	pipeline       *framePipeline
+	validateLength bool
+	validateJPEG   bool
+	sniffBoundary  bool
+	dumpDir        string
+	dumpFrames     int
+	readBuffer     int
+	readBufferMax  int
+	tunedBuffer    int64 // read buffer size learned from the frames, atomic
+	lastGoodAge    time.Duration
+	metadata       *metadataHub
+	maxFrameErrors int
+	stripMarkers   map[byte]bool
 }
 
-func NewChunker(id, source, username, password string, digest bool, rate float64) (*Chunker, error) {
+func NewChunker(id string, conf configSource) (*Chunker, error) {
 	chunker := new(Chunker)
 
-	sourceUrl, err := url.Parse(source)
+	sourceUrl, err := url.Parse(conf.Source)
 	if err != nil {
 		return nil, err
 	}
 	if !sourceUrl.IsAbs() {
-		return nil, fmt.Errorf("uri is not absolute: %s", source)
+		return nil, fmt.Errorf("uri is not absolute: %s", conf.Source)
+	}
+
+	// static query parameters are part of the source from now on
+	if len(conf.SourceQuery) > 0 {
+		query := sourceUrl.Query()
+		for key, value := range conf.SourceQuery {
+			query.Set(key, value)
+		}
+		sourceUrl.RawQuery = query.Encode()
 	}
 
 	chunker.id = id
 	chunker.source = sourceUrl
-	chunker.username = username
-	chunker.password = password
-	chunker.digest = digest
-	chunker.rate = rate
+	chunker.username = conf.Username
+	chunker.password = conf.Password
+	chunker.auth, err = parseAuth(conf)
+	if err != nil {
+		return nil, err
+	}
+	chunker.rate = conf.Rate
+	chunker.pipeline, err = newFramePipeline(conf)
+	if err != nil {
+		return nil, err
+	}
+	chunker.validateLength = conf.ValidateLength
+	chunker.validateJPEG = conf.ValidateJPEG
+	chunker.sniffBoundary = conf.SniffBoundary
+	chunker.lastGoodAge = time.Duration(conf.LastGoodSeconds * float64(time.Second))
+	chunker.maxFrameErrors = conf.MaxFrameErrors
+	chunker.dumpDir = conf.DumpDir
+	chunker.dumpFrames = conf.DumpFrames
+	chunker.readBuffer = conf.ReadBuffer
+	if chunker.readBuffer <= 0 {
+		chunker.readBuffer = defaultReadBuffer
+	}
+	chunker.readBufferMax = conf.ReadBufferMax
+
+	chunker.stripMarkers, err = parseJPEGMarkers(conf.StripMarkers)
+	if err != nil {
+		return nil, err
+	}
+
+	// share one transport across reconnects so idle connections
+	// and TLS sessions can be reused. The transport also removes any
+	// chunked transfer encoding, so the multipart parser only sees the
+	// decoded body and chunk sizes never need to line up with parts.
+	// Requests are sent without a body, Expect: 100-continue never applies.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = !upstreamReuse
+	transport.RegisterProtocol("file", replayTransport{})
+	chunker.client = &http.Client{Transport: transport}
+
+	if conf.Login != nil && conf.Login.URL != "" {
+		chunker.session, err = newSessionLogin(sourceUrl, *conf.Login)
+		if err != nil {
+			return nil, err
+		}
+		chunker.client.Jar = chunker.session.jar
+	}
 
 	return chunker, nil
 }
 
-func (chunker *Chunker) basicAuthEnabled() bool {
-	return chunker.username != "" && chunker.password != "" && !chunker.digest
+// Upstream authentication modes, auto picks the scheme from the
+// challenge of the source.
+const (
+	authBasic  = "basic"
+	authDigest = "digest"
+	authAuto   = "auto"
+)
+
+func parseAuth(conf configSource) (string, error) {
+	switch auth := strings.ToLower(conf.Auth); auth {
+	case "":
+		if conf.Digest {
+			return authDigest, nil
+		}
+		return authBasic, nil
+	case authBasic, authDigest, authAuto:
+		return auth, nil
+	default:
+		return "", fmt.Errorf("unknown auth mode: %s", conf.Auth)
+	}
 }
 
-func (chunker *Chunker) digestAuthEnabled() bool {
-	return chunker.username != "" && chunker.password != "" && chunker.digest
+func (chunker *Chunker) authEnabled() bool {
+	return chunker.username != "" && chunker.password != ""
 }
 
-func (chunker *Chunker) Connect() error {
-	fmt.Printf("chunker[%s]: connecting to %s\n", chunker.id, chunker.source)
+// negotiateAuth picks the scheme to retry a 401 response with, or
+// returns an empty scheme if the request should not be retried.
+func (chunker *Chunker) negotiateAuth(resp *http.Response, sent string) (string, string) {
+	switch chunker.auth {
+	case authDigest:
+		if challenge, ok := authChallenge(resp, "Digest"); ok {
+			return authDigest, challenge
+		}
+	case authAuto:
+		if challenge, ok := authChallenge(resp, "Digest"); ok {
+			return authDigest, challenge
+		}
+		if challenge, ok := authChallenge(resp, "Basic"); ok && sent != authBasic {
+			return authBasic, challenge
+		}
+	}
+	return "", ""
+}
 
-	req, err := http.NewRequest("GET", chunker.source.String(), nil)
-	if err != nil {
-		return err
+// SetForwardedQuery sets client query parameters added to the source url
+// on the following connects, replacing configured parameters of the same name.
+func (chunker *Chunker) SetForwardedQuery(query url.Values) {
+	chunker.forward = query
+}
+
+// sourceURL returns the source url with the forwarded query parameters.
+func (chunker *Chunker) sourceURL(forward url.Values) *url.URL {
+	if len(forward) == 0 {
+		return chunker.source
 	}
 
+	u := *chunker.source
+	query := u.Query()
+	for key, values := range forward {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (chunker *Chunker) Connect() error {
+	logf("chunker[%s]: connecting to %s\n", chunker.id, chunker.sourceURL(chunker.forward))
+
 	ctx, cancel := context.WithCancel(context.Background())
-	req = req.WithContext(ctx)
 	chunker.cancel = cancel
 	defer func() {
 		if chunker.stop == nil { // connection failed
@@ -106,49 +230,142 @@ func (chunker *Chunker) Connect() error {
 		}
 	}()
 
-	if chunker.basicAuthEnabled() {
-		req.SetBasicAuth(chunker.username, chunker.password)
+	resp, err := chunker.request(ctx, chunker.forward)
+	if err != nil {
+		return err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	boundary, err := getBoundary(resp)
+	if err != nil && chunker.sniffBoundary {
+		logf("chunker[%s]: %s, looking for the boundary in the body\n", chunker.id, err)
+		br := bufio.NewReader(resp.Body)
+		timer := time.AfterFunc(boundarySniffTimeout, cancel)
+		boundary, err = sniffBoundary(br)
+		if !timer.Stop() && err == nil {
+			err = errBoundaryNotFound
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, resp.Body}
+	}
 	if err != nil {
+		chunker.closeResponse(resp)
 		return err
 	}
 
-	if chunker.digestAuthEnabled() && digestAuthRequested(resp) {
+	// frames are always sent with the boundary of the proxy, so clients
+	// are not affected, but a change hints at a different source
+	if chunker.boundary != "" && boundary != chunker.boundary {
+		logf("chunker[%s]: source boundary changed from %q to %q\n",
+			chunker.id, chunker.boundary, boundary)
+	}
+
+	chunker.resp = resp
+	chunker.boundary = boundary
+	chunker.stop = make(chan struct{})
+	return nil
+}
+
+// request opens a new upstream connection, handling authentication.
+func (chunker *Chunker) request(ctx context.Context, forward url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", chunker.sourceURL(forward).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	// basic credentials can be sent upfront, in auto mode only once the
+	// source asked for them
+	sent := ""
+	if chunker.authEnabled() {
+		sent = chunker.auth
+		if sent == authAuto {
+			sent, _ = chunker.authScheme.Load().(string)
+		}
+		if sent == authBasic {
+			req.SetBasicAuth(chunker.username, chunker.password)
+		}
+	}
+
+	// log in before the first request and once the session expired
+	loggedIn := false
+	if chunker.session != nil && !chunker.session.valid(req.URL) {
+		err = chunker.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		loggedIn = true
+	}
+
+	resp, err := chunker.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the source may have ended the session before the cookie expired
+	if chunker.session != nil && !loggedIn &&
+		(resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
 		io.Copy(ioutil.Discard, resp.Body)
 		resp.Body.Close()
-		digestAuth := digestAuthBuild(chunker.username, chunker.password,
-			chunker.source.RequestURI(), resp)
-		req.Header.Set("Authorization", "Digest "+digestAuth)
-		resp, err = client.Do(req)
+
+		err = chunker.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = chunker.do(req)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		chunker.closeResponse(resp)
-		return fmt.Errorf("request failed: %s", resp.Status)
+	if chunker.authEnabled() && resp.StatusCode == http.StatusUnauthorized {
+		scheme, challenge := chunker.negotiateAuth(resp, sent)
+		if scheme != "" {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			if chunker.auth == authAuto {
+				if old := chunker.authScheme.Swap(scheme); old != scheme {
+					logf("chunker[%s]: using %s authentication\n", chunker.id, scheme)
+				}
+			}
+
+			if scheme == authDigest {
+				digestAuth := digestAuthBuild(chunker.username, chunker.password,
+					req.URL.RequestURI(), challenge)
+				req.Header.Set("Authorization", "Digest "+digestAuth)
+			} else {
+				req.SetBasicAuth(chunker.username, chunker.password)
+			}
+			resp, err = chunker.do(req)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	boundary, err := getBoundary(resp)
-	if err != nil {
+	if resp.StatusCode != http.StatusOK {
 		chunker.closeResponse(resp)
-		return err
+		return nil, fmt.Errorf("request failed: %s", resp.Status)
 	}
 
-	chunker.resp = resp
-	chunker.boundary = boundary
-	chunker.stop = make(chan struct{})
-	return nil
+	return resp, nil
+}
+
+// do sends the request, possibly again. The client adds the cookies of
+// its jar to the request on each send, so earlier ones are removed first.
+func (chunker *Chunker) do(req *http.Request) (*http.Response, error) {
+	if chunker.client.Jar != nil {
+		req.Header.Del("Cookie")
+	}
+	return chunker.client.Do(req)
 }
 
 func (chunker *Chunker) closeResponse(resp *http.Response) {
 	err := resp.Body.Close()
 	if err != nil {
-		fmt.Printf("chunker[%s]: body close failed: %s\n", chunker.id, err)
+		logf("chunker[%s]: body close failed: %s\n", chunker.id, err)
 	}
 }
 
@@ -190,11 +407,105 @@ func getBoundary(resp *http.Response) (string, error) {
 	return boundary, nil
 }
 
+var errEmptyFrame = errors.New("received final chunk of size 0")
+
+// corruptPartError is a multipart parse error not caused by an error of
+// the source. mime/multipart has no error types for unexpected boundary
+// lines, but it wraps the errors of the source it reads from.
+type corruptPartError struct {
+	err error
+}
+
+func (e *corruptPartError) Error() string { return e.err.Error() }
+func (e *corruptPartError) Unwrap() error { return e.err }
+
+// recoverableError reports whether the error is caused by a corrupt part
+// rather than the connection, so reading can continue with the next part.
+func recoverableError(err error) bool {
+	var corrupt *corruptPartError
+	var protoErr textproto.ProtocolError
+	return errors.As(err, &corrupt) || errors.As(err, &protoErr) ||
+		errors.Is(err, errEmptyFrame)
+}
+
+// skipFrame decides if a frame error can be tolerated without reconnecting
+// to the source, counting the consecutive errors.
+func (chunker *Chunker) skipFrame(err error, frameErrors *int) bool {
+	if !recoverableError(err) || *frameErrors >= chunker.maxFrameErrors {
+		return false
+	}
+
+	*frameErrors++
+	logf("chunker[%s]: skipping corrupt frame (%d/%d): %s\n",
+		chunker.id, *frameErrors, chunker.maxFrameErrors, partError(err))
+	return true
+}
+
+// resync skips the rest of a corrupt part up to the next boundary. It
+// reads on with the same multipart reader, which fails on every line that
+// is not a boundary, so nothing the reader buffered ahead is lost.
+func resync(mr *multipart.Reader, source *ingestReader) (*multipart.Part, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == nil || err == io.EOF || errors.Is(err, source.err) {
+			return part, err
+		}
+	}
+}
+
+// partError replaces part header parse errors, which quote the offending
+// line and may contain binary frame data, with a readable description.
+func partError(err error) error {
+	var protoErr textproto.ProtocolError
+	if errors.As(err, &protoErr) {
+		return errors.New("malformed part header, source may be missing the empty line before frame data")
+	}
+
+	return err
+}
+
+// Largest Content-Length trusted for preallocating the frame buffer.
+const maxPartPrealloc = 16 * 1024 * 1024
+
+// readPart reads the frame data of a part. Only the data is kept, as the
+// part headers are regenerated when serving. If the source announces the
+// part size the buffer is allocated once instead of growing while reading.
+func readPart(part *multipart.Part) ([]byte, error) {
+	size, err := strconv.Atoi(part.Header.Get("Content-Length"))
+	if err != nil || size <= 0 || size > maxPartPrealloc {
+		return ioutil.ReadAll(part)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size+bytes.MinRead))
+	_, err = buf.ReadFrom(part)
+	return buf.Bytes(), err
+}
+
+// Minimum time between warnings about frames dropped for a wrong size.
+const lengthWarningInterval = time.Minute
+
+// checkLength compares the frame with the size announced by the source.
+// Line breaks some sources add after the frame are removed, any other
+// difference means the frame was cut short or ran into the next one.
+func checkLength(part *multipart.Part, data []byte) ([]byte, error) {
+	size, err := strconv.Atoi(part.Header.Get("Content-Length"))
+	if err != nil || size < 0 || len(data) == size {
+		return data, nil
+	}
+
+	if len(data) > size && len(bytes.TrimRight(data[size:], "\r\n")) == 0 {
+		return data[:size], nil
+	}
+
+	return nil, fmt.Errorf("frame size %d does not match Content-Length %d", len(data), size)
+}
+
 func (chunker *Chunker) GetHeader() http.Header {
 	return chunker.resp.Header
 }
 
-func (chunker *Chunker) watcher(timeout time.Duration, counter *int32) {
+func (chunker *Chunker) watcher(timeout time.Duration, counter *int32,
+	stop chan struct{}, cancel context.CancelFunc) {
 	ticker := time.NewTicker(timeout)
 	defer ticker.Stop()
 
@@ -204,30 +515,123 @@ WatchLoop:
 		case <-ticker.C:
 			framesReceived := atomic.SwapInt32(counter, 0)
 			if framesReceived == 0 {
-				fmt.Printf("chunker[%s]: frame timeout\n", chunker.id)
-				chunker.cancel()
+				logf("chunker[%s]: frame timeout\n", chunker.id)
+				cancel()
 				break WatchLoop
 			}
-		case <-chunker.stop:
+		case <-stop:
 			break WatchLoop
 		}
 	}
 }
 
-func (chunker *Chunker) Start(pubChan chan []byte) {
-	fmt.Printf("chunker[%s]: started\n", chunker.id)
+// Limits for finding the boundary in the body when the header has none.
+const (
+	boundarySniffSize    = 1024
+	boundarySniffTimeout = 10 * time.Second
+)
+
+var errBoundaryNotFound = errors.New("boundary not found in body")
+
+// sniffBoundary takes the boundary from the first delimiter line of the
+// body. The data is only peeked, so the parts are read from the start.
+func sniffBoundary(br *bufio.Reader) (string, error) {
+	start := 0
+	for n := 1; n <= boundarySniffSize; n++ {
+		data, err := br.Peek(n)
+		if err != nil {
+			return "", err
+		}
+		if data[n-1] != '\n' {
+			continue
+		}
+
+		line := strings.TrimSpace(string(data[start:n]))
+		start = n
+		if line == "" {
+			continue // leading line breaks
+		}
+		if len(line) <= 2 || !strings.HasPrefix(line, "--") {
+			return "", errBoundaryNotFound
+		}
+		return line[2:], nil
+	}
+
+	return "", errBoundaryNotFound
+}
+
+// Read buffer size of source connections unless configured otherwise.
+const defaultReadBuffer = 4096
+
+// bufferSize returns the read buffer size for the next connection.
+func (chunker *Chunker) bufferSize() int {
+	if size := atomic.LoadInt64(&chunker.tunedBuffer); size > 0 {
+		return int(size)
+	}
+	return chunker.readBuffer
+}
+
+// tuneBuffer sizes the read buffer of the next connection to hold one and
+// a half frames of the average size read, within the configured bounds.
+// The buffer of a running connection is never replaced.
+func (chunker *Chunker) tuneBuffer(frames int, bytes int64) {
+	if chunker.readBufferMax <= 0 || frames == 0 {
+		return
+	}
+
+	size := int(bytes / int64(frames) * 3 / 2)
+	if size < chunker.readBuffer {
+		size = chunker.readBuffer
+	}
+	if size > chunker.readBufferMax {
+		size = chunker.readBufferMax
+	}
+
+	// small changes in the frame size keep the buffer as it is
+	old := chunker.bufferSize()
+	if diff := size - old; diff*8 > old || -diff*8 > old {
+		logf("chunker[%s]: read buffer resized from %d to %d bytes\n", chunker.id, old, size)
+		atomic.StoreInt64(&chunker.tunedBuffer, int64(size))
+	}
+}
+
+// Start reads frames from the connected source in the background. The
+// goroutine keeps its own copy of the connection state, so a later Stop
+// and Connect cannot interfere with a chunker that is still shutting down.
+// The returned channel receives the reason for stopping, nil if the
+// source ended or the chunker was stopped, just before pubChan is closed.
+func (chunker *Chunker) Start(pubChan chan Frame) <-chan error {
+	done := make(chan error, 1)
+	go chunker.run(pubChan, done, chunker.resp.Body, chunker.boundary,
+		chunker.stop, chunker.cancel)
+	return done
+}
+
+func (chunker *Chunker) run(pubChan chan Frame, done chan<- error, body io.ReadCloser,
+	boundary string, stop chan struct{}, cancel context.CancelFunc) {
+	logf("chunker[%s]: started\n", chunker.id)
 
-	body := chunker.resp.Body
 	defer func() {
 		err := body.Close()
 		if err != nil {
-			fmt.Printf("chunker[%s]: body close failed: %s\n", chunker.id, err)
+			logf("chunker[%s]: body close failed: %s\n", chunker.id, err)
 		}
 	}()
 	defer close(pubChan)
 
 	var failure error
-	mr := multipart.NewReader(body, chunker.boundary)
+	source := &ingestReader{
+		r:     body,
+		bytes: ingestBytesCounter.WithLabelValues(chunker.id),
+		stop:  stop,
+	}
+	br := bufio.NewReaderSize(source, chunker.bufferSize())
+	var framesRead int
+	var bytesRead int64
+	defer func() {
+		chunker.tuneBuffer(framesRead, bytesRead)
+	}()
+	mr := multipart.NewReader(br, boundary)
 
 	var ticker *time.Ticker
 	firstFrame := true
@@ -236,28 +640,51 @@ func (chunker *Chunker) Start(pubChan chan []byte) {
 		ticker = time.NewTicker(time.Duration(interval))
 	}
 
+	var frameErrors int
+	var lengthErrors int
+	var lengthWarning time.Time
+	var jpegErrors int
+	var jpegWarning time.Time
+	var lastGood []byte
+	var lastGoodAt time.Time
+	var dumper *frameDumper
+	if chunker.dumpDir != "" && chunker.dumpFrames > 0 {
+		dumper = newFrameDumper(chunker.id, chunker.dumpDir, chunker.dumpFrames)
+	}
 	var frameCounter int32
 	if frameTimeout > 0 {
-		go chunker.watcher(frameTimeout, &frameCounter)
+		go chunker.watcher(frameTimeout, &frameCounter, stop, cancel)
 	}
 
 ChunkLoop:
 	for {
 		part, err := mr.NextPart()
 		atomic.AddInt32(&frameCounter, 1)
+		if err != nil && err != io.EOF && !errors.Is(err, source.err) {
+			err = &corruptPartError{err}
+			if chunker.skipFrame(err, &frameErrors) {
+				part, err = resync(mr, source)
+			}
+		}
 		if err == io.EOF {
 			break ChunkLoop
 		}
 		if err != nil {
-			failure = err
+			failure = partError(err)
 			break ChunkLoop
 		}
 
-		data, err := ioutil.ReadAll(part)
+		data, err := readPart(part)
 		if err != nil {
 			failure = err
 			break ChunkLoop
 		}
+		captured := time.Now()
+		framesRead++
+		bytesRead += int64(len(data))
+		if dumper != nil {
+			dumper.dump(part.Header, data)
+		}
 
 		err = part.Close()
 		if err != nil {
@@ -265,13 +692,59 @@ ChunkLoop:
 			break ChunkLoop
 		}
 
+		// mixed content sources interleave other parts with the frames
+		if contentType := part.Header.Get("Content-Type"); !isImagePart(contentType) {
+			if chunker.metadata != nil {
+				chunker.metadata.publish(metadataPart{contentType, data})
+			}
+			continue ChunkLoop
+		}
+
+		// the multipart reader already continues at the next boundary,
+		// so frames of the wrong size only need to be dropped
+		if chunker.validateLength {
+			data, err = checkLength(part, data)
+			if err != nil {
+				lengthErrors++
+				if time.Since(lengthWarning) >= lengthWarningInterval {
+					logf("chunker[%s]: dropped %d frames: %s\n",
+						chunker.id, lengthErrors, err)
+					lengthErrors = 0
+					lengthWarning = time.Now()
+				}
+				continue ChunkLoop
+			}
+		}
+
 		if len(data) == 0 {
-			failure = errors.New("received final chunk of size 0")
+			if chunker.skipFrame(errEmptyFrame, &frameErrors) {
+				continue ChunkLoop
+			}
+			failure = errEmptyFrame
 			break ChunkLoop
 		}
+		frameErrors = 0
+
+		// broken frames are replaced by the last good one for a while,
+		// so displays do not glitch during short bursts of corruption
+		replaced := false
+		if chunker.validateJPEG && !jpegComplete(data) {
+			jpegErrors++
+			if time.Since(jpegWarning) >= lengthWarningInterval {
+				logf("chunker[%s]: %d frames without JPEG start or end\n",
+					chunker.id, jpegErrors)
+				jpegErrors = 0
+				jpegWarning = time.Now()
+			}
+			if lastGood == nil || time.Since(lastGoodAt) > chunker.lastGoodAge {
+				continue ChunkLoop
+			}
+			data = lastGood
+			replaced = true
+		}
 
 		select { // check for stop
-		case <-chunker.stop:
+		case <-stop:
 			break ChunkLoop
 		default:
 		}
@@ -285,23 +758,70 @@ ChunkLoop:
 		}
 
 		firstFrame = false
-		pubChan <- data
+		if !replaced {
+			data = chunker.process(data)
+			if chunker.lastGoodAge > 0 {
+				lastGood = data
+				lastGoodAt = time.Now()
+			}
+		}
+		debugf(chunker.id, "chunker[%s]: frame of %d bytes\n", chunker.id, len(data))
+		select {
+		case pubChan <- Frame{Data: data, Captured: captured}:
+		case <-stop: // nobody is reading anymore
+			break ChunkLoop
+		}
 	}
 
 	if ticker != nil {
 		ticker.Stop()
 	}
-	chunker.cancel()
+	cancel()
 
 	if failure != nil {
-		fmt.Printf("chunker[%s]: failed: %s\n", chunker.id, failure)
+		logf("chunker[%s]: failed: %s\n", chunker.id, failure)
 	} else {
-		fmt.Printf("chunker[%s]: stopped\n", chunker.id)
+		logf("chunker[%s]: stopped\n", chunker.id)
+	}
+	done <- failure
+}
+
+// process applies the per-stream frame transformations.
+func (chunker *Chunker) process(data []byte) []byte {
+	start := time.Now()
+	applied := false
+
+	if chunker.pipeline != nil {
+		applied = true
+		out, steps, err := chunker.pipeline.process(data)
+		if err != nil {
+			logf("chunker[%s]: transform failed: %s\n", chunker.id, err)
+		} else {
+			data = out
+		}
+		for _, name := range steps {
+			countTransform(chunker.id, stageSource, name)
+		}
 	}
+
+	if len(chunker.stripMarkers) > 0 {
+		applied = true
+		out := stripJPEG(data, chunker.stripMarkers)
+		if len(out) != len(data) {
+			countTransform(chunker.id, stageSource, "strip")
+		}
+		data = out
+	}
+
+	if applied {
+		observeTransform(chunker.id, stageSource, start)
+	}
+
+	return data
 }
 
 func (chunker *Chunker) Stop() {
-	fmt.Printf("chunker[%s]: stopping\n", chunker.id)
+	logf("chunker[%s]: stopping\n", chunker.id)
 	close(chunker.stop)
 }
 
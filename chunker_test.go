@@ -0,0 +1,822 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newAuthSource answers with 200 only to requests using the scheme, and
+// challenges all others with it.
+func newAuthSource(t *testing.T, scheme string, challenges *int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), scheme+" ") {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddInt32(challenges, 1)
+		if scheme == "Digest" {
+			w.Header().Set("WWW-Authenticate", `Digest realm="cam", nonce="abc", qop="auth"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cam"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAuthAutoFallsBackToBasic(t *testing.T) {
+	var challenges int32
+	source := newAuthSource(t, "Basic", &challenges)
+	chunker, err := NewChunker("/auth", configSource{
+		Source: source.URL, Username: "user", Password: "secret", Auth: authAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := chunker.request(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunker.closeResponse(resp)
+	}
+
+	// only the first request is challenged, later ones send Basic upfront
+	if challenges != 1 {
+		t.Errorf("challenges: got %d, want 1", challenges)
+	}
+	if scheme, _ := chunker.authScheme.Load().(string); scheme != authBasic {
+		t.Errorf("learned scheme: got %q", scheme)
+	}
+}
+
+func TestAuthAutoUsesDigest(t *testing.T) {
+	var challenges int32
+	source := newAuthSource(t, "Digest", &challenges)
+	chunker, err := NewChunker("/auth", configSource{
+		Source: source.URL, Username: "user", Password: "secret", Auth: authAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := chunker.request(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunker.closeResponse(resp)
+	if scheme, _ := chunker.authScheme.Load().(string); scheme != authDigest {
+		t.Errorf("learned scheme: got %q", scheme)
+	}
+}
+
+// A source offering both schemes gets digest, and never sees the password
+// in a basic header.
+func TestAuthAutoPrefersDigest(t *testing.T) {
+	var basic int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Basic ") {
+			atomic.AddInt32(&basic, 1)
+		}
+		if auth != "" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Add("WWW-Authenticate", `Basic realm="cam"`)
+		w.Header().Add("WWW-Authenticate", `Digest realm="cam", nonce="abc", qop="auth"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/auth", configSource{
+		Source: source.URL, Username: "user", Password: "secret", Auth: authAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := chunker.request(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunker.closeResponse(resp)
+	}
+	if scheme, _ := chunker.authScheme.Load().(string); scheme != authDigest {
+		t.Errorf("learned scheme: got %q", scheme)
+	}
+	if basic != 0 {
+		t.Errorf("basic credentials sent %d times", basic)
+	}
+}
+
+// The login form is posted before the first request, the session cookie
+// is reused and a session ended by the source logs in again.
+func TestSessionLogin(t *testing.T) {
+	var logins int32
+	var mu sync.Mutex
+	session := ""
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/login" {
+			if r.Method != http.MethodPost || r.FormValue("user") != "admin" || r.FormValue("pass") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			session = fmt.Sprintf("s%d", atomic.AddInt32(&logins, 1))
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: session, Path: "/"})
+			return
+		}
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != session {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/login", configSource{
+		Source: source.URL + "/video",
+		Login:  &configLogin{URL: "/login", Fields: map[string]string{"user": "admin", "pass": "secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int32{1, 1, 2} {
+		if i == 2 {
+			mu.Lock()
+			session = "" // the source forgets the session
+			mu.Unlock()
+		}
+		resp, err := chunker.request(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("request %d: got status %d", i, resp.StatusCode)
+		}
+		chunker.closeResponse(resp)
+		if got := atomic.LoadInt32(&logins); got != want {
+			t.Errorf("request %d: got %d logins, want %d", i, got, want)
+		}
+	}
+}
+
+// The connect loop and /debug/raw send requests at the same time, run
+// with -race.
+func TestAuthSchemeConcurrentRequests(t *testing.T) {
+	var challenges int32
+	source := newAuthSource(t, "Basic", &challenges)
+	chunker, err := NewChunker("/auth", configSource{
+		Source: source.URL, Username: "user", Password: "secret", Auth: authAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := chunker.request(context.Background(), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			chunker.closeResponse(resp)
+		}()
+	}
+	wg.Wait()
+}
+
+// Reconnects to a source that ends its streams cleanly reuse the
+// connection of the shared transport, unless reuse is disabled.
+func TestUpstreamReuse(t *testing.T) {
+	var conns int32
+	source := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, "--B\r\nContent-Type: image/jpeg\r\n\r\none\r\n--B--\r\n")
+	}))
+	source.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	source.Start()
+	defer source.Close()
+
+	old := upstreamReuse
+	defer func() { upstreamReuse = old }()
+
+	for _, reuse := range []bool{true, false} {
+		upstreamReuse = reuse
+		atomic.StoreInt32(&conns, 0)
+		chunker, err := NewChunker("/reuse", configSource{Source: source.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		transport := chunker.client.Transport
+
+		for i := 0; i < 3; i++ {
+			if err := chunker.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			pubChan := make(chan Frame)
+			done := chunker.Start(pubChan)
+			for range pubChan {
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			chunker.Stop()
+		}
+
+		if chunker.client.Transport != transport {
+			t.Errorf("reuse %v: transport replaced", reuse)
+		}
+		want := int32(1)
+		if !reuse {
+			want = 3
+		}
+		if got := atomic.LoadInt32(&conns); got != want {
+			t.Errorf("reuse %v: got %d connections, want %d", reuse, got, want)
+		}
+	}
+}
+
+// A source changing its boundary between connections is parsed with the
+// new one, as every response is read with its own boundary.
+func TestBoundaryChange(t *testing.T) {
+	var conns int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		boundary := fmt.Sprintf("B%d", atomic.AddInt32(&conns, 1))
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+		fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--%s--\r\n", boundary, boundary, boundary)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/boundary", configSource{Source: source.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"B1", "B2"} {
+		if err := chunker.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if chunker.boundary != want {
+			t.Errorf("boundary: got %q, want %q", chunker.boundary, want)
+		}
+		pubChan := make(chan Frame)
+		done := chunker.Start(pubChan)
+		var frames []string
+		for frame := range pubChan {
+			frames = append(frames, string(frame.Data))
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		chunker.Stop()
+
+		if len(frames) != 1 || frames[0] != want {
+			t.Errorf("connection %s: got frames %q", want, frames)
+		}
+	}
+}
+
+func TestSniffBoundary(t *testing.T) {
+	tests := []struct {
+		body     string
+		boundary string
+		err      error
+	}{
+		{"--frame\r\nContent-Type: image/jpeg\r\n", "frame", nil},
+		{"\r\n\r\n--myboundary \n", "myboundary", nil},
+		{"Content-Type: image/jpeg\r\n", "", errBoundaryNotFound},
+		{"--\r\n", "", errBoundaryNotFound},
+		{"--" + strings.Repeat("x", boundarySniffSize), "", errBoundaryNotFound},
+		{"--frame", "", io.EOF},
+	}
+	for _, test := range tests {
+		boundary, err := sniffBoundary(bufio.NewReader(strings.NewReader(test.body)))
+		if boundary != test.boundary || err != test.err {
+			t.Errorf("%.20q: got %q, %v, want %q, %v", test.body, boundary, err, test.boundary, test.err)
+		}
+	}
+}
+
+// A source without a boundary in its content type is only read when the
+// boundary may be taken from the body, starting with its first frame.
+func TestSniffedBoundarySource(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary")
+		io.WriteString(w, "--cam\r\nContent-Type: image/jpeg\r\n\r\none\r\n"+
+			"--cam\r\nContent-Type: image/jpeg\r\n\r\ntwo\r\n--cam--\r\n")
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/sniff", configSource{Source: source.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err == nil {
+		chunker.Stop()
+		t.Error("connected without a boundary")
+	}
+
+	chunker, err = NewChunker("/sniff", configSource{Source: source.URL, SniffBoundary: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+	var frames []string
+	for frame := range pubChan {
+		frames = append(frames, string(frame.Data))
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	chunker.Stop()
+
+	if want := []string{"one", "two"}; fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("got frames %q, want %q", frames, want)
+	}
+}
+
+func TestTuneBuffer(t *testing.T) {
+	tests := []struct {
+		max    int
+		frames int
+		bytes  int64
+		want   int
+	}{
+		{0, 10, 100000, 4096},        // tuning disabled
+		{65536, 0, 0, 4096},          // nothing read
+		{65536, 10, 100000, 15000},   // one and a half frames
+		{65536, 10, 10000000, 65536}, // up to the maximum
+		{65536, 10, 1000, 4096},      // down to the configured size
+	}
+	for _, test := range tests {
+		chunker, err := NewChunker("/buffer", configSource{Source: "http://127.0.0.1/", ReadBufferMax: test.max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunker.tuneBuffer(test.frames, test.bytes)
+		if got := chunker.bufferSize(); got != test.want {
+			t.Errorf("%+v: got %d", test, got)
+		}
+	}
+
+	// small changes keep the buffer size stable
+	chunker, _ := NewChunker("/buffer", configSource{Source: "http://127.0.0.1/", ReadBufferMax: 65536})
+	chunker.tuneBuffer(10, 100000)
+	chunker.tuneBuffer(10, 110000)
+	if got := chunker.bufferSize(); got != 15000 {
+		t.Errorf("after a small change: got %d", got)
+	}
+	chunker.tuneBuffer(10, 200000)
+	if got := chunker.bufferSize(); got != 30000 {
+		t.Errorf("after a large change: got %d", got)
+	}
+}
+
+// The frames read on a connection size the buffer of the next one.
+func TestTuneBufferOnReconnect(t *testing.T) {
+	frame := bytes.Repeat([]byte{0xaa}, 20000)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "--B\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n", frame)
+		}
+		io.WriteString(w, "--B--\r\n")
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/buffer", configSource{Source: source.URL, ReadBufferMax: 65536})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{defaultReadBuffer, 30000} {
+		if got := chunker.bufferSize(); got != want {
+			t.Errorf("buffer size: got %d, want %d", got, want)
+		}
+		if err := chunker.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		pubChan := make(chan Frame)
+		done := chunker.Start(pubChan)
+		for range pubChan {
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		chunker.Stop()
+	}
+}
+
+// BenchmarkReadPart compares the allocations for reading parts with and
+// without a Content-Length to size the buffer from.
+func BenchmarkReadPart(b *testing.B) {
+	frame := bytes.Repeat([]byte{0xaa}, 200*1024)
+	for _, length := range []bool{false, true} {
+		b.Run(fmt.Sprintf("contentlength=%v", length), func(b *testing.B) {
+			var body bytes.Buffer
+			body.WriteString("--B\r\nContent-Type: image/jpeg\r\n")
+			if length {
+				fmt.Fprintf(&body, "Content-Length: %d\r\n", len(frame))
+			}
+			body.WriteString("\r\n")
+			body.Write(frame)
+			body.WriteString("\r\n--B--\r\n")
+			data := body.Bytes()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mr := multipart.NewReader(bytes.NewReader(data), "B")
+				part, err := mr.NextPart()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := readPart(part); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// A source sending frame data right after the part headers fails with a
+// readable error instead of one quoting the binary data.
+func TestMissingHeaderBlankLine(t *testing.T) {
+	body := "--B\r\nContent-Type: image/jpeg\r\n\xff\xd8\x00binary\xff\xd9\r\n--B--\r\n"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, body)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/noblankline", configSource{Source: source.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+	for range pubChan {
+		t.Error("frame published from a part without headers end")
+	}
+	err = <-done
+	chunker.Stop()
+	if err == nil {
+		t.Fatal("no error for the missing blank line")
+	}
+	if !strings.Contains(err.Error(), "empty line") || strings.Contains(err.Error(), "binary") {
+		t.Errorf("error: %q", err)
+	}
+}
+
+func TestRecoverableError(t *testing.T) {
+	tests := []struct {
+		err         error
+		recoverable bool
+	}{
+		{&corruptPartError{errors.New("multipart: expecting a new Part")}, true},
+		{fmt.Errorf("frame: %w", errEmptyFrame), true},
+		{io.ErrUnexpectedEOF, false},
+		{context.Canceled, false},
+		// the message alone does not make a parse error
+		{errors.New("multipart: unexpected line in Next(): x"), false},
+	}
+	for _, test := range tests {
+		if got := recoverableError(test.err); got != test.recoverable {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.recoverable)
+		}
+	}
+}
+
+// Corrupt parts are skipped without losing the frames read ahead with
+// them, also when the reader resyncs more than once.
+func TestResyncKeepsBufferedFrames(t *testing.T) {
+	good := func(data string) string {
+		return "--B\r\nContent-Type: image/jpeg\r\n\r\n" + data + "\r\n"
+	}
+	corrupt := "--B\r\nbroken header line\r\n\r\njunk\r\n"
+	body := good("one") + corrupt + good("two") + good("three") +
+		corrupt + good("four") + "--B--\r\n"
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, body)
+	}))
+	defer source.Close()
+
+	for _, readBuffer := range []int{0, 64} {
+		chunker, err := NewChunker("/resync", configSource{
+			Source: source.URL, MaxFrameErrors: 5, ReadBuffer: readBuffer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chunker.Connect(); err != nil {
+			t.Fatal(err)
+		}
+
+		pubChan := make(chan Frame)
+		done := chunker.Start(pubChan)
+		var frames []string
+		for frame := range pubChan {
+			frames = append(frames, string(frame.Data))
+		}
+		if err := <-done; err != nil {
+			t.Errorf("read buffer %d: %s", readBuffer, err)
+		}
+		chunker.Stop()
+
+		want := []string{"one", "two", "three", "four"}
+		if fmt.Sprint(frames) != fmt.Sprint(want) {
+			t.Errorf("read buffer %d: got frames %q, want %q", readBuffer, frames, want)
+		}
+	}
+}
+
+// A source ending in the middle of a part fails instead of being skipped
+// like a corrupt part.
+func TestTruncatedPartFails(t *testing.T) {
+	body := "--B\r\nContent-Type: image/jpeg\r\n\r\none\r\n--B\r\nContent-Ty"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, body)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/truncated", configSource{Source: source.URL, MaxFrameErrors: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+	frames := 0
+	for range pubChan {
+		frames++
+	}
+	if err := <-done; err == nil {
+		t.Error("no error for the truncated part")
+	}
+	chunker.Stop()
+	if frames != 1 {
+		t.Errorf("frames: got %d, want 1", frames)
+	}
+}
+
+// Frames not matching their Content-Length are dropped without losing the
+// ones after them, trailing line breaks are only trimmed.
+func TestValidateLength(t *testing.T) {
+	part := func(length int, data string) string {
+		return fmt.Sprintf("--B\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n%s\r\n", length, data)
+	}
+	body := part(3, "one") +
+		part(10, "two") + // cut short
+		part(3, "threeee") + // ran into the next frame
+		part(4, "four\r\n") +
+		"--B\r\nContent-Type: image/jpeg\r\n\r\nfive\r\n" +
+		"--B--\r\n"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, body)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/length", configSource{Source: source.URL, ValidateLength: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+	var frames []string
+	for frame := range pubChan {
+		frames = append(frames, string(frame.Data))
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	chunker.Stop()
+
+	want := []string{"one", "four", "five"}
+	if fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("got frames %q, want %q", frames, want)
+	}
+}
+
+// Broken JPEG frames are dropped, or replaced by the last good frame while
+// it is younger than LastGoodSeconds.
+func TestLastGoodFrame(t *testing.T) {
+	good1, good2, bad := "\xff\xd8one\xff\xd9", "\xff\xd8two\xff\xd9\r\n", "\xff\xd8bad"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, "--B\r\n")
+		for _, data := range []string{good1, bad, "", bad, good2} {
+			if data == "" {
+				// the first broken frame ends with the boundary
+				// sent before the pause
+				w.(http.Flusher).Flush()
+				time.Sleep(200 * time.Millisecond)
+				continue
+			}
+			fmt.Fprintf(w, "Content-Type: image/jpeg\r\n\r\n%s\r\n--B", data)
+			if data != good2 {
+				io.WriteString(w, "\r\n")
+			}
+		}
+		io.WriteString(w, "--\r\n")
+	}))
+	defer source.Close()
+
+	tests := []struct {
+		lastGood float64
+		want     []string
+	}{
+		{0, []string{good1, good2}},
+		{0.1, []string{good1, good1, good2}},
+		{10, []string{good1, good1, good1, good2}},
+	}
+	for _, test := range tests {
+		chunker, err := NewChunker("/lastgood", configSource{
+			Source: source.URL, ValidateJPEG: true, LastGoodSeconds: test.lastGood,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chunker.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		pubChan := make(chan Frame)
+		done := chunker.Start(pubChan)
+		var frames []string
+		for frame := range pubChan {
+			frames = append(frames, string(frame.Data))
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		chunker.Stop()
+
+		if fmt.Sprintf("%q", frames) != fmt.Sprintf("%q", test.want) {
+			t.Errorf("last good %gs: got frames %q, want %q", test.lastGood, frames, test.want)
+		}
+	}
+}
+
+// A source sending chunks that cross part boundaries has all its frames
+// forwarded, the transport decodes the chunked body for the parser.
+func TestChunkedSource(t *testing.T) {
+	var body bytes.Buffer
+	var want []string
+	for i := 0; i < 5; i++ {
+		frame := fmt.Sprintf("frame %d data", i)
+		want = append(want, frame)
+		fmt.Fprintf(&body, "--B\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n", frame)
+	}
+	body.WriteString("--B--\r\n")
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		data := body.Bytes()
+		for len(data) > 0 {
+			n := min(7, len(data))
+			w.Write(data[:n])
+			w.(http.Flusher).Flush()
+			data = data[n:]
+		}
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/chunked", configSource{Source: source.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if te := chunker.resp.TransferEncoding; len(te) != 1 || te[0] != "chunked" {
+		t.Fatalf("source not chunked: %v", te)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+	var frames []string
+	for frame := range pubChan {
+		frames = append(frames, string(frame.Data))
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	chunker.Stop()
+
+	if fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("got frames %q, want %q", frames, want)
+	}
+}
+
+// Sources interleaving XML event parts with the frames only publish the
+// images as frames, the other parts go to the metadata clients.
+func TestMixedContentParts(t *testing.T) {
+	part := func(contentType, data string) string {
+		return "--B\r\nContent-Type: " + contentType + "\r\n\r\n" + data + "\r\n"
+	}
+	body := part("image/jpeg", "one") +
+		part("application/xml", "<event>1</event>") +
+		part("image/jpeg", "two") +
+		part("text/xml; charset=utf-8", "<event>2</event>") +
+		part("IMAGE/JPEG", "three") +
+		"--B--\r\n"
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		io.WriteString(w, body)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/mixed", configSource{Source: source.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunker.metadata = newMetadataHub()
+	parts := chunker.metadata.subscribe()
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+
+	// each metadata part is published before the next frame is sent
+	var frames, metadata []string
+	for frame := range pubChan {
+		frames = append(frames, string(frame.Data))
+		if len(frames) < 3 {
+			part := <-parts
+			metadata = append(metadata, part.contentType+" "+string(part.data))
+		}
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	chunker.Stop()
+
+	if want := []string{"one", "two", "three"}; fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("frames: got %q, want %q", frames, want)
+	}
+	want := []string{"application/xml <event>1</event>", "text/xml; charset=utf-8 <event>2</event>"}
+	if fmt.Sprint(metadata) != fmt.Sprint(want) {
+		t.Errorf("metadata: got %q, want %q", metadata, want)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"net/http"
+	"time"
+)
+
+// Caps keeping contact sheets cheap to composite.
+const (
+	contactSheetMaxTiles     = 64
+	contactSheetMaxTileWidth = 640
+)
+
+// configContactSheet enables an image tiling recent frames of the stream
+// in a grid, taking one frame every IntervalSeconds.
+type configContactSheet struct {
+	Path            string
+	Columns         int
+	Rows            int
+	TileWidth       int
+	IntervalSeconds float64
+}
+
+// contactSheet composites the frames kept by the pubsub loop.
+type contactSheet struct {
+	pubSub    *PubSub
+	columns   int
+	rows      int
+	tileWidth int
+}
+
+// normalized applies the defaults and caps to the configuration.
+func (conf configContactSheet) normalized() configContactSheet {
+	if conf.Columns <= 0 {
+		conf.Columns = 4
+	}
+	if conf.Columns > contactSheetMaxTiles {
+		conf.Columns = contactSheetMaxTiles
+	}
+	if conf.Rows <= 0 {
+		conf.Rows = 3
+	}
+	if conf.Columns*conf.Rows > contactSheetMaxTiles {
+		conf.Rows = contactSheetMaxTiles / conf.Columns
+	}
+	if conf.TileWidth <= 0 || conf.TileWidth > contactSheetMaxTileWidth {
+		conf.TileWidth = 160
+	}
+	if conf.IntervalSeconds <= 0 {
+		conf.IntervalSeconds = 1
+	}
+	return conf
+}
+
+func newContactSheet(pubSub *PubSub, conf configContactSheet) *contactSheet {
+	conf = conf.normalized()
+	return &contactSheet{
+		pubSub:    pubSub,
+		columns:   conf.Columns,
+		rows:      conf.Rows,
+		tileWidth: conf.TileWidth,
+	}
+}
+
+func (sheet *contactSheet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+		sheet.pubSub.httpError(w, r, errorMethod, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	header.Set("Pragma", "no-cache")
+	header.Set("Expires", "0")
+
+	// probes only get the headers, compositing is too costly for them
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	release, ok := sheet.pubSub.limitUser(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// frames are only kept while the source is connected, wait for one
+	// so a sheet can be made even if nobody was watching
+	frames := sheet.pubSub.RecentFrames()
+	if len(frames) == 0 {
+		sub := NewSubscriber(clientAddress(r))
+		sheet.pubSub.Subscribe(sub)
+		defer sheet.pubSub.Unsubscribe(sub)
+		setupDone(r)
+
+		timer := time.NewTimer(snapshotTimeout)
+		defer timer.Stop()
+
+		if !waitAdmitted(w, r, sub, timer) {
+			return
+		}
+		select {
+		case frame, ok := <-sub.ChunkChannel:
+			if !ok {
+				sheet.pubSub.httpError(w, r, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+				return
+			}
+			memoryRelease(len(frame.Data))
+		case <-timer.C:
+			sheet.pubSub.httpError(w, r, errorStreamIdle, "Stream idle timeout", http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		frames = sheet.pubSub.RecentFrames()
+	}
+
+	data, err := sheet.composite(frames)
+	if err != nil {
+		logf("server[%s]: contact sheet failed: %s\n", sheet.pubSub.id, err)
+		http.Error(w, "Contact sheet failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// composite tiles the frames, oldest first, with the tile height taken
+// from the aspect ratio of the newest frame.
+func (sheet *contactSheet) composite(frames [][]byte) ([]byte, error) {
+	width, height, _, ok := jpegDimensions(frames[len(frames)-1])
+	if !ok || width == 0 {
+		return nil, errJPEGMalformed
+	}
+	tileWidth := sheet.tileWidth
+	tileHeight := height * tileWidth / width
+	if tileHeight < 1 {
+		tileHeight = 1
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, sheet.columns*tileWidth, sheet.rows*tileHeight))
+	for i, data := range frames {
+		img, err := decodeJPEG(data)
+		if err != nil {
+			continue // leave the tile empty
+		}
+
+		x := i % sheet.columns * tileWidth
+		y := i / sheet.columns * tileHeight
+		tile := scaleImage(img, tileWidth, tileHeight)
+		draw.Draw(out, image.Rect(x, y, x+tileWidth, y+tileHeight), tile, image.Point{}, draw.Src)
+	}
+
+	return encodeJPEG(out)
+}
@@ -0,0 +1,107 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContactSheet(t *testing.T) {
+	frame := testJPEG(t, 32, 16, color.White)
+	source := newTestSource(t, frame, 10*time.Millisecond)
+	conf := configContactSheet{Path: "/sheet", Columns: 2, Rows: 1, TileWidth: 20, IntervalSeconds: 0.01}
+	pubSub := newTestStream(t, "/sheet", configSource{Source: source.URL, ContactSheet: &conf})
+
+	server := httptest.NewServer(newContactSheet(pubSub, conf))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 10 {
+		t.Errorf("sheet size: got %dx%d, want 40x10", b.Dx(), b.Dy())
+	}
+}
+
+// The frames kept for the sheet count against the memory limit until they
+// are dropped. Frames are published directly, without a running loop.
+func TestContactSheetMemory(t *testing.T) {
+	used := memoryUsed()
+	frame := testJPEG(t, 32, 16, color.White)
+	conf := configContactSheet{Path: "/sheetmemory", Columns: 2, Rows: 1, IntervalSeconds: 1e-9}
+	pubSub := newTestPubSub(t, "/sheetmemory", configSource{ContactSheet: &conf})
+
+	for i := 0; i < 5; i++ {
+		pubSub.doPublish(Frame{Data: frame, Captured: time.Now()})
+		time.Sleep(time.Millisecond)
+	}
+	if len(pubSub.recent) != 2 {
+		t.Fatalf("kept frames: got %d, want 2", len(pubSub.recent))
+	}
+	if got, want := memoryUsed()-used, int64(2*len(frame)); got != want {
+		t.Errorf("memory of kept frames: got %d, want %d", got, want)
+	}
+
+	pubSub.clearRecent()
+	if got := memoryUsed(); got != used {
+		t.Errorf("memory after clear: got %d, want %d", got, used)
+	}
+}
+
+// Probes get the headers without waiting for frames to composite.
+func TestContactSheetHead(t *testing.T) {
+	source := newStalledSource(t)
+	conf := configContactSheet{Path: "/sheethead"}
+	pubSub := newTestStream(t, "/sheethead", configSource{Source: source.URL, ContactSheet: &conf})
+
+	server := httptest.NewServer(newContactSheet(pubSub, conf))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Head(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("got status %d with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if pubSub.Status().Subscribers != 0 {
+		t.Error("HEAD request subscribed to the stream")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Time browsers may cache the answer to a preflight request.
+const corsMaxAge = "600"
+
+var (
+	corsOrigins     []string // origins allowed to embed the streams, * for any
+	corsCredentials bool     // allow requests with cookies or authorization
+)
+
+// checkCORS rejects allowing credentials for any origin, which would let
+// every site read the streams with the cookies or credentials of a user.
+func checkCORS() error {
+	if !corsCredentials {
+		return nil
+	}
+	for _, allowed := range corsOrigins {
+		if allowed == "*" {
+			return errors.New("corscredentials cannot be used with the * origin")
+		}
+	}
+	return nil
+}
+
+func corsAllowed(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds the CORS headers for allowed origins to a stream handler and
+// answers preflight requests before they reach it. Credentialed requests
+// cannot use the * origin, so the origin of the request is sent back.
+func cors(handler http.Handler) http.Handler {
+	if len(corsOrigins) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsAllowed(origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if corsCredentials {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Allow-Credentials", "true")
+		} else if len(corsOrigins) == 1 && corsOrigins[0] == "*" {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			header.Set("Access-Control-Allow-Headers", headers)
+		}
+		header.Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
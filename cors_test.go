@@ -0,0 +1,135 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setCORS(t *testing.T, origins []string, credentials bool) {
+	oldOrigins, oldCredentials := corsOrigins, corsCredentials
+	corsOrigins, corsCredentials = origins, credentials
+	t.Cleanup(func() {
+		corsOrigins, corsCredentials = oldOrigins, oldCredentials
+	})
+}
+
+func TestCheckCORS(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		credentials bool
+		ok          bool
+	}{
+		{nil, false, true},
+		{[]string{"*"}, false, true},
+		{[]string{"https://a.example"}, true, true},
+		{[]string{"*"}, true, false},
+		{[]string{"https://a.example", "*"}, true, false},
+	}
+
+	for _, test := range tests {
+		setCORS(t, test.origins, test.credentials)
+		err := checkCORS()
+		if (err == nil) != test.ok {
+			t.Errorf("origins %v credentials %v: got error %v", test.origins, test.credentials, err)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	setCORS(t, []string{"https://a.example"}, true)
+
+	called := false
+	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/cam", nil)
+	req.Header.Set("Origin", "https://a.example")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if !called {
+		t.Fatal("handler not called for allowed origin")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Errorf("allow origin: got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("allow credentials: got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/cam", nil)
+	req.Header.Set("Origin", "https://b.example")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("other origin allowed: got %q", got)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	setCORS(t, []string{"*"}, false)
+
+	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight reached the handler")
+	}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/cam", nil)
+	req.Header.Set("Origin", "https://a.example")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("status: got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("allow origin: got %q", got)
+	}
+}
+
+// Only the stream handlers get CORS headers, the preflight is answered
+// before the stream users are checked.
+func TestCORSStreamHandlersOnly(t *testing.T) {
+	setCORS(t, []string{"*"}, false)
+
+	pubSub := &PubSub{id: "/cors", users: map[string]string{"user": "secret"}, realm: defaultRealm}
+	mux := http.NewServeMux()
+	mux.Handle("/cors", cors(pubSub.authenticate(http.NotFoundHandler())))
+	mux.HandleFunc("/api/info", infoEndpoint)
+
+	req := httptest.NewRequest(http.MethodOptions, "/cors", nil)
+	req.Header.Set("Origin", "https://a.example")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("stream preflight: got status %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/info", nil)
+	req.Header.Set("Origin", "https://a.example")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("info endpoint got CORS header %q", got)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Minimum time between starting two raw debug streams, as each one
+// opens an additional connection to the upstream source.
+const debugRawInterval = 10 * time.Second
+
+var (
+	debugRawLock sync.Mutex
+	debugRawLast time.Time
+)
+
+func debugRawAllowed() bool {
+	debugRawLock.Lock()
+	defer debugRawLock.Unlock()
+
+	now := time.Now()
+	if now.Sub(debugRawLast) < debugRawInterval {
+		return false
+	}
+
+	debugRawLast = now
+	return true
+}
+
+// debugRawEndpoint is a debug-only endpoint streaming the verbatim bytes
+// received from the upstream source, using a dedicated connection.
+func debugRawEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/debug/raw")
+	pubSub := findPubSub(id)
+	if pubSub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&pubSub.debugRaw, 0, 1) {
+		http.Error(w, "Raw stream already active", http.StatusTooManyRequests)
+		return
+	}
+	defer atomic.StoreInt32(&pubSub.debugRaw, 0)
+
+	if !debugRawAllowed() {
+		http.Error(w, "Raw stream rate limited", http.StatusTooManyRequests)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logf("debug[%s]: client %s could not be flushed\n",
+			pubSub.id, r.RemoteAddr)
+		return
+	}
+
+	logf("debug[%s]: raw stream started for %s\n", pubSub.id, clientAddress(r))
+	defer logf("debug[%s]: raw stream stopped for %s\n", pubSub.id, clientAddress(r))
+
+	resp, err := pubSub.chunker.request(r.Context(), nil)
+	if err != nil {
+		logf("debug[%s]: raw stream failed: %s\n", pubSub.id, err)
+		http.Error(w, "Upstream request failed", http.StatusBadGateway)
+		return
+	}
+	defer pubSub.chunker.closeResponse(resp)
+
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	for _, k := range []string{"Connection", "Content-Length", "Keep-Alive", "Transfer-Encoding"} {
+		header.Del(k)
+	}
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Debug", "raw upstream stream")
+	w.WriteHeader(resp.StatusCode)
+	setupDone(r)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The raw endpoint passes the upstream bytes through unchanged, including
+// parts the chunker would reject.
+func TestDebugRaw(t *testing.T) {
+	canned := []byte("--B\r\nContent-Type: image/jpeg\r\nX-Camera: 1\r\n\r\n\xff\xd8junk\xff\xd9\r\n" +
+		"--B\r\nbroken header\r\n\r\n\x00\x01\x02\r\n--B--\r\n")
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		w.Header().Set("Server", "TestCam/1.0")
+		w.Write(canned)
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/raw", configSource{Source: source.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setStreams(t, NewPubSub("/raw", chunker, configSource{}))
+
+	old := debugRawLast
+	debugRawLast = time.Time{}
+	defer func() { debugRawLast = old }()
+
+	server := httptest.NewServer(http.HandlerFunc(debugRawEndpoint))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/raw/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, canned) {
+		t.Errorf("body: got %q, want %q", body, canned)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "multipart/x-mixed-replace; boundary=B" {
+		t.Errorf("content type: got %q", got)
+	}
+	if got := resp.Header.Get("Server"); got != "TestCam/1.0" {
+		t.Errorf("upstream headers not passed on: server %q", got)
+	}
+
+	// each raw stream opens another upstream connection, so they are spaced
+	resp, err = http.Get(server.URL + "/debug/raw/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second raw stream: got status %d", resp.StatusCode)
+	}
+}
@@ -28,17 +28,31 @@ import (
 	"strings"
 )
 
-func digestAuthRequested(resp *http.Response) bool {
-	return resp.StatusCode == http.StatusUnauthorized &&
-		strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Digest ")
+// authChallenge returns the first WWW-Authenticate challenge of a 401
+// response that uses the given scheme.
+func authChallenge(resp *http.Response, scheme string) (string, bool) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", false
+	}
+	for _, challenge := range resp.Header.Values("WWW-Authenticate") {
+		challenge = strings.TrimSpace(challenge)
+		name := strings.SplitN(challenge, " ", 2)[0]
+		if strings.EqualFold(name, scheme) {
+			return challenge, true
+		}
+	}
+	return "", false
 }
 
-func digestAuthBuild(username, password, uri string, resp *http.Response) string {
-	auth := strings.TrimPrefix(resp.Header.Get("WWW-Authenticate"), "Digest ")
+func digestAuthBuild(username, password, uri, challenge string) string {
+	auth := strings.TrimSpace(strings.TrimPrefix(challenge, strings.SplitN(challenge, " ", 2)[0]))
 	authMap := make(map[string]string)
 	authQop := false
 	for _, part := range strings.Split(auth, ",") {
 		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
 		key := kv[0]
 		val := strings.Trim(kv[1], `"`)
 		authMap[key] = val
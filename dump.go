@@ -0,0 +1,140 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Upper limit for frames dumped per connect, whatever is configured.
+const maxDumpFrames = 100
+
+// frameDumper saves the first parts read after a connect, as received and
+// with their headers, for looking into sources that are parsed wrongly.
+// The files of the previous connect are replaced, so the disk use stays
+// bounded by the number of frames.
+type frameDumper struct {
+	id      string
+	dir     string
+	prefix  string
+	limit   int
+	written int
+}
+
+func newFrameDumper(id, dir string, limit int) *frameDumper {
+	if limit > maxDumpFrames {
+		limit = maxDumpFrames
+	}
+
+	dumper := &frameDumper{
+		id:     id,
+		dir:    dir,
+		prefix: statName(id) + "-",
+		limit:  limit,
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = dumper.clear()
+	}
+	if err != nil {
+		logf("chunker[%s]: dump: %s\n", id, err)
+		dumper.limit = 0
+	}
+
+	return dumper
+}
+
+// clear removes the dump of the previous connect. Only files named like
+// the dump of the stream are removed, not those of streams sharing the
+// prefix, like a-b for a, or other files in the directory.
+func (dumper *frameDumper) clear() error {
+	infos, err := ioutil.ReadDir(dumper.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !dumper.owns(info.Name()) {
+			continue
+		}
+		err = os.Remove(filepath.Join(dumper.dir, info.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// owns reports whether the file name is one written by dump, the prefix
+// followed by three digits and the extension.
+func (dumper *frameDumper) owns(name string) bool {
+	if !strings.HasPrefix(name, dumper.prefix) {
+		return false
+	}
+	name = name[len(dumper.prefix):]
+	if len(name) < 3 || strings.Trim(name[:3], "0123456789") != "" {
+		return false
+	}
+	return name[3:] == ".txt" || name[3:] == ".part"
+}
+
+// dump writes the part body and a text file with its headers.
+func (dumper *frameDumper) dump(header textproto.MIMEHeader, data []byte) {
+	if dumper.written >= dumper.limit {
+		return
+	}
+	dumper.written++
+
+	name := filepath.Join(dumper.dir, fmt.Sprintf("%s%03d", dumper.prefix, dumper.written))
+
+	var text bytes.Buffer
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&text, "%s: %s\n", key, value)
+		}
+	}
+	fmt.Fprintf(&text, "\nRead %d bytes\n", len(data))
+
+	err := ioutil.WriteFile(name+".txt", text.Bytes(), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(name+".part", data, 0644)
+	}
+	if err != nil {
+		logf("chunker[%s]: dump: %s\n", dumper.id, err)
+		dumper.limit = 0
+		return
+	}
+
+	if dumper.written == dumper.limit {
+		logf("chunker[%s]: dumped %d frames to %s\n", dumper.id, dumper.written, dumper.dir)
+	}
+}
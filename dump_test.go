@@ -0,0 +1,108 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFrameDumper(t *testing.T) {
+	dir := t.TempDir()
+	dumper := newFrameDumper("/cam", dir, 2)
+
+	header := textproto.MIMEHeader{"Content-Type": {"image/jpeg"}, "Content-Length": {"3"}}
+	for i := 0; i < 3; i++ {
+		dumper.dump(header, []byte("abc"))
+	}
+
+	want := []string{"cam-001.part", "cam-001.txt", "cam-002.part", "cam-002.txt"}
+	if got := listDir(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files: got %v, want %v", got, want)
+	}
+	text, _ := ioutil.ReadFile(filepath.Join(dir, "cam-001.txt"))
+	if !strings.Contains(string(text), "Content-Type: image/jpeg\n") ||
+		!strings.Contains(string(text), "Read 3 bytes") {
+		t.Errorf("header dump: got %q", text)
+	}
+}
+
+func TestFrameDumperLimit(t *testing.T) {
+	if got := newFrameDumper("/cam", t.TempDir(), 1000).limit; got != maxDumpFrames {
+		t.Errorf("limit: got %d, want %d", got, maxDumpFrames)
+	}
+}
+
+// A new connect only clears the dump of its own stream.
+func TestFrameDumperClear(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"cam-001.part", "cam-001.txt", "cam-099.part", // own dump
+		"cam-b-001.part", "cam-b-001.txt", // stream /cam/b
+		"cam-20260101T000000.000Z.jpg", // sample of the stream
+		"cam-notes.txt", "cam-0001.part", "cam-001.jpg",
+	}
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newFrameDumper("/cam", dir, 10)
+
+	want := []string{"cam-0001.part", "cam-001.jpg", "cam-20260101T000000.000Z.jpg",
+		"cam-b-001.part", "cam-b-001.txt", "cam-notes.txt"}
+	if got := listDir(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files left: got %v, want %v", got, want)
+	}
+}
+
+func TestDumpSampleSameDir(t *testing.T) {
+	dir := t.TempDir()
+	err := startSource(configSource{
+		Source:  "http://127.0.0.1:1/",
+		Path:    "/dumpsample",
+		DumpDir: dir,
+		Sample:  &configSample{Dir: dir + string(os.PathSeparator)},
+	})
+	if err == nil || !strings.Contains(err.Error(), "must differ") {
+		t.Errorf("got error %v", err)
+	}
+}
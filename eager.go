@@ -0,0 +1,52 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// Wait before subscribing an eager stream again after a failure.
+const eagerRetryDelay = 5 * time.Second
+
+// Time over which the first connects of eager streams are spread.
+var startupRamp time.Duration
+
+// keepConnected holds an internal subscriber on the stream, so the source
+// is connected from startup on instead of with the first client.
+func (pubSub *PubSub) keepConnected(delay time.Duration) {
+	time.Sleep(delay)
+	pubSub.follow("eager", false, eagerRetryDelay, nil, func(Frame) bool {
+		return true
+	})
+}
+
+// startEager connects the eager streams, spreading the connects evenly
+// over the startup ramp so the sources are not all hit at once.
+func startEager(streams []*PubSub) {
+	for i, pubSub := range streams {
+		delay := time.Duration(0)
+		if len(streams) > 1 {
+			delay = startupRamp * time.Duration(i) / time.Duration(len(streams))
+		}
+		logf("pubsub[%s]: connecting eagerly in %s\n", pubSub.id, delay)
+		go pubSub.keepConnected(delay)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Eager streams are connected one after the other over the startup ramp.
+func TestStartEagerStaggered(t *testing.T) {
+	const n = 5
+	old := startupRamp
+	startupRamp = 500 * time.Millisecond
+	defer func() { startupRamp = old }()
+
+	var mu sync.Mutex
+	connected := make([]time.Time, n)
+	streams := make([]*PubSub, n)
+	for i := range streams {
+		i := i
+		source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			if connected[i].IsZero() {
+				connected[i] = time.Now()
+			}
+			mu.Unlock()
+			w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+		t.Cleanup(func() {
+			source.CloseClientConnections()
+			source.Close()
+		})
+		streams[i] = newTestStream(t, fmt.Sprintf("/eager%d", i), configSource{Source: source.URL})
+	}
+
+	start := time.Now()
+	startEager(streams)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		last := connected[n-1]
+		mu.Unlock()
+		if !last.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("streams not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	step := startupRamp / n
+	for i, at := range connected {
+		if at.IsZero() {
+			t.Fatalf("stream %d not connected", i)
+		}
+		if min := start.Add(time.Duration(i) * step); at.Before(min) {
+			t.Errorf("stream %d connected %s early", i, min.Sub(at))
+		}
+		if i > 0 && at.Sub(connected[i-1]) < step/2 {
+			t.Errorf("stream %d connected %s after stream %d", i, at.Sub(connected[i-1]), i-1)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// Reasons for error responses, available to error page templates.
+const (
+	errorStreamFailed = "stream_failed"
+	errorStreamIdle   = "idle_timeout"
+	errorMethod       = "method_not_allowed"
+	errorUnauthorized = "unauthorized"
+)
+
+// defaultErrorPage is used by streams without their own error page.
+var defaultErrorPage *errorPage
+
+// configErrorPage replaces the plain text error responses of a stream.
+// The body file and redirect URL are templates, see errorPageData.
+type configErrorPage struct {
+	Status         int // replaces the status of the error if set
+	ContentType    string
+	File           string
+	Redirect       string
+	RedirectStatus int // 301, 302, 303, 307 or 308, 302 if not set
+}
+
+type errorPage struct {
+	status      int
+	contentType string
+	body        interface {
+		Execute(w io.Writer, data interface{}) error
+	}
+	redirect       *template.Template
+	redirectStatus int
+}
+
+// errorPageData is passed to the templates.
+type errorPageData struct {
+	Stream     string
+	Reason     string
+	Message    string
+	Status     int
+	StatusText string
+}
+
+func newErrorPage(conf configErrorPage) (*errorPage, error) {
+	page := &errorPage{
+		status:      conf.Status,
+		contentType: conf.ContentType,
+	}
+	if page.contentType == "" {
+		page.contentType = "text/html; charset=utf-8"
+	}
+
+	switch conf.RedirectStatus {
+	case 0:
+		page.redirectStatus = http.StatusFound
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		page.redirectStatus = conf.RedirectStatus
+	default:
+		return nil, fmt.Errorf("invalid error page redirect status: %d", conf.RedirectStatus)
+	}
+
+	if conf.Redirect != "" {
+		redirect, err := template.New("redirect").Parse(conf.Redirect)
+		if err != nil {
+			return nil, err
+		}
+		page.redirect = redirect
+	}
+
+	if conf.File != "" {
+		text, err := ioutil.ReadFile(conf.File)
+		if err != nil {
+			return nil, err
+		}
+
+		// escape the values in HTML pages, others are used as they are
+		if strings.Contains(page.contentType, "html") {
+			page.body, err = htmltemplate.New(conf.File).Parse(string(text))
+		} else {
+			page.body, err = template.New(conf.File).Parse(string(text))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// protocolError reports whether the status of an error is part of the
+// protocol, like the 401 a browser needs to ask for credentials or the
+// 405 going with the Allow header, so it must never be redirected or
+// replaced by the error page.
+func protocolError(reason string) bool {
+	return reason == errorUnauthorized || reason == errorMethod
+}
+
+// httpError responds with the error page of the stream, or a plain text
+// error like http.Error if it has none.
+func (pubSub *PubSub) httpError(w http.ResponseWriter, r *http.Request, reason, message string, status int) {
+	page := pubSub.errorPage
+	if page == nil {
+		page = defaultErrorPage
+	}
+	if page == nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := errorPageData{
+		Stream:     pubSub.id,
+		Reason:     reason,
+		Message:    message,
+		Status:     status,
+		StatusText: http.StatusText(status),
+	}
+
+	if page.redirect != nil && !protocolError(reason) {
+		var location bytes.Buffer
+		err := page.redirect.Execute(&location, data)
+		if err != nil {
+			logf("server[%s]: error page redirect failed: %s\n", pubSub.id, err)
+			http.Error(w, message, status)
+			return
+		}
+
+		http.Redirect(w, r, location.String(), page.redirectStatus)
+		return
+	}
+
+	var body bytes.Buffer
+	if page.body != nil {
+		err := page.body.Execute(&body, data)
+		if err != nil {
+			logf("server[%s]: error page failed: %s\n", pubSub.id, err)
+			http.Error(w, message, status)
+			return
+		}
+	} else {
+		body.WriteString(message + "\n")
+	}
+
+	if page.status != 0 && !protocolError(reason) {
+		status = page.status
+	}
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,151 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPageRedirect(t *testing.T) {
+	page, err := newErrorPage(configErrorPage{Redirect: "/offline.html?stream={{.Stream}}&reason={{.Reason}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := &PubSub{id: "/cam", errorPage: page}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/cam", nil)
+	pubSub.httpError(rec, req, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+	if rec.Code != http.StatusFound {
+		t.Errorf("status: got %d, want %d", rec.Code, http.StatusFound)
+	}
+	if got := rec.Header().Get("Location"); got != "/offline.html?stream=/cam&reason=stream_failed" {
+		t.Errorf("location: got %q", got)
+	}
+}
+
+// Redirects use their own status, the status of the page is not one.
+func TestErrorPageRedirectStatus(t *testing.T) {
+	page, err := newErrorPage(configErrorPage{
+		Redirect:       "/offline.html",
+		Status:         http.StatusServiceUnavailable,
+		RedirectStatus: http.StatusTemporaryRedirect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := &PubSub{id: "/cam", errorPage: page}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/cam", nil)
+	pubSub.httpError(rec, req, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "/offline.html" {
+		t.Errorf("got status %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotModified, http.StatusServiceUnavailable} {
+		_, err := newErrorPage(configErrorPage{Redirect: "/offline.html", RedirectStatus: status})
+		if err == nil {
+			t.Errorf("redirect status %d accepted", status)
+		}
+	}
+}
+
+func TestErrorPageBody(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "error.html")
+	err := ioutil.WriteFile(file, []byte("<p>{{.Stream}}: {{.Message}} ({{.Status}})</p>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := newErrorPage(configErrorPage{File: file, Status: http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := &PubSub{id: "/<cam>", errorPage: page}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/cam", nil)
+	pubSub.httpError(rec, req, errorStreamIdle, "Stream idle timeout", http.StatusGatewayTimeout)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status: got %d, want the configured %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Body.String(); got != "<p>/&lt;cam&gt;: Stream idle timeout (504)</p>" {
+		t.Errorf("body: got %q", got)
+	}
+}
+
+// Protocol errors keep their status even with a redirect or status set.
+func TestErrorPageProtocolErrors(t *testing.T) {
+	pages := []configErrorPage{
+		{Redirect: "/offline.html"},
+		{Status: http.StatusOK},
+	}
+	errors := []struct {
+		reason string
+		status int
+	}{
+		{errorUnauthorized, http.StatusUnauthorized},
+		{errorMethod, http.StatusMethodNotAllowed},
+	}
+
+	for _, conf := range pages {
+		page, err := newErrorPage(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubSub := &PubSub{id: "/cam", errorPage: page}
+
+		for _, e := range errors {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/cam", nil)
+			pubSub.httpError(rec, req, e.reason, "error", e.status)
+			if rec.Code != e.status {
+				t.Errorf("%+v %s: got status %d, want %d", conf, e.reason, rec.Code, e.status)
+			}
+			if rec.Header().Get("Location") != "" {
+				t.Errorf("%+v %s: redirected", conf, e.reason)
+			}
+		}
+	}
+}
+
+// Browsers only ask for credentials on a 401 with the challenge.
+func TestErrorPageUnauthorizedChallenge(t *testing.T) {
+	page, err := newErrorPage(configErrorPage{Redirect: "/login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := &PubSub{id: "/cam", errorPage: page, users: map[string]string{"user": "secret"}, realm: defaultRealm}
+	handler := pubSub.authenticate(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cam", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status: got %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("challenge: got %q", rec.Header().Get("WWW-Authenticate"))
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// latestFrame is the last frame published by a stream with its number.
+type latestFrame struct {
+	frame    Frame
+	sequence uint64
+}
+
+// frameInfo describes a frame without its data.
+type frameInfo struct {
+	Stream      string    `json:"stream"`
+	Sequence    uint64    `json:"sequence"`
+	Captured    time.Time `json:"captured"`
+	Age         float64   `json:"age"`
+	Size        int       `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Components  int       `json:"components,omitempty"`
+	Progressive bool      `json:"progressive"`
+}
+
+// LatestFrame returns the last frame published while the source is
+// connected, or a frame without data if there is none.
+func (pubSub *PubSub) LatestFrame() (Frame, uint64) {
+	reply := make(chan latestFrame, 1)
+	pubSub.latestChan <- reply
+	latest := <-reply
+	return latest.frame, latest.sequence
+}
+
+// frameInfoEndpoint describes the latest frame of a stream, so monitoring
+// can check that frames are coming without transferring them.
+func frameInfoEndpoint(w http.ResponseWriter, r *http.Request) {
+	pubSub := findPubSub(strings.TrimPrefix(r.URL.Path, "/frameinfo"))
+	if pubSub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	pubSub.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frame, sequence := pubSub.LatestFrame()
+		if frame.Data == nil {
+			http.Error(w, "No frame available", http.StatusServiceUnavailable)
+			return
+		}
+
+		info := frameInfo{
+			Stream:      pubSub.id,
+			Sequence:    sequence,
+			Captured:    frame.Captured,
+			Age:         time.Since(frame.Captured).Seconds(),
+			Size:        len(frame.Data),
+			Progressive: jpegProgressive(frame.Data),
+		}
+		info.Width, info.Height, info.Components, _ = jpegDimensions(frame.Data)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		json.NewEncoder(w).Encode(info)
+	})).ServeHTTP(w, r)
+}
@@ -0,0 +1,90 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getFrameInfo(t *testing.T, path string) (int, frameInfo) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	frameInfoEndpoint(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var info frameInfo
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, info
+}
+
+// The latest frame is described while the stream is connected.
+func TestFrameInfo(t *testing.T) {
+	frame := testJPEG(t, 64, 48, color.RGBA{255, 0, 0, 255})
+	source := newTestSource(t, frame, 20*time.Millisecond)
+	pubSub := newTestStream(t, "/cam", configSource{Source: source.URL})
+	setStreams(t, pubSub)
+
+	if code, _ := getFrameInfo(t, "/frameinfo/other"); code != http.StatusNotFound {
+		t.Errorf("unknown stream: got status %d", code)
+	}
+	if code, _ := getFrameInfo(t, "/frameinfo/cam"); code != http.StatusServiceUnavailable {
+		t.Errorf("stream without clients: got status %d", code)
+	}
+
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	readFrames(t, resp, 1)
+
+	code, info := getFrameInfo(t, "/frameinfo/cam")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if info.Stream != "/cam" || info.Sequence == 0 || info.Size != len(frame) ||
+		info.Width != 64 || info.Height != 48 || info.Components != 3 || info.Progressive {
+		t.Errorf("got %+v", info)
+	}
+	if info.Age < 0 || info.Age > 5 || time.Since(info.Captured) > 5*time.Second {
+		t.Errorf("frame captured %s, age %g", info.Captured, info.Age)
+	}
+}
+
+// Describing frames needs the same users as watching the stream.
+func TestFrameInfoAuth(t *testing.T) {
+	pubSub := newTestPubSub(t, "/private", configSource{Users: map[string]string{"alice": "secret"}})
+	setStreams(t, pubSub)
+
+	if code, _ := getFrameInfo(t, "/frameinfo/private"); code != http.StatusUnauthorized {
+		t.Errorf("without credentials: got status %d", code)
+	}
+}
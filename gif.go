@@ -0,0 +1,128 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"net/http"
+	"time"
+)
+
+// GIF previews are short and small, as every frame is quantized.
+const (
+	gifFrames   = 10
+	gifMaxWidth = 320
+)
+
+// serveGIF responds with the next frames of the stream as an animated GIF.
+func (pubSub *PubSub) serveGIF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+		pubSub.httpError(w, r, errorMethod, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "image/gif")
+	header.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	header.Set("Pragma", "no-cache")
+	header.Set("Expires", "0")
+
+	// probes only get the headers, collecting and encoding the frames is
+	// too costly for them
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if memoryExceeded() {
+		http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	release, ok := pubSub.limitUser(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	sub := NewSubscriber(clientAddress(r))
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	setupDone(r)
+
+	timer := time.NewTimer(snapshotTimeout)
+	defer timer.Stop()
+
+	if !waitAdmitted(w, r, sub, timer) {
+		return
+	}
+
+	anim := &gif.GIF{}
+	var last time.Time
+	for len(anim.Image) < gifFrames {
+		select {
+		case frame, ok := <-sub.ChunkChannel:
+			if !ok {
+				pubSub.httpError(w, r, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+				return
+			}
+			img, err := decodeJPEG(frame.Data)
+			memoryRelease(len(frame.Data))
+			if err != nil {
+				continue
+			}
+
+			// delays are in hundredths of a second, set once the
+			// following frame arrived
+			now := time.Now()
+			if len(anim.Delay) > 0 {
+				anim.Delay[len(anim.Delay)-1] = int(now.Sub(last) / (10 * time.Millisecond))
+			}
+			last = now
+			anim.Image = append(anim.Image, gifFrame(img))
+			anim.Delay = append(anim.Delay, 10)
+		case <-timer.C:
+			pubSub.httpError(w, r, errorStreamIdle, "Stream idle timeout", http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	gif.EncodeAll(w, anim)
+}
+
+// gifFrame scales the image down to the preview size and quantizes it.
+func gifFrame(img image.Image) *image.Paletted {
+	if b := img.Bounds(); b.Dx() > gifMaxWidth {
+		img = scaleImage(img, gifMaxWidth, b.Dy()*gifMaxWidth/b.Dx())
+	}
+
+	b := img.Bounds()
+	out := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette.Plan9)
+	draw.FloydSteinberg.Draw(out, out.Bounds(), img, b.Min)
+	return out
+}
@@ -0,0 +1,88 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtensionBase(t *testing.T) {
+	for path, want := range map[string]string{"/": "/stream", "/cam1": "/cam1", "/cams/front/": "/cams/front"} {
+		if got := extensionBase(path); got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+}
+
+// The preview is made of the next frames, scaled down to the GIF width.
+func TestServeGIF(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 480, 30, color.White), 10*time.Millisecond)
+	pubSub := newTestStream(t, "/gif", configSource{Source: source.URL})
+	server := httptest.NewServer(http.HandlerFunc(pubSub.serveGIF))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/gif.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "image/gif" {
+		t.Fatalf("got status %d with %q", resp.StatusCode, ct)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	anim, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != gifFrames {
+		t.Errorf("got %d frames, want %d", len(anim.Image), gifFrames)
+	}
+	if b := anim.Image[0].Bounds(); b.Dx() != gifMaxWidth || b.Dy() != 20 {
+		t.Errorf("frame size %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+// HEAD gets the headers without waiting for frames or connecting.
+func TestServeGIFHead(t *testing.T) {
+	var connects int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connects, 1)
+		http.Error(w, "offline", http.StatusServiceUnavailable)
+	}))
+	defer source.Close()
+	pubSub := newTestStream(t, "/gifhead", configSource{Source: source.URL})
+
+	rec := httptest.NewRecorder()
+	pubSub.serveGIF(rec, httptest.NewRequest(http.MethodHead, "/gifhead.gif", nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || ct != "image/gif" {
+		t.Errorf("got status %d with %q", rec.Code, ct)
+	}
+	if n := atomic.LoadInt32(&connects); n != 0 {
+		t.Errorf("HEAD connected to the source %d times", n)
+	}
+}
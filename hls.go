@@ -0,0 +1,300 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encoder binary used to package streams as HLS.
+var ffmpegPath string
+
+const (
+	hlsPlaylist     = "index.m3u8"
+	hlsIdleTimeout  = 30 * time.Second // encoder runs on after the last request
+	hlsStartTimeout = 15 * time.Second // wait for the first playlist
+)
+
+var hlsSegmentPattern = regexp.MustCompile(`^segment[0-9]+\.ts$`)
+
+// configHLS enables packaging a stream as HLS for players without MJPEG
+// support. Segments are encoded by ffmpeg while the playlist is requested.
+type configHLS struct {
+	Path           string
+	SegmentSeconds float64
+	PlaylistLength int
+}
+
+// hlsStream runs an encoder fed by an internal subscriber of the stream.
+// The encoder starts with the first playlist request and stops once no
+// player asked for the playlist or segments for hlsIdleTimeout, removing
+// its segment directory.
+type hlsStream struct {
+	pubSub         *PubSub
+	prefix         string
+	segmentSeconds float64
+	playlistLength int
+
+	mu         sync.Mutex
+	dir        string
+	lastAccess time.Time
+}
+
+func newHLSStream(pubSub *PubSub, prefix string, conf configHLS) *hlsStream {
+	hls := &hlsStream{
+		pubSub:         pubSub,
+		prefix:         prefix,
+		segmentSeconds: conf.SegmentSeconds,
+		playlistLength: conf.PlaylistLength,
+	}
+	if hls.segmentSeconds <= 0 {
+		hls.segmentSeconds = 2
+	}
+	if hls.playlistLength <= 0 {
+		hls.playlistLength = 5
+	}
+
+	return hls
+}
+
+func (hls *hlsStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+		hls.pubSub.httpError(w, r, errorMethod, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	release, ok := hls.pubSub.limitUser(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	name := strings.TrimPrefix(r.URL.Path, hls.prefix)
+	switch {
+	case name == hlsPlaylist:
+		hls.servePlaylist(w, r)
+	case hlsSegmentPattern.MatchString(name):
+		hls.serveSegment(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// touch records a request and returns the segment directory, starting
+// the encoder if it is not running.
+func (hls *hlsStream) touch(start bool) (string, error) {
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+
+	if hls.dir == "" {
+		if !start {
+			return "", nil
+		}
+
+		dir, err := ioutil.TempDir("", "mjpeg-proxy-hls")
+		if err != nil {
+			return "", err
+		}
+		hls.dir = dir
+		go hls.run(dir)
+	}
+
+	hls.lastAccess = time.Now()
+	return hls.dir, nil
+}
+
+// retire gives up the directory of an idle encoder, so requests from now
+// on start a new one instead of getting a directory about to be removed.
+func (hls *hlsStream) retire(dir string, idle bool) bool {
+	hls.mu.Lock()
+	defer hls.mu.Unlock()
+
+	if idle && time.Since(hls.lastAccess) <= hlsIdleTimeout {
+		return false
+	}
+	if hls.dir == dir {
+		hls.dir = ""
+	}
+	return true
+}
+
+func (hls *hlsStream) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	dir, err := hls.touch(true)
+	if err != nil {
+		logf("hls[%s]: %s\n", hls.pubSub.id, err)
+		hls.pubSub.httpError(w, r, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+		return
+	}
+	setupDone(r)
+
+	// the first playlist appears once the first segment is encoded
+	var data []byte
+	timeout := time.NewTimer(hlsStartTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		data, err = ioutil.ReadFile(filepath.Join(dir, hlsPlaylist))
+		if err == nil {
+			break
+		}
+
+		select {
+		case <-poll.C:
+		case <-timeout.C:
+			hls.pubSub.httpError(w, r, errorStreamIdle, "Stream not ready", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+func (hls *hlsStream) serveSegment(w http.ResponseWriter, r *http.Request, name string) {
+	dir, _ := hls.touch(false)
+	if dir == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
+
+func (hls *hlsStream) command(dir string) *exec.Cmd {
+	segment := fmt.Sprintf("%g", hls.segmentSeconds)
+	return exec.Command(ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "mjpeg", "-use_wallclock_as_timestamps", "1", "-i", "pipe:0",
+		"-an", "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*"+segment+")",
+		"-f", "hls", "-hls_time", segment,
+		"-hls_list_size", fmt.Sprintf("%d", hls.playlistLength),
+		"-hls_flags", "delete_segments+omit_endlist",
+		"-hls_segment_filename", filepath.Join(dir, "segment%05d.ts"),
+		filepath.Join(dir, hlsPlaylist))
+}
+
+// run feeds the frames of the stream to the encoder until it is idle.
+func (hls *hlsStream) run(dir string) {
+	defer func() {
+		hls.retire(dir, false)
+		os.RemoveAll(dir)
+		logf("hls[%s]: stopped\n", hls.pubSub.id)
+	}()
+
+	cmd := hls.command(dir)
+	cmd.Stdout = logOutput
+	cmd.Stderr = logOutput
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		logf("hls[%s]: encoder start failed: %s\n", hls.pubSub.id, err)
+		return
+	}
+	logf("hls[%s]: started encoder in %s\n", hls.pubSub.id, dir)
+
+	stop := make(chan struct{})
+	fed := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if hls.retire(dir, true) {
+					close(stop)
+					return
+				}
+				hls.expire(dir)
+			case <-fed:
+				return
+			}
+		}
+	}()
+
+	hls.pubSub.follow("hls", true, 0, stop, func(frame Frame) bool {
+		_, err := stdin.Write(frame.Data)
+		if err != nil {
+			logf("hls[%s]: encoder write failed: %s\n", hls.pubSub.id, err)
+			return false
+		}
+		return true
+	})
+	close(fed)
+
+	// the frames are stopped first, the stream must not wait for a stopping encoder
+	stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// expire removes segments that dropped out of the playlist, in case the
+// encoder keeps them around.
+func (hls *hlsStream) expire(dir string) {
+	file, err := os.Open(filepath.Join(dir, hlsPlaylist))
+	if err != nil {
+		return
+	}
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		listed[filepath.Base(strings.TrimSpace(scanner.Text()))] = true
+	}
+	file.Close()
+
+	// players may still fetch a segment that just left the playlist
+	grace := time.Duration(2 * hls.segmentSeconds * float64(time.Second))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if hlsSegmentPattern.MatchString(name) && !listed[name] &&
+			time.Since(fi.ModTime()) > grace {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An idle encoder gives up its directory in the same step as the idle
+// check, so a request coming in meanwhile starts a new encoder.
+func TestHLSRetire(t *testing.T) {
+	hls := newHLSStream(nil, "/hls/", configHLS{})
+	hls.dir = "/tmp/a"
+	hls.lastAccess = time.Now()
+
+	if hls.retire("/tmp/a", true) {
+		t.Error("retired while in use")
+	}
+	if dir, _ := hls.touch(false); dir != "/tmp/a" {
+		t.Errorf("dir in use: got %q", dir)
+	}
+
+	hls.lastAccess = time.Now().Add(-2 * hlsIdleTimeout)
+	if !hls.retire("/tmp/a", true) {
+		t.Error("not retired when idle")
+	}
+	if dir, _ := hls.touch(false); dir != "" {
+		t.Errorf("dir after retire: got %q", dir)
+	}
+
+	// a stopping encoder leaves the directory of its successor alone
+	hls.dir = "/tmp/b"
+	hls.retire("/tmp/a", false)
+	if dir, _ := hls.touch(false); dir != "/tmp/b" {
+		t.Errorf("dir of the new encoder: got %q", dir)
+	}
+}
+
+// Segments that left the playlist are removed after a grace period for
+// players still fetching them.
+func TestHLSExpire(t *testing.T) {
+	dir := t.TempDir()
+	hls := newHLSStream(nil, "/hls/", configHLS{SegmentSeconds: 1})
+	playlist := "#EXTM3U\n#EXTINF:1.0,\nsegment00002.ts\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, hlsPlaylist), []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Minute)
+	for _, name := range []string{"segment00001.ts", "segment00002.ts", "segment00003.ts", "other.ts"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "segment00003.ts" {
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	hls.expire(dir)
+
+	for name, kept := range map[string]bool{
+		"segment00001.ts": false, // old and no longer listed
+		"segment00002.ts": true,  // listed
+		"segment00003.ts": true,  // within the grace period
+		"other.ts":        true,  // not a segment
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != kept {
+			t.Errorf("%s: exists %v, want %v", name, exists, kept)
+		}
+	}
+}
+
+// The playlist and its segments are served while the encoder runs, this
+// needs ffmpeg with libx264.
+func TestHLSPlaylist(t *testing.T) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	if ffmpegPath == "" {
+		ffmpegPath = path // read by encoders outliving the test
+	}
+
+	source := newTestSource(t, testJPEG(t, 64, 64, color.White), 40*time.Millisecond)
+	pubSub := newTestStream(t, "/hls", configSource{Source: source.URL})
+	server := httptest.NewServer(newHLSStream(pubSub, "/", configHLS{SegmentSeconds: 1}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/" + hlsPlaylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("playlist: got status %d: %s", resp.StatusCode, playlist)
+	}
+	if !strings.HasPrefix(string(playlist), "#EXTM3U") {
+		t.Fatalf("not a playlist: %q", playlist)
+	}
+
+	var segment string
+	for _, line := range strings.Split(string(playlist), "\n") {
+		if hlsSegmentPattern.MatchString(strings.TrimSpace(line)) {
+			segment = strings.TrimSpace(line)
+		}
+	}
+	if segment == "" {
+		t.Fatalf("no segment in playlist: %q", playlist)
+	}
+	resp, err = http.Get(server.URL + "/" + segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(data) == 0 || data[0] != 0x47 {
+		t.Errorf("segment: got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+}
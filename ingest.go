@@ -0,0 +1,116 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Upstream bytes per second allowed for all streams together, 0 for no
+// limit. Chunkers share one token bucket, so each read waits its turn.
+var ingestLimit int64
+
+// Largest read from a source while the ingest limit is enforced, so
+// streams take turns in small steps.
+const ingestReadSize = 32 * 1024
+
+var (
+	ingestBucket tokenBucket
+	ingestMeter  syncRateEstimator
+)
+
+// tokenBucket hands out bytes at a fixed rate with a burst of one second.
+// Reservations can take the bucket below zero, later callers then wait
+// until the debt is paid off, which keeps the order of requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// has to wait before using them.
+func (bucket *tokenBucket) reserve(n int, rate float64) time.Duration {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	now := time.Now()
+	if bucket.last.IsZero() {
+		bucket.tokens = rate
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+		if bucket.tokens > rate {
+			bucket.tokens = rate
+		}
+	}
+	bucket.last = now
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
+
+// ingestReader counts the data read from a source and throttles it to
+// the global ingest limit.
+type ingestReader struct {
+	r     io.Reader
+	bytes prometheus.Counter
+	stop  <-chan struct{}
+	err   error // first error of the source, to tell parse errors from it
+}
+
+func (ir *ingestReader) Read(p []byte) (int, error) {
+	if ingestLimit > 0 && len(p) > ingestReadSize {
+		p = p[:ingestReadSize]
+	}
+
+	n, err := ir.r.Read(p)
+	if err != nil && ir.err == nil {
+		ir.err = err
+	}
+	if n > 0 {
+		ir.bytes.Add(float64(n))
+		ingestMeter.add(float64(n))
+		if ingestLimit > 0 {
+			ir.wait(ingestBucket.reserve(n, float64(ingestLimit)))
+		}
+	}
+
+	return n, err
+}
+
+func (ir *ingestReader) wait(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ir.stop:
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Streams reading at the same time share the limit, together they get
+// no more than the rate after the first second of burst.
+func TestIngestLimitShared(t *testing.T) {
+	var bucket tokenBucket
+	const rate = 1024 * 1024
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for read := 0; read < rate/2; read += ingestReadSize {
+				time.Sleep(bucket.reserve(ingestReadSize, rate))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// one second of burst and one of waiting for the rest
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("read twice the rate in %s, want about a second", elapsed)
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	var bucket tokenBucket
+	if delay := bucket.reserve(1000, 1000); delay != 0 {
+		t.Errorf("first second of burst: waited %s", delay)
+	}
+	if delay := bucket.reserve(500, 1000); delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("after the burst: got delay %s, want about 500ms", delay)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JPEG markers used when inspecting frames without decoding them.
+const (
+	jpegSOI  = 0xd8 // start of image
+	jpegEOI  = 0xd9 // end of image
+	jpegSOS  = 0xda // start of scan
+	jpegSOF0 = 0xc0 // baseline frame
+	jpegSOF2 = 0xc2 // progressive frame
+)
+
+var errJPEGMalformed = errors.New("malformed JPEG")
+
+// jpegSegments calls fn for each marker segment in the JPEG header, with
+// the segment bounds including the marker itself. Parsing stops at the
+// start of scan, as entropy coded data follows it, or when fn returns false.
+func jpegSegments(data []byte, fn func(marker byte, start, end int) bool) error {
+	if len(data) < 4 || data[0] != 0xff || data[1] != jpegSOI {
+		return errJPEGMalformed
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return errJPEGMalformed
+		}
+		marker := data[i+1]
+		if marker == 0xff { // fill byte
+			i++
+			continue
+		}
+
+		length := int(data[i+2])<<8 | int(data[i+3])
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return errJPEGMalformed
+		}
+
+		if !fn(marker, i, end) || marker == jpegSOS {
+			return nil
+		}
+		i = end
+	}
+
+	return errJPEGMalformed
+}
+
+// jpegComplete reports whether the frame starts with SOI and ends with
+// EOI, ignoring line breaks some sources add after the frame.
+func jpegComplete(data []byte) bool {
+	data = bytes.TrimRight(data, "\r\n")
+	n := len(data)
+	return n >= 4 && data[0] == 0xff && data[1] == jpegSOI &&
+		data[n-2] == 0xff && data[n-1] == jpegEOI
+}
+
+// jpegIsSOF reports whether the marker starts a frame, skipping the
+// DHT, JPG and DAC markers sharing the same range.
+func jpegIsSOF(marker byte) bool {
+	return marker >= 0xc0 && marker <= 0xcf &&
+		marker != 0xc4 && marker != 0xc8 && marker != 0xcc
+}
+
+// jpegProgressive reports whether the frame uses progressive encoding.
+func jpegProgressive(data []byte) bool {
+	progressive := false
+	jpegSegments(data, func(marker byte, start, end int) bool {
+		if jpegIsSOF(marker) {
+			progressive = marker == jpegSOF2 || marker == 0xc6 ||
+				marker == 0xca || marker == 0xce
+			return false
+		}
+		return true
+	})
+
+	return progressive
+}
+
+// jpegDimensions reads the image size and number of color components
+// from the frame header.
+func jpegDimensions(data []byte) (width, height, components int, ok bool) {
+	jpegSegments(data, func(marker byte, start, end int) bool {
+		if jpegIsSOF(marker) {
+			if end-start >= 10 {
+				height = int(data[start+5])<<8 | int(data[start+6])
+				width = int(data[start+7])<<8 | int(data[start+8])
+				components = int(data[start+9])
+				ok = true
+			}
+			return false
+		}
+		return true
+	})
+
+	return width, height, components, ok
+}
+
+// parseJPEGMarkers converts marker names like APP1 or COM to marker codes.
+func parseJPEGMarkers(names []string) (map[byte]bool, error) {
+	markers := make(map[byte]bool)
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		switch {
+		case name == "":
+			continue
+		case name == "COM":
+			markers[0xfe] = true
+		case strings.HasPrefix(name, "APP"):
+			n, err := strconv.Atoi(strings.TrimPrefix(name, "APP"))
+			if err != nil || n < 0 || n > 15 {
+				return nil, fmt.Errorf("invalid JPEG marker: %s", name)
+			}
+			markers[byte(0xe0+n)] = true
+		default:
+			return nil, fmt.Errorf("invalid JPEG marker: %s", name)
+		}
+	}
+
+	return markers, nil
+}
+
+// stripJPEG removes the selected marker segments from the frame without
+// decoding it. Frames that cannot be parsed are returned unchanged.
+func stripJPEG(data []byte, markers map[byte]bool) []byte {
+	var keep [][2]int
+	scan := -1
+	err := jpegSegments(data, func(marker byte, start, end int) bool {
+		if marker == jpegSOS {
+			scan = start
+		} else if !markers[marker] {
+			keep = append(keep, [2]int{start, end})
+		}
+		return true
+	})
+	if err != nil || scan < 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	for _, segment := range keep {
+		out = append(out, data[segment[0]:segment[1]]...)
+	}
+
+	return append(out, data[scan:]...)
+}
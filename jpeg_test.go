@@ -0,0 +1,149 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withSegment inserts a marker segment with the payload after the SOI.
+func withSegment(data []byte, marker byte, payload string) []byte {
+	n := len(payload) + 2
+	segment := append([]byte{0xff, marker, byte(n >> 8), byte(n)}, payload...)
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestParseJPEGMarkers(t *testing.T) {
+	markers, err := parseJPEGMarkers([]string{"app1", " COM ", "APP15", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range []byte{0xe1, 0xfe, 0xef} {
+		if !markers[marker] {
+			t.Errorf("marker %#x not parsed", marker)
+		}
+	}
+	if len(markers) != 3 {
+		t.Errorf("got %d markers, want 3", len(markers))
+	}
+
+	for _, name := range []string{"APP16", "APPx", "SOS"} {
+		if _, err := parseJPEGMarkers([]string{name}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+// Stripped frames are smaller but decode to the same image.
+func TestStripJPEG(t *testing.T) {
+	plain := testJPEG(t, 16, 16, color.RGBA{200, 40, 40, 255})
+	data := withSegment(plain, 0xe1, "Exif\x00\x00camera model and location")
+	data = withSegment(data, 0xfe, "comment from the camera")
+	data = withSegment(data, 0xe2, "ICC profile")
+
+	markers, err := parseJPEGMarkers([]string{"APP1", "COM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := stripJPEG(data, markers)
+	if len(stripped) >= len(data) {
+		t.Fatalf("stripped frame not smaller: %d >= %d", len(stripped), len(data))
+	}
+	if want := withSegment(plain, 0xe2, "ICC profile"); !bytes.Equal(stripped, want) {
+		t.Error("stripped other segments than the selected ones")
+	}
+
+	before, err := decodeJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := decodeJPEG(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := before.Bounds()
+	if after.Bounds() != bounds {
+		t.Fatalf("bounds: got %v, want %v", after.Bounds(), bounds)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if before.At(x, y) != after.At(x, y) {
+				t.Fatalf("pixel %d,%d differs after stripping", x, y)
+			}
+		}
+	}
+
+	// frames that cannot be parsed are left alone
+	broken := data[:len(data)/3]
+	if got := stripJPEG(broken, markers); !bytes.Equal(got, broken) {
+		t.Error("unparsable frame changed")
+	}
+}
+
+// Parts too short to hold a JPEG header pass through stripping unchanged
+// instead of failing the chunker.
+func TestStripTruncatedPart(t *testing.T) {
+	for _, data := range [][]byte{nil, {0xff}, {0xff, 0xd8}, {'x', 'y', 'z'}} {
+		markers := map[byte]bool{0xfe: true}
+		if got := stripJPEG(data[:len(data):len(data)], markers); !bytes.Equal(got, data) {
+			t.Errorf("part %q changed to %q", data, got)
+		}
+	}
+
+	want := []string{"\xff", "x", "\xff\xd8", "\xff\xd8\xff"}
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		for _, part := range want {
+			fmt.Fprintf(w, "--B\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n%s\r\n", len(part), part)
+		}
+		io.WriteString(w, "--B--\r\n")
+	}))
+	defer source.Close()
+
+	chunker, err := NewChunker("/strip", configSource{Source: source.URL, StripMarkers: []string{"COM"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chunker.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	pubChan := make(chan Frame)
+	done := chunker.Start(pubChan)
+	var frames []string
+	for frame := range pubChan {
+		frames = append(frames, string(frame.Data))
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	chunker.Stop()
+
+	if fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("got frames %q, want %q", frames, want)
+	}
+}
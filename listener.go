@@ -0,0 +1,192 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	keepAlivePeriod time.Duration
+	tcpRecvBuffer   int
+	maxConnsPerIP   int
+	maxSetups       int
+	clientConns     = &connLimiter{conns: make(map[string]int)}
+)
+
+// limitListener applies socket options to accepted client connections and
+// closes connections from addresses that already have too many open.
+// Connections of trusted proxies are left to limitForwarded instead.
+type limitListener struct {
+	net.Listener
+}
+
+func newLimitListener(listener net.Listener) net.Listener {
+	if keepAlivePeriod <= 0 && tcpRecvBuffer <= 0 && maxConnsPerIP <= 0 {
+		return listener
+	}
+
+	return &limitListener{Listener: listener}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		tcpConn, ok := conn.(*net.TCPConn)
+		if !ok {
+			return conn, nil
+		}
+
+		if keepAlivePeriod > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(keepAlivePeriod)
+		}
+		if tcpRecvBuffer > 0 {
+			tcpConn.SetReadBuffer(tcpRecvBuffer)
+		}
+
+		addr := tcpConn.RemoteAddr().(*net.TCPAddr).IP
+		if maxConnsPerIP <= 0 || trustedProxy(addr) {
+			return conn, nil
+		}
+
+		ip := addr.String()
+		if !clientConns.acquire(ip) {
+			logf("server: too many connections from %s, closing\n", ip)
+			conn.Close()
+			continue
+		}
+
+		return &limitConn{Conn: conn, release: func() { clientConns.release(ip) }}, nil
+	}
+}
+
+// limitForwarded applies the per address limit to the clients of trusted
+// proxies, taking their address from -clientheader. As the clients share
+// the proxy connections, each of their requests counts as a connection.
+func limitForwarded(handler http.Handler) http.Handler {
+	if maxConnsPerIP <= 0 || len(trustedProxies) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromTrustedProxy(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientAddress(r)
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if !clientConns.acquire(ip) {
+			logf("server: too many connections from %s, rejecting\n", ip)
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer clientConns.release(ip)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// connLimiter counts the open connections of each client address.
+type connLimiter struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip] >= maxConnsPerIP {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// limitConn gives the per address slot back once the connection is closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+type setupKey struct{}
+
+// setupLimit sheds requests once too many are being set up at the same
+// time, before any work is done for them. A request holds its slot until
+// it calls setupDone or returns, so long running streams do not count.
+func setupLimit(handler http.Handler, limit int) http.Handler {
+	if limit <= 0 {
+		return handler
+	}
+
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server busy", http.StatusServiceUnavailable)
+			return
+		}
+
+		var once sync.Once
+		release := func() { once.Do(func() { <-slots }) }
+		defer release()
+
+		ctx := context.WithValue(r.Context(), setupKey{}, release)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setupDone gives back the setup slot of a request that is done setting up.
+func setupDone(r *http.Request) {
+	if release, ok := r.Context().Value(setupKey{}).(func()); ok {
+		release()
+	}
+}
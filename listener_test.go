@@ -0,0 +1,248 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// setConnsPerIP sets the per address limit and the trusted proxies.
+func setConnsPerIP(t *testing.T, limit int, proxies string) {
+	t.Helper()
+
+	networks, err := parseTrustedProxies(proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLimit, oldProxies, oldHeader := maxConnsPerIP, trustedProxies, clientHeader
+	maxConnsPerIP, trustedProxies, clientHeader = limit, networks, "X-Forwarded-For"
+	t.Cleanup(func() {
+		maxConnsPerIP, trustedProxies, clientHeader = oldLimit, oldProxies, oldHeader
+	})
+}
+
+// Connections over the limit are closed when accepted, and the slot of a
+// closed connection is given back.
+func TestConnsPerIPAtAccept(t *testing.T) {
+	setConnsPerIP(t, 1, "")
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newLimitListener(inner)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	first := dial()
+	defer first.Close()
+	held := <-accepted
+
+	second := dial()
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("second connection not closed: %v", err)
+	}
+	select {
+	case <-accepted:
+		t.Error("second connection accepted")
+	default:
+	}
+
+	held.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Error("connection after release not accepted")
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Clients behind a trusted proxy are limited by their forwarded address,
+// not by the address of the proxy they share.
+func TestConnsPerIPBehindProxy(t *testing.T) {
+	setConnsPerIP(t, 1, "127.0.0.1")
+
+	release := make(chan struct{})
+	entered := make(chan struct{}, 2)
+	server := httptest.NewUnstartedServer(limitForwarded(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+		})))
+	server.Listener = newLimitListener(server.Listener)
+	server.Start()
+	defer server.Close()
+	defer close(release)
+
+	get := func(client string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("X-Forwarded-For", client)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	go get("192.0.2.1")
+	<-entered
+
+	// another client of the same proxy still gets in
+	go get("192.0.2.2")
+	select {
+	case <-entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("second client behind the proxy blocked")
+	}
+
+	if resp := get("192.0.2.1, 127.0.0.1"); resp != nil && resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("client over the limit: got status %d", resp.StatusCode)
+	}
+}
+
+func TestSetupLimit(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 2)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/setup", func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		setupDone(r)
+		entered <- struct{}{}
+		<-release
+	})
+	mux.HandleFunc("/quick", func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(setupLimit(mux, 1))
+	defer server.Close()
+	defer close(release)
+
+	// a request done setting up gives back its slot
+	go http.Get(server.URL + "/stream")
+	<-entered
+	resp, err := http.Get(server.URL + "/quick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("after setupDone: got status %d", resp.StatusCode)
+	}
+
+	// one still setting up holds it
+	go http.Get(server.URL + "/setup")
+	<-entered
+	resp, err = http.Get(server.URL + "/quick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("during setup: got status %d", resp.StatusCode)
+	}
+}
+
+// Handlers waiting for frames must not hold a setup slot while waiting.
+func TestSetupDoneWhileWaiting(t *testing.T) {
+	source := newStalledSource(t)
+	pubSub := newTestStream(t, "/setupwait", configSource{Source: source.URL})
+
+	handlers := map[string]http.Handler{
+		"snapshot": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pubSub.serveSnapshot(w, r, outputOptions{})
+		}),
+		"gif":      http.HandlerFunc(pubSub.serveGIF),
+		"metadata": pubSub.metadataHandler(newMetadataHub()),
+		"sheet":    newContactSheet(pubSub, configContactSheet{Path: "/sheet"}),
+	}
+
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/wait", handler)
+			mux.HandleFunc("/quick", func(w http.ResponseWriter, r *http.Request) {})
+			server := httptest.NewServer(setupLimit(mux, 1))
+			defer server.Close()
+			defer server.CloseClientConnections()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/wait", nil)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+			}()
+
+			// the waiting request gives back its slot once subscribed
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				resp, err := http.Get(server.URL + "/quick")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("setup slot still held by the waiting request")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Wait before subscribing a listener again after the stream failed.
+const listenerRetryDelay = 5 * time.Second
+
+// FrameListener is called with every frame of a stream, from a goroutine
+// of its own for each stream. The frame data is shared with the other
+// subscribers and must not be modified.
+type FrameListener func(stream string, frame Frame)
+
+type frameListener struct {
+	fn   FrameListener
+	stop chan struct{}
+}
+
+// Listeners attached to all streams, guarded together with the adding of
+// streams so none is missed.
+var (
+	listenersMu  sync.Mutex
+	listeners    = make(map[int]*frameListener)
+	nextListener int
+)
+
+// SubscribeAll attaches the listener to every stream, including streams
+// added later, and returns an id for UnsubscribeAll. Like eager streams,
+// the sources stay connected while the listener is attached.
+func SubscribeAll(fn FrameListener) int {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	nextListener++
+	listener := &frameListener{fn: fn, stop: make(chan struct{})}
+	listeners[nextListener] = listener
+	for _, pubSub := range pubSubs {
+		go pubSub.listen(listener)
+	}
+
+	return nextListener
+}
+
+// UnsubscribeAll detaches a listener from all streams.
+func UnsubscribeAll(id int) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	if listener, ok := listeners[id]; ok {
+		delete(listeners, id)
+		close(listener.stop)
+	}
+}
+
+// addStream registers a stream and attaches the current listeners to it.
+func addStream(pubSub *PubSub) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	pubSubs = append(pubSubs, pubSub)
+	for _, listener := range listeners {
+		go pubSub.listen(listener)
+	}
+}
+
+// listen passes the frames of the stream to the listener through an
+// internal subscriber until the listener is detached.
+func (pubSub *PubSub) listen(listener *frameListener) {
+	pubSub.follow("listener", false, listenerRetryDelay, listener.stop, func(frame Frame) bool {
+		listener.fn(pubSub.id, frame)
+		return true
+	})
+}
@@ -0,0 +1,67 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestSubscribeAllLaterStream(t *testing.T) {
+	setStreams(t)
+
+	frames := make(chan string, 100)
+	id := SubscribeAll(func(stream string, frame Frame) {
+		select {
+		case frames <- stream:
+		default:
+		}
+	})
+	defer UnsubscribeAll(id)
+
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	conf := configSource{Source: source.URL}
+	chunker, err := NewChunker("/later", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := NewPubSub("/later", chunker, conf)
+	pubSub.Start()
+	addStream(pubSub)
+
+	select {
+	case stream := <-frames:
+		if stream != "/later" {
+			t.Errorf("frame of stream %s", stream)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener got no frames of the stream added later")
+	}
+
+	UnsubscribeAll(id)
+	deadline := time.Now().Add(5 * time.Second)
+	for pubSub.Status().Internal > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("listener still subscribed after UnsubscribeAll")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destination of log messages, stdout unless a log file is configured.
+var logOutput io.Writer = os.Stdout
+
+// Log levels, debug messages report per frame events and are only
+// written for streams logging at the debug level.
+const (
+	logDebug = iota
+	logInfo
+)
+
+var (
+	logLevel        = logInfo
+	streamLogLevels sync.Map // stream id to level overriding logLevel
+)
+
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(logOutput, format, args...)
+}
+
+// debugf logs a message about a stream if it is logging at the debug level.
+func debugf(stream string, format string, args ...interface{}) {
+	if debugEnabled(stream) {
+		logf(format, args...)
+	}
+}
+
+func debugEnabled(stream string) bool {
+	level := logLevel
+	if override, ok := streamLogLevels.Load(stream); ok {
+		level = override.(int)
+	}
+	return level <= logDebug
+}
+
+func parseLogLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return logDebug, nil
+	case "info":
+		return logInfo, nil
+	default:
+		return 0, fmt.Errorf("unknown log level: %s", name)
+	}
+}
+
+// rotatingFile is a log file that is renamed to path.1, path.2, ... once
+// it grows beyond maxSize or gets older than maxAge, keeping maxBackups
+// old files.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	full := rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize
+	old := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if full || old {
+		err := rf.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log: rotate failed: %s\n", err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d", rf.path, i)
+	}
+
+	os.Remove(backup(rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(backup(i), backup(i+1))
+	}
+	if rf.maxBackups > 0 {
+		os.Rename(rf.path, backup(1))
+	} else {
+		os.Remove(rf.path)
+	}
+
+	return rf.open()
+}
@@ -0,0 +1,125 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Full files are renamed to numbered backups, dropping the oldest ones.
+func TestLogRotateSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	rf, err := openRotatingFile(path, 25, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.file.Close()
+
+	for i := 1; i <= 6; i++ {
+		fmt.Fprintf(rf, "line %03d\n", i) // 9 bytes, two fit in a file
+	}
+
+	want := map[string]string{
+		path:        "line 005\nline 006\n",
+		path + ".1": "line 003\nline 004\n",
+		path + ".2": "line 001\nline 002\n",
+	}
+	for file, content := range want {
+		if got := readLog(t, file); got != content {
+			t.Errorf("%s: got %q, want %q", filepath.Base(file), got, content)
+		}
+	}
+
+	fmt.Fprintf(rf, "line %03d\n", 7)
+	if got := readLog(t, path+".2"); got != "line 003\nline 004\n" {
+		t.Errorf("oldest backup not dropped: %q", got)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups kept than configured: %v", err)
+	}
+}
+
+// Old files are rotated on the next write, existing content counts
+// towards the size after a restart.
+func TestLogRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	if err := ioutil.WriteFile(path, []byte("before restart\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := openRotatingFile(path, 1000, 50*time.Millisecond, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.file.Close()
+
+	fmt.Fprintln(rf, "first")
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintln(rf, "second")
+
+	if got := readLog(t, path+".1"); got != "before restart\nfirst\n" {
+		t.Errorf("backup: got %q", got)
+	}
+	if got := readLog(t, path); got != "second\n" {
+		t.Errorf("current: got %q", got)
+	}
+	if rf.size != int64(len("second\n")) {
+		t.Errorf("size after rotation: got %d", rf.size)
+	}
+}
+
+// A stream level overrides the default for that stream only.
+func TestStreamLogLevel(t *testing.T) {
+	streamLogLevels.Store("/loud", logDebug)
+	defer streamLogLevels.Delete("/loud")
+	streamLogLevels.Store("/quiet", logInfo)
+	defer streamLogLevels.Delete("/quiet")
+
+	for stream, want := range map[string]bool{"/loud": true, "/quiet": false, "/other": logLevel <= logDebug} {
+		if got := debugEnabled(stream); got != want {
+			t.Errorf("%s: debug %v, want %v", stream, got, want)
+		}
+	}
+
+	for name, want := range map[string]int{"debug": logDebug, "INFO": logInfo} {
+		if got, err := parseLogLevel(name); err != nil || got != want {
+			t.Errorf("%s: got %d, %v", name, got, err)
+		}
+	}
+	err := startSource(configSource{Source: "http://127.0.0.1:1/", Path: "/loglevel", LogLevel: "verbose"})
+	if err == nil || !strings.Contains(err.Error(), "unknown log level") {
+		t.Errorf("unknown level: got error %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// configLogin describes a login form of a source that hands out a
+// session cookie required for the stream.
+type configLogin struct {
+	URL    string
+	Fields map[string]string
+}
+
+// sessionLogin posts the login form, keeping the session cookies in the
+// jar of the upstream client so they are sent with the stream requests.
+type sessionLogin struct {
+	url    *url.URL
+	fields url.Values
+	jar    http.CookieJar
+}
+
+func newSessionLogin(source *url.URL, conf configLogin) (*sessionLogin, error) {
+	loginUrl, err := source.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(url.Values)
+	for key, value := range conf.Fields {
+		fields.Set(key, value)
+	}
+
+	return &sessionLogin{url: loginUrl, fields: fields, jar: jar}, nil
+}
+
+// valid reports whether the jar still holds a cookie for the source,
+// the jar forgets cookies once they expire.
+func (login *sessionLogin) valid(source *url.URL) bool {
+	return len(login.jar.Cookies(source)) > 0
+}
+
+// login submits the form with the client using the cookie jar.
+func (chunker *Chunker) login(ctx context.Context) error {
+	logf("chunker[%s]: logging in at %s\n", chunker.id, chunker.session.url)
+
+	req, err := http.NewRequest("POST", chunker.session.url.String(),
+		strings.NewReader(chunker.session.fields.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := chunker.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("login failed: %s", err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("login failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,417 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logOutput = ioutil.Discard
+	}
+	os.Exit(m.Run())
+}
+
+// testJPEG returns a JPEG of the given size filled with one color.
+func testJPEG(t testing.TB, width, height int, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	data, err := encodeJPEG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newTestSource serves an endless MJPEG stream repeating the frame at the
+// interval, as a camera would.
+func newTestSource(t testing.TB, frame []byte, interval time.Duration) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusOK)
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", "image/jpeg")
+		header.Set("Content-Length", fmt.Sprintf("%d", len(frame)))
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			part, err := mw.CreatePart(header)
+			if err == nil {
+				_, err = part.Write(frame)
+			}
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return server
+}
+
+// newStalledSource accepts the stream request but never sends a frame.
+func newStalledSource(t testing.TB) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return server
+}
+
+// newTestStream starts a stream of the source, as startSource does, but
+// without registering any handlers.
+func newTestStream(t testing.TB, id string, conf configSource) *PubSub {
+	t.Helper()
+
+	chunker, err := NewChunker(id, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubSub := NewPubSub(id, chunker, conf)
+	pubSub.Start()
+	return pubSub
+}
+
+// setStreams replaces the registered streams for the test.
+func setStreams(t testing.TB, streams ...*PubSub) {
+	t.Helper()
+
+	old := pubSubs
+	pubSubs = streams
+	t.Cleanup(func() { pubSubs = old })
+}
+
+// metricValue returns the current value of a counter or gauge.
+func metricValue(t testing.TB, metric prometheus.Metric) float64 {
+	t.Helper()
+
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	}
+	t.Fatalf("unsupported metric %s", metric.Desc())
+	return 0
+}
+
+// readFrames reads the first parts of a multipart stream response.
+func readFrames(t testing.TB, resp *http.Response, n int) [][]byte {
+	t.Helper()
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+
+	frames := make([][]byte, 0, n)
+	for len(frames) < n {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(part); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, buf.Bytes())
+	}
+	return frames
+}
+
+// Every stream gets the same numeric keys in /stat, named after its path.
+func TestStatEndpoint(t *testing.T) {
+	source := newStalledSource(t)
+	setStreams(t,
+		newTestStream(t, "/", configSource{Source: source.URL}),
+		newTestStream(t, "/cam/front.mjpg", configSource{Source: source.URL}))
+
+	w := httptest.NewRecorder()
+	statEndpoint(w, httptest.NewRequest(http.MethodGet, "/stat", nil))
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			t.Fatalf("line without value: %q", line)
+		}
+		if _, err := strconv.ParseFloat(line[i+1:], 64); err != nil {
+			t.Errorf("non numeric value: %q", line)
+		}
+		values[line[:i]] = line[i+1:]
+	}
+	for _, name := range []string{"root", "cam_front_mjpg"} {
+		for _, key := range []string{"subscribers", "queued", "connected", "fps", "frames", "uptime"} {
+			if _, ok := values["stream."+name+"."+key]; !ok {
+				t.Errorf("missing key stream.%s.%s", name, key)
+			}
+		}
+	}
+	if got := values["stream.root.connected"]; got != "0" {
+		t.Errorf("stream without clients: connected=%s", got)
+	}
+}
+
+// The Server headers of the source are kept from the last connect and
+// shown in the status and /api/info.
+func TestUpstreamIdentity(t *testing.T) {
+	camera := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "CamFirmware/1.2")
+		w.Header().Set("X-Powered-By", "camd")
+		camera.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer source.Close()
+	defer source.CloseClientConnections()
+	pubSub := newTestStream(t, "/identity", configSource{Source: source.URL})
+	setStreams(t, pubSub)
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	want := map[string]string{"Server": "CamFirmware/1.2", "X-Powered-By": "camd"}
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFrames(t, resp, 1)
+	if got := pubSub.Status().Upstream; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("status while connected: got %v, want %v", got, want)
+	}
+	resp.Body.Close()
+
+	// still known once the stream is disconnected
+	deadline := time.Now().Add(5 * time.Second)
+	for pubSub.Status().Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("stream not disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	infoEndpoint(w, httptest.NewRequest(http.MethodGet, "/api/info", nil))
+	var info struct {
+		Upstream map[string]map[string]string `json:"upstream"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Upstream["/identity"]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("info: got %v, want %v", got, want)
+	}
+}
+
+// statValues returns the values of the /stat endpoint by key.
+func statValues(t *testing.T) map[string]string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	statEndpoint(w, httptest.NewRequest(http.MethodGet, "/stat", nil))
+	values := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			values[line[:i]] = line[i+1:]
+		}
+	}
+	return values
+}
+
+// eventMetrics returns the stream event times reported for the stream.
+func eventMetrics(t *testing.T, id string) map[string]float64 {
+	t.Helper()
+
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(map[string]float64)
+	for _, family := range families {
+		name := strings.TrimPrefix(family.GetName(), "mjpeg_proxy_stream_")
+		if name == family.GetName() || !strings.HasSuffix(name, "_timestamp_seconds") {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if m.GetLabel()[0].GetValue() == id {
+				events[strings.TrimSuffix(name, "_timestamp_seconds")] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	return events
+}
+
+// Stream events are reported once they happened, as times in the status
+// and metrics and as ages in /stat.
+func TestStreamEventTimes(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	pubSub := newTestStream(t, "/events", configSource{Source: source.URL})
+	setStreams(t, pubSub)
+
+	status := pubSub.Status()
+	if status.Created.IsZero() || !status.LastConnect.IsZero() ||
+		!status.LastFrame.IsZero() || !status.LastSubscriber.IsZero() {
+		t.Errorf("new stream: %+v", status)
+	}
+	values := statValues(t)
+	for _, key := range []string{"connectage", "frameage", "subscriberage"} {
+		if got := values["stream.events."+key]; got != "-1" {
+			t.Errorf("new stream: %s=%s", key, got)
+		}
+	}
+	if got := eventMetrics(t, "/events"); len(got) != 1 || got["created"] == 0 {
+		t.Errorf("new stream metrics: %v", got)
+	}
+
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFrames(t, resp, 1)
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for status = pubSub.Status(); status.Connected; status = pubSub.Status() {
+		if time.Now().After(deadline) {
+			t.Fatal("stream not disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.LastConnect.Before(status.Created) || status.LastFrame.Before(status.LastConnect) ||
+		status.LastSubscriber.Before(status.LastFrame) {
+		t.Errorf("event times out of order: %+v", status)
+	}
+	values = statValues(t)
+	for _, key := range []string{"age", "connectage", "frameage", "subscriberage"} {
+		if got := values["stream.events."+key]; got != "0" {
+			t.Errorf("%s=%s, want 0", key, got)
+		}
+	}
+	events := eventMetrics(t, "/events")
+	if want := float64(status.LastFrame.UnixNano()) / 1e9; events["last_frame"] != want || len(events) != 4 {
+		t.Errorf("metrics: got %v, want last_frame %v", events, want)
+	}
+}
+
+// Oversized headers get 431, and GET requests with a body are refused at
+// once, so clients expecting 100 Continue never get it.
+func TestRequestLimits(t *testing.T) {
+	server := httptest.NewUnstartedServer(rejectBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	server.Config.MaxHeaderBytes = 1024
+	server.Start()
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{"large header", "GET / HTTP/1.1\r\nHost: x\r\nX-Big: " + strings.Repeat("a", 8192) + "\r\n\r\n",
+			http.StatusRequestHeaderFieldsTooLarge},
+		{"continue with body", "GET / HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 10\r\n\r\n",
+			http.StatusRequestEntityTooLarge},
+		{"continue without body", "GET / HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\n\r\n",
+			http.StatusOK},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, test.request); err != nil {
+			t.Fatal(err)
+		}
+
+		// the body is never sent, the answer must come without it
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+		if test.status == http.StatusRequestEntityTooLarge && !resp.Close {
+			t.Errorf("%s: connection kept open", test.name)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+)
+
+// Approximate number of bytes held by frames in flight to clients and
+// by client write buffers. A frame delivered to several subscribers is
+// counted once per subscriber, so the estimate errs on the high side.
+var (
+	memoryLimit int64
+	memoryInUse int64
+)
+
+func memoryAcquire(n int) {
+	atomic.AddInt64(&memoryInUse, int64(n))
+}
+
+func memoryRelease(n int) {
+	atomic.AddInt64(&memoryInUse, -int64(n))
+}
+
+func memoryUsed() int64 {
+	return atomic.LoadInt64(&memoryInUse)
+}
+
+// memoryExceeded reports whether frames should be dropped and new
+// clients rejected to stay within the configured memory limit.
+func memoryExceeded() bool {
+	return memoryLimit > 0 && memoryUsed() >= memoryLimit
+}
@@ -0,0 +1,155 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// metadataPart is a non-image part of a mixed content source, like the
+// ONVIF event data some cameras interleave with the frames.
+type metadataPart struct {
+	contentType string
+	data        []byte
+}
+
+// isImagePart reports whether a source part holds a frame. Parts without
+// a Content-Type are assumed to be frames, as many cameras omit it.
+func isImagePart(contentType string) bool {
+	return contentType == "" ||
+		strings.HasPrefix(strings.ToLower(strings.TrimSpace(contentType)), "image/")
+}
+
+// metadataHub passes metadata parts on to the clients of the metadata path.
+// Parts are dropped for clients that are not ready to take them.
+type metadataHub struct {
+	mu   sync.Mutex
+	subs map[chan metadataPart]struct{}
+}
+
+func newMetadataHub() *metadataHub {
+	return &metadataHub{subs: make(map[chan metadataPart]struct{})}
+}
+
+func (hub *metadataHub) subscribe() chan metadataPart {
+	ch := make(chan metadataPart, 1)
+	hub.mu.Lock()
+	hub.subs[ch] = struct{}{}
+	hub.mu.Unlock()
+	return ch
+}
+
+func (hub *metadataHub) unsubscribe(ch chan metadataPart) {
+	hub.mu.Lock()
+	delete(hub.subs, ch)
+	hub.mu.Unlock()
+}
+
+func (hub *metadataHub) publish(part metadataPart) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for ch := range hub.subs {
+		select {
+		case ch <- part:
+		default:
+		}
+	}
+}
+
+// metadataHandler streams the metadata parts of the source as multipart.
+// Its clients also subscribe to the frames, so the source stays connected
+// while only metadata is watched.
+func (pubSub *PubSub) metadataHandler(hub *metadataHub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			pubSub.httpError(w, r, errorMethod, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return
+		}
+
+		release, ok := pubSub.limitUser(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		sub := NewSubscriber(clientAddress(r))
+		pubSub.Subscribe(sub)
+		defer pubSub.Unsubscribe(sub)
+		setupDone(r)
+
+		select {
+		case ok := <-sub.admitted:
+			if !ok {
+				http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		parts := hub.subscribe()
+		defer hub.unsubscribe(parts)
+
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+	LOOP:
+		for {
+			select {
+			case frame, ok := <-sub.ChunkChannel:
+				if !ok {
+					break LOOP
+				}
+				memoryRelease(len(frame.Data))
+			case part := <-parts:
+				header := make(textproto.MIMEHeader)
+				header.Set("Content-Type", part.contentType)
+				header.Set("Content-Length", fmt.Sprintf("%d", len(part.data)))
+				pw, err := mw.CreatePart(header)
+				if err == nil {
+					_, err = pw.Write(part.data)
+				}
+				if err != nil {
+					logf("server[%s]: metadata write failed: %s\n", pubSub.id, err)
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				break LOOP
+			}
+		}
+
+		mw.Close()
+	})
+}
@@ -0,0 +1,185 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	frameSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "frame_size_bytes",
+		Help:      "Size of frames published to subscribers.",
+		Buckets:   prometheus.ExponentialBuckets(4096, 2, 10), // 4KiB to 2MiB
+	}, []string{"stream"})
+
+	ingestBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "upstream_bytes_total",
+		Help:      "Bytes read from the sources.",
+	}, []string{"stream"})
+
+	ingestRateGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "upstream_bytes_per_second",
+		Help:      "Current rate of bytes read from all sources together.",
+	}, func() float64 {
+		return ingestMeter.value()
+	})
+
+	transformCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "transforms_total",
+		Help:      "Frame transformations applied, by stage and type.",
+	}, []string{"stream", "stage", "type"})
+
+	transformHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "transform_duration_seconds",
+		Help:      "Time spent transforming a frame.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12), // 0.5ms to 1s
+	}, []string{"stream", "stage"})
+
+	disconnectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "client_disconnects_total",
+		Help:      "Clients leaving a stream, by reason.",
+	}, []string{"stream", "reason"})
+
+	streamEventDescs = map[string]*prometheus.Desc{
+		"created":         streamEventDesc("created", "Time the stream was set up."),
+		"last_connect":    streamEventDesc("last_connect", "Time of the last successful source connect."),
+		"last_frame":      streamEventDesc("last_frame", "Time the last frame was read from the source."),
+		"last_subscriber": streamEventDesc("last_subscriber", "Last time the stream had a subscriber."),
+	}
+
+	viewersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "viewers",
+		Help:      "Clients watching a stream, by path with -pathmetrics.",
+	}, []string{"stream", "path"})
+
+	viewerBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "viewer_bytes_total",
+		Help:      "Frame bytes sent to stream clients, by path with -pathmetrics.",
+	}, []string{"stream", "path"})
+
+	memoryGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "mjpeg_proxy",
+		Name:      "memory_in_use_bytes",
+		Help:      "Estimated memory held by frames in flight to clients.",
+	}, func() float64 {
+		return float64(memoryUsed())
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(frameSizeHistogram)
+	metricsRegistry.MustRegister(memoryGauge)
+	metricsRegistry.MustRegister(ingestBytesCounter)
+	metricsRegistry.MustRegister(ingestRateGauge)
+	metricsRegistry.MustRegister(transformCounter)
+	metricsRegistry.MustRegister(transformHistogram)
+	metricsRegistry.MustRegister(disconnectCounter)
+	metricsRegistry.MustRegister(viewersGauge)
+	metricsRegistry.MustRegister(viewerBytesCounter)
+	metricsRegistry.MustRegister(streamEventCollector{})
+}
+
+func streamEventDesc(event, help string) *prometheus.Desc {
+	return prometheus.NewDesc("mjpeg_proxy_stream_"+event+"_timestamp_seconds",
+		help, []string{"stream"}, nil)
+}
+
+// streamEventCollector reports the times of stream events from the status
+// of each stream, leaving out events that did not happen yet.
+type streamEventCollector struct{}
+
+func (streamEventCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range streamEventDescs {
+		ch <- desc
+	}
+}
+
+func (streamEventCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, pubSub := range pubSubs {
+		status := pubSub.Status()
+		for event, t := range map[string]time.Time{
+			"created":         status.Created,
+			"last_connect":    status.LastConnect,
+			"last_frame":      status.LastFrame,
+			"last_subscriber": status.LastSubscriber,
+		} {
+			if t.IsZero() {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(streamEventDescs[event],
+				prometheus.GaugeValue, float64(t.UnixNano())/1e9, pubSub.id)
+		}
+	}
+}
+
+// Transformation stages: once per frame from the source, or per client
+// handler for output options like thumbnails.
+const (
+	stageSource = "source"
+	stageOutput = "output"
+)
+
+// Report viewer metrics for each path a stream is served on, like its
+// aliases, instead of merging them into the stream.
+var pathMetrics bool
+
+// viewerMetrics returns the metrics of the subscriber's viewers. Source
+// metrics are always shared by the paths of a stream.
+func (pubSub *PubSub) viewerMetrics(sub *Subscriber) (prometheus.Gauge, prometheus.Counter) {
+	path := pubSub.id
+	if pathMetrics && sub.path != "" {
+		path = sub.path
+	}
+	return viewersGauge.WithLabelValues(pubSub.id, path),
+		viewerBytesCounter.WithLabelValues(pubSub.id, path)
+}
+
+func countTransform(stream, stage, kind string) {
+	transformCounter.WithLabelValues(stream, stage, kind).Inc()
+}
+
+func observeTransform(stream, stage string, start time.Time) {
+	transformHistogram.WithLabelValues(stream, stage).Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler also adds the Go runtime and process metrics, so they
+// are only collected once metrics are enabled.
+func metricsHandler() http.Handler {
+	metricsRegistry.MustRegister(collectors.NewGoCollector())
+	metricsRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
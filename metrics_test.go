@@ -0,0 +1,141 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Viewers are reported by the registered path, requests below a subtree
+// alias share its label.
+func TestPathMetrics(t *testing.T) {
+	old := pathMetrics
+	pathMetrics = true
+	defer func() { pathMetrics = old }()
+
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	pubSub := newTestStream(t, "/pathmetrics", configSource{Source: source.URL})
+
+	mux := http.NewServeMux()
+	mux.Handle("/pathmetrics", pubSub)
+	mux.Handle("/pathmetrics-alias/", pubSub)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	for _, path := range []string{"/pathmetrics", "/pathmetrics-alias/a", "/pathmetrics-alias/b"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		readFrames(t, resp, 1)
+	}
+
+	want := map[string]float64{"/pathmetrics": 1, "/pathmetrics-alias/": 2}
+	for path, viewers := range want {
+		gauge := viewersGauge.WithLabelValues(pubSub.id, path)
+		if got := metricValue(t, gauge); got != viewers {
+			t.Errorf("viewers on %s: got %g, want %g", path, got, viewers)
+		}
+		bytes := viewerBytesCounter.WithLabelValues(pubSub.id, path)
+		if metricValue(t, bytes) == 0 {
+			t.Errorf("no bytes counted on %s", path)
+		}
+	}
+	for _, path := range []string{"/pathmetrics-alias/a", "/pathmetrics-alias/b"} {
+		if viewersGauge.DeleteLabelValues(pubSub.id, path) {
+			t.Errorf("viewers reported by request path %s", path)
+		}
+	}
+
+	// the source is read once for all paths
+	if metricValue(t, ingestBytesCounter.WithLabelValues(pubSub.id)) == 0 {
+		t.Errorf("no source bytes counted")
+	}
+}
+
+// Published frames are observed in the size histogram of their stream.
+func TestFrameSizeHistogram(t *testing.T) {
+	frameSizeHistogram.DeleteLabelValues("/framesize") // from earlier runs
+	pubSub := newTestPubSub(t, "/framesize", configSource{})
+	for _, size := range []int{1000, 20000, 20000, 300000} {
+		pubSub.doPublish(Frame{Data: make([]byte, size), Captured: time.Now()})
+	}
+
+	var m dto.Metric
+	err := frameSizeHistogram.WithLabelValues("/framesize").(prometheus.Metric).Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m.GetHistogram()
+	if h.GetSampleCount() != 4 || h.GetSampleSum() != 341000 {
+		t.Errorf("got %d frames of %g bytes, want 4 of 341000", h.GetSampleCount(), h.GetSampleSum())
+	}
+	for _, bucket := range h.GetBucket() {
+		want := uint64(0)
+		for _, size := range []float64{1000, 20000, 20000, 300000} {
+			if size <= bucket.GetUpperBound() {
+				want++
+			}
+		}
+		if bucket.GetCumulativeCount() != want {
+			t.Errorf("bucket %g: got %d, want %d", bucket.GetUpperBound(), bucket.GetCumulativeCount(), want)
+		}
+	}
+}
+
+// The Go runtime and process metrics are only collected once the metrics
+// handler is set up.
+func TestRuntimeMetrics(t *testing.T) {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), "go_") || strings.HasPrefix(family.GetName(), "process_") {
+			t.Errorf("%s collected without the handler", family.GetName())
+		}
+	}
+
+	handler := metricsHandler()
+	defer func() {
+		// equal collectors unregister the ones added by the handler
+		metricsRegistry.Unregister(collectors.NewGoCollector())
+		metricsRegistry.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "process_cpu_seconds_total", "process_start_time_seconds"} {
+		if !strings.Contains(body, "\n"+name+" ") {
+			t.Errorf("%s missing from the exposition", name)
+		}
+	}
+}
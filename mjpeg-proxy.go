@@ -20,52 +20,279 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
 )
 
 var (
-	clientHeader  string
-	frameTimeout  time.Duration
-	stopDelay     time.Duration
-	tcpSendBuffer int
-	pubSubs       []PubSub
+	clientHeader    string
+	frameTimeout    time.Duration
+	stopDelay       time.Duration
+	tcpSendBuffer   int
+	writeBufferSize int
+	maxBatchFrames  int
+	maxBatchDelay   time.Duration
+	statusInterval  time.Duration
+	upstreamReuse   bool
+	requestTimeout  time.Duration
+	maxHeaderBytes  int
+	minSendInterval time.Duration
+	maxSendInterval time.Duration
+	adminUser       string
+	adminPassword   string
+	pubSubs         []*PubSub
 )
 
 type configSource struct {
-	Source          string
-	Username        string
-	Password        string
-	Digest          bool
-	Path            string
-	Rate            float64
-	DurationSeconds float64
+	Source               string
+	Username             string
+	Password             string
+	Digest               bool
+	Auth                 string
+	SourceQuery          map[string]string
+	ForwardQuery         []string
+	Path                 string
+	Rate                 float64
+	DefaultFPS           float64
+	MaxFPS               float64
+	DurationSeconds      float64
+	EndBehavior          string
+	EndImage             string
+	IdleTimeoutSeconds   float64
+	ConnectDelaySeconds  float64
+	StaleIntervalSeconds float64
+	MaxFrameAgeSeconds   float64
+	JoinWindowSeconds    float64
+	Baseline             bool
+	Grayscale            bool
+	GrayQuery            bool
+	TransformOrder       []string
+	MaxWidth             int
+	MaxHeight            int
+	ValidateLength       bool
+	ValidateJPEG         bool
+	SniffBoundary        bool
+	LastGoodSeconds      float64
+	DumpDir              string
+	DumpFrames           int
+	ReadBuffer           int
+	ReadBufferMax        int
+	ContentType          string
+	Boundary             string
+	Preamble             string
+	Aliases              []string
+	PreamblePart         string
+	MaxFrameErrors       int
+	StripMarkers         []string
+	ReportDrops          bool
+	FreezeOnEnd          bool
+	MaxSubscribers       int
+	QueueLength          int
+	QueueTimeoutSeconds  float64
+	Thumbnail            *configThumbnail
+	HLS                  *configHLS
+	SequencePath         string
+	MetadataPath         string
+	LogLevel             string
+	Sample               *configSample
+	Login                *configLogin
+	Extensions           bool
+	Users                map[string]string
+	Realm                string
+	ErrorPage            *configErrorPage
+	ContactSheet         *configContactSheet
+	Eager                bool
 }
 
-func startSource(source, username, password, proxyUrl string, digest bool, rate float64, durationSeconds float64) error {
-	chunker, err := NewChunker(proxyUrl, source, username, password, digest, rate)
+// configThumbnail declares a downscaled, rate limited stream derived
+// from the same source without opening another upstream connection.
+type configThumbnail struct {
+	Path  string
+	Rate  float64
+	Scale float64
+	Gray  bool
+}
+
+func startSource(conf configSource) error {
+	proxyUrl := conf.Path
+	if conf.ContentType != "" && !strings.Contains(conf.ContentType, boundaryPlaceholder) {
+		return fmt.Errorf("chunker[%s]: content type without %s: %s",
+			proxyUrl, boundaryPlaceholder, conf.ContentType)
+	}
+
+	var endImage []byte
+	switch conf.EndBehavior {
+	case "", endClose, endTrailer:
+	case endPlaceholder:
+		data, err := ioutil.ReadFile(conf.EndImage)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: end image: %s", proxyUrl, err)
+		}
+		endImage = data
+	default:
+		return fmt.Errorf("chunker[%s]: unknown end behavior: %s", proxyUrl, conf.EndBehavior)
+	}
+
+	if conf.Boundary != "" {
+		err := multipart.NewWriter(nil).SetBoundary(conf.Boundary)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: boundary %q: %s", proxyUrl, conf.Boundary, err)
+		}
+		if strings.Contains(conf.Preamble, "--"+conf.Boundary) {
+			return fmt.Errorf("chunker[%s]: preamble contains the boundary", proxyUrl)
+		}
+	}
+
+	// clearing the dump must not touch the samples
+	if conf.DumpDir != "" && conf.Sample != nil && conf.Sample.Dir != "" &&
+		filepath.Clean(conf.DumpDir) == filepath.Clean(conf.Sample.Dir) {
+		return fmt.Errorf("chunker[%s]: dump and sample directories must differ", proxyUrl)
+	}
+
+	if conf.LogLevel != "" {
+		level, err := parseLogLevel(conf.LogLevel)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: %s", proxyUrl, err)
+		}
+		streamLogLevels.Store(proxyUrl, level)
+	}
+
+	var page *errorPage
+	if conf.ErrorPage != nil {
+		var err error
+		page, err = newErrorPage(*conf.ErrorPage)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: error page: %s", proxyUrl, err)
+		}
+	}
+
+	chunker, err := NewChunker(proxyUrl, conf)
 	if err != nil {
 		return fmt.Errorf("chunker[%s]: create failed: %s", proxyUrl, err)
 	}
 
-	pubSub := NewPubSub(proxyUrl, chunker, durationSeconds)
+	var metadata *metadataHub
+	if conf.MetadataPath != "" {
+		metadata = newMetadataHub()
+		chunker.metadata = metadata
+	}
+
+	pubSub := NewPubSub(proxyUrl, chunker, conf)
+	pubSub.endImage = endImage
+	pubSub.errorPage = page
+	if eventURL != "" {
+		pubSub.SetCallbacks(postEvents(eventURL))
+	}
 	pubSub.Start()
-	pubSubs = append(pubSubs, *pubSub)
+	addStream(pubSub)
+
+	logf("chunker[%s]: serving from %s\n", proxyUrl, conf.Source)
+	pubSub.handle(proxyUrl, pubSub)
+
+	for _, alias := range conf.Aliases {
+		logf("chunker[%s]: serving also on %s\n", proxyUrl, alias)
+		pubSub.handle(alias, pubSub)
+	}
+
+	if conf.Extensions {
+		base := extensionBase(proxyUrl)
+		logf("chunker[%s]: serving %s.mjpg, %s.jpg and %s.gif\n", proxyUrl, base, base, base)
+		pubSub.handle(base+".mjpg", pubSub)
+		pubSub.handle(base+".jpg", http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				pubSub.serveSnapshot(w, r, outputOptions{})
+			}))
+		pubSub.handle(base+".gif", http.HandlerFunc(pubSub.serveGIF))
+	}
 
-	fmt.Printf("chunker[%s]: serving from %s\n", proxyUrl, source)
-	http.Handle(proxyUrl, pubSub)
+	if thumb := conf.Thumbnail; thumb != nil && thumb.Path != "" {
+		opts := outputOptions{rate: thumb.Rate, scale: thumb.Scale, gray: thumb.Gray}
+		if opts.rate <= 0 {
+			opts.rate = 1
+		}
+		if opts.scale <= 0 || opts.scale > 1 {
+			opts.scale = 0.25
+		}
+
+		logf("chunker[%s]: serving thumbnail on %s\n", proxyUrl, thumb.Path)
+		pubSub.handle(thumb.Path, pubSub.handler(opts))
+	}
+
+	if conf.SequencePath != "" {
+		prefix := strings.TrimSuffix(conf.SequencePath, "/") + "/"
+		logf("chunker[%s]: serving image sequence on %s\n", proxyUrl, prefix)
+		pubSub.handle(prefix, pubSub.sequenceHandler(prefix))
+	}
+
+	if conf.HLS != nil && conf.HLS.Path != "" {
+		prefix := strings.TrimSuffix(conf.HLS.Path, "/") + "/"
+		logf("chunker[%s]: serving HLS on %s\n", proxyUrl, prefix)
+		pubSub.handle(prefix, newHLSStream(pubSub, prefix, *conf.HLS))
+	}
+
+	if sheet := conf.ContactSheet; sheet != nil && sheet.Path != "" {
+		logf("chunker[%s]: serving contact sheet on %s\n", proxyUrl, sheet.Path)
+		pubSub.handle(sheet.Path, newContactSheet(pubSub, *sheet))
+	}
+
+	if metadata != nil {
+		logf("chunker[%s]: serving metadata on %s\n", proxyUrl, conf.MetadataPath)
+		pubSub.handle(conf.MetadataPath, pubSub.metadataHandler(metadata))
+	}
+
+	if conf.Sample != nil && conf.Sample.Dir != "" {
+		sampler, err := newFrameSampler(pubSub, *conf.Sample)
+		if err != nil {
+			return fmt.Errorf("chunker[%s]: sample: %s", proxyUrl, err)
+		}
+		logf("chunker[%s]: saving a frame every %s to %s\n",
+			proxyUrl, sampler.interval, sampler.dir)
+		go sampler.run()
+	}
+
+	return nil
+}
+
+// handle registers a handler serving the stream. Preflight requests carry
+// no credentials, so they are answered before authentication.
+func (pubSub *PubSub) handle(path string, handler http.Handler) {
+	http.Handle(path, cors(pubSub.authenticate(handler)))
+}
+
+func findPubSub(id string) *PubSub {
+	for _, pubSub := range pubSubs {
+		if pubSub.id == id {
+			return pubSub
+		}
+	}
 
 	return nil
 }
 
+// extensionBase returns the path the stream, snapshot and GIF preview
+// extensions are added to, /stream for a stream served on the root.
+func extensionBase(path string) string {
+	base := strings.TrimSuffix(path, "/")
+	if base == "" {
+		return "/stream"
+	}
+	return base
+}
+
 func loadConfig(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -74,7 +301,7 @@ func loadConfig(filename string) error {
 	defer func() {
 		err := file.Close()
 		if err != nil {
-			fmt.Printf("config: file close failed for %s: %s\n", file.Name(), err)
+			logf("config: file close failed for %s: %s\n", file.Name(), err)
 		}
 	}()
 
@@ -87,16 +314,38 @@ func loadConfig(filename string) error {
 
 	exists := make(map[string]bool)
 	for _, conf := range sources {
-		if exists[conf.Path] {
-			return fmt.Errorf("duplicate proxy path: %s", conf.Path)
+		paths := []string{conf.Path}
+		if conf.Thumbnail != nil && conf.Thumbnail.Path != "" {
+			paths = append(paths, conf.Thumbnail.Path)
+		}
+		if conf.HLS != nil && conf.HLS.Path != "" {
+			paths = append(paths, strings.TrimSuffix(conf.HLS.Path, "/")+"/")
+		}
+		if conf.ContactSheet != nil && conf.ContactSheet.Path != "" {
+			paths = append(paths, conf.ContactSheet.Path)
+		}
+		if conf.MetadataPath != "" {
+			paths = append(paths, conf.MetadataPath)
+		}
+		if conf.SequencePath != "" {
+			paths = append(paths, strings.TrimSuffix(conf.SequencePath, "/")+"/")
+		}
+		paths = append(paths, conf.Aliases...)
+		if conf.Extensions {
+			base := extensionBase(conf.Path)
+			paths = append(paths, base+".mjpg", base+".jpg", base+".gif")
+		}
+		for _, path := range paths {
+			if exists[path] {
+				return fmt.Errorf("duplicate proxy path: %s", path)
+			}
+			exists[path] = true
 		}
 
-		err = startSource(conf.Source, conf.Username, conf.Password, conf.Path, conf.Digest, conf.Rate, conf.DurationSeconds)
+		err = startSource(conf)
 		if err != nil {
 			return err
 		}
-
-		exists[conf.Path] = true
 	}
 
 	return nil
@@ -104,6 +353,12 @@ func loadConfig(filename string) error {
 
 func connStateEvent(conn net.Conn, event http.ConnState) {
 	if event == http.StateActive && tcpSendBuffer > 0 {
+		if c, ok := conn.(*tls.Conn); ok {
+			conn = c.NetConn()
+		}
+		if c, ok := conn.(*limitConn); ok {
+			conn = c.Conn
+		}
 		switch c := conn.(type) {
 		case *net.TCPConn:
 			c.SetWriteBuffer(tcpSendBuffer)
@@ -134,20 +389,61 @@ func listenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
+	listener = newLimitListener(listener)
 
-	fmt.Printf("server: starting on address %s\n", addr)
+	logf("server: starting on address %s\n", addr)
 	server := &http.Server{
-		ConnState: connStateEvent,
+		Handler:        countRequests(rejectBody(limitForwarded(setupLimit(requestDeadline(http.DefaultServeMux, requestTimeout), maxSetups)))),
+		ConnState:      connStateEvent,
+		MaxHeaderBytes: maxHeaderBytes, // larger headers get 431
+	}
+
+	if tlsCertFile != "" {
+		server.TLSConfig, err = tlsConfig(tlsClientCAs[addr])
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		return server.ServeTLS(listener, "", "")
 	}
 	return server.Serve(listener)
 }
 
+// rejectBody answers GET and HEAD requests carrying a body without reading
+// it. Clients waiting for 100 Continue get the final response instead, as
+// the body is never read, and the connection is closed after it.
+func rejectBody(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.ContentLength != 0 {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Request body not allowed", http.StatusRequestEntityTooLarge)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// requestDeadline bounds the total time of every request as a backstop
+// for handlers that would otherwise never return.
+func requestDeadline(handler http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func infoEndpoint(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	data := map[string]interface{}{}
 	connections := map[string]interface{}{}
 	remoteAddrs := make(map[string][]string)
+	upstream := make(map[string]map[string]string)
+	status := make(map[string]StreamStatus)
 
 	for _, pubSub := range pubSubs {
 		connections[pubSub.id] = len(pubSub.subscribers)
@@ -156,47 +452,465 @@ func infoEndpoint(w http.ResponseWriter, r *http.Request) {
 			remoteAddrs[pubSub.id] = append(remoteAddrs[pubSub.id], sub.RemoteAddr)
 		}
 	}
+	for _, pubSub := range pubSubs {
+		status[pubSub.id] = pubSub.Status()
+		if identity := status[pubSub.id].Upstream; identity != nil {
+			upstream[pubSub.id] = identity
+		}
+	}
 	data["connections"] = connections
+	data["upstream"] = upstream
+	data["status"] = status
 	data["remote_addresses"] = remoteAddrs
 	json.NewEncoder(w).Encode(data)
 }
 
+// statAge returns the seconds since an event, or -1 if it never happened.
+func statAge(t time.Time) float64 {
+	if t.IsZero() {
+		return -1
+	}
+	return time.Since(t).Seconds()
+}
+
+// statName turns a stream path into a key component for /stat.
+func statName(id string) string {
+	name := strings.Trim(id, "/")
+	if name == "" {
+		return "root"
+	}
+	return strings.NewReplacer("/", "_", ".", "_", "=", "_").Replace(name)
+}
+
+func statEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	for _, pubSub := range pubSubs {
+		status := pubSub.Status()
+		connected := 0
+		if status.Connected {
+			connected = 1
+		}
+		frozen := 0
+		if status.Frozen {
+			frozen = 1
+		}
+
+		prefix := "stream." + statName(pubSub.id)
+		fmt.Fprintf(w, "%s.subscribers=%d\n", prefix, status.Subscribers)
+		fmt.Fprintf(w, "%s.queued=%d\n", prefix, status.Queued)
+		fmt.Fprintf(w, "%s.connected=%d\n", prefix, connected)
+		fmt.Fprintf(w, "%s.frozen=%d\n", prefix, frozen)
+		fmt.Fprintf(w, "%s.fps=%.1f\n", prefix, status.FPS)
+		fmt.Fprintf(w, "%s.egress=%.0f\n", prefix, status.EgressRate)
+		fmt.Fprintf(w, "%s.dropratio=%.3f\n", prefix, status.DropRatio)
+		fmt.Fprintf(w, "%s.frames=%d\n", prefix, status.FramesPublished)
+		fmt.Fprintf(w, "%s.uptime=%.0f\n", prefix, status.Uptime)
+		fmt.Fprintf(w, "%s.age=%.0f\n", prefix, statAge(status.Created))
+		fmt.Fprintf(w, "%s.connectage=%.0f\n", prefix, statAge(status.LastConnect))
+		fmt.Fprintf(w, "%s.frameage=%.0f\n", prefix, statAge(status.LastFrame))
+		fmt.Fprintf(w, "%s.subscriberage=%.0f\n", prefix, statAge(status.LastSubscriber))
+		for _, reason := range disconnectReasons {
+			fmt.Fprintf(w, "%s.disconnects.%s=%d\n", prefix, reason, status.Disconnects[reason])
+		}
+	}
+}
+
 func main() {
 	source := flag.String("source", "http://example.com/img.mjpg", "source uri")
 	username := flag.String("username", "", "source uri username")
 	password := flag.String("password", "", "source uri password")
 	digest := flag.Bool("digest", false, "source uri uses digest authentication")
+	sourceQuery := flag.String("sourcequery", "", "query parameters added to the source uri, like a=1&b=2")
+	loginUrl := flag.String("loginurl", "", "login form uri posted to for a session cookie before requesting the source")
+	loginFields := flag.String("loginfields", "", "login form fields, like user=a&pass=b")
+	forwardQuery := flag.String("forwardquery", "", "comma separated client query parameters passed on to the source")
+	auth := flag.String("auth", "", "source uri authentication: basic, digest or auto")
 	sources := flag.String("sources", "", "JSON configuration file to load sources from")
-	bind := flag.String("bind", ":8080", "proxy bind address")
+	bind := flag.String("bind", ":8080", "comma separated proxy bind addresses")
 	path := flag.String("path", "/", "proxy serving path")
+	aliases := flag.String("aliases", "", "comma separated additional paths serving the same stream")
+	flag.BoolVar(&pathMetrics, "pathmetrics", false, "report viewer metrics for each path a stream is served on")
 	rate := flag.Float64("rate", 0, "limit output frame rate")
+	defaultFPS := flag.Float64("defaultfps", 0, "frame rate for clients not requesting one with fps")
+	maxFPS := flag.Float64("maxfps", 0, "highest frame rate sent to any client, whether or not it requests one with fps")
 	duration := flag.Float64("durationseconds", 0, "time before client is disconnected")
+	endBehavior := flag.String("endbehavior", endClose, "end of duration: close, placeholder or trailer")
+	endImage := flag.String("endimage", "", "JPEG file sent as the last frame with -endbehavior placeholder")
+	staleInterval := flag.Float64("staleintervalseconds", 0, "time without frames before repeating the last frame as stale")
+	idleTimeout := flag.Float64("idletimeoutseconds", 0, "time without frames before client is disconnected")
+	maxFrameAge := flag.Float64("maxframeageseconds", 0, "skip frames older than this when sending to clients (0 to send all)")
+	connectDelay := flag.Float64("connectdelayseconds", 0, "time a first client has to stay before connecting to the source")
+	joinWindow := flag.Float64("joinwindowseconds", 0, "send the last frame together to clients joining within this time (0 to wait for the next frame)")
+	contentType := flag.String("contenttype", defaultContentType, "response content type template")
+	eager := flag.Bool("eager", false, "connect to the source on startup and stay connected without clients")
+	freezeOnEnd := flag.Bool("freezeonend", false, "keep clients on the last frame when the source ends cleanly")
+	reportDrops := flag.Bool("reportdrops", false, "add X-Frames-Dropped to frames following frames dropped for slow clients")
+	maxSubscribers := flag.Int("maxsubscribers", 0, "limit number of clients")
+	queueLength := flag.Int("queuelength", 0, "clients waiting for a free slot")
+	queueTimeout := flag.Float64("queuetimeoutseconds", 30, "time a client waits for a free slot")
+	maxFrameErrors := flag.Int("maxframeerrors", 0, "corrupt frames skipped before reconnecting")
+	stripMarkers := flag.String("stripmarkers", "", "comma separated JPEG markers to remove (APP0-APP15, COM)")
+	boundary := flag.String("boundary", "", "fixed multipart boundary for clients (random if empty)")
+	preamble := flag.String("preamble", "", "text sent to clients before the first part, for legacy parsers")
+	preamblePart := flag.String("preamblepart", "", "content type of an empty part sent to clients before the first frame, for legacy parsers")
+	baseline := flag.Bool("baseline", false, "convert progressive JPEG frames to baseline")
+	maxWidth := flag.Int("maxwidth", 0, "downscale frames wider than this")
+	maxHeight := flag.Int("maxheight", 0, "downscale frames higher than this")
+	transformOrder := flag.String("transformorder", "", "comma separated order of the resize and grayscale steps")
+	grayscale := flag.Bool("grayscale", false, "convert frames to grayscale")
+	grayQuery := flag.Bool("grayquery", false, "let clients ask for grayscale frames with gray=1")
+	validateJPEG := flag.Bool("validatejpeg", false, "drop frames not starting and ending like a JPEG image")
+	sniffBoundary := flag.Bool("sniffboundary", false, "look for the boundary in the body if the source content type has none")
+	readBuffer := flag.Int("readbuffer", 4096, "read buffer size for the source connection")
+	readBufferMax := flag.Int("readbuffermax", 0, "grow the read buffer toward 1.5 times the average frame up to this size on reconnects (0 to keep it fixed)")
+	dumpDir := flag.String("dumpdir", "", "directory to dump the first frames read after each connect to")
+	dumpFrames := flag.Int("dumpframes", 10, "number of frames dumped after each connect, at most 100")
+	lastGood := flag.Float64("lastgoodseconds", 0, "replace frames dropped by -validatejpeg with the last good frame up to this age")
+	validateLength := flag.Bool("validatelength", false, "drop frames not matching their Content-Length")
+	hlsPath := flag.String("hlspath", "", "serving path for the stream packaged as HLS")
+	hlsSegment := flag.Float64("hlssegmentseconds", 2, "duration of HLS segments")
+	hlsLength := flag.Int("hlsplaylistlength", 5, "number of segments in the HLS playlist")
+	flag.StringVar(&spritePath, "spritepath", "", "serve a sprite sheet of the latest frame of every stream as <path>.jpg with its layout as <path>.json")
+	flag.IntVar(&spriteTileWidth, "spritetilewidth", 160, "sprite sheet tile width")
+	sheetPath := flag.String("contactsheetpath", "", "serving path for a contact sheet of recent frames")
+	sheetColumns := flag.Int("contactsheetcolumns", 4, "contact sheet columns")
+	sheetRows := flag.Int("contactsheetrows", 3, "contact sheet rows")
+	sheetTileWidth := flag.Int("contactsheettilewidth", 160, "contact sheet tile width")
+	sheetInterval := flag.Float64("contactsheetintervalseconds", 1, "time between frames on the contact sheet")
+	sampleDir := flag.String("sampledir", "", "directory to save sampled frames to")
+	sampleInterval := flag.Float64("sampleintervalseconds", 5, "time between sampled frames")
+	sampleMaxFiles := flag.Int("samplemaxfiles", 0, "remove the oldest sampled frames beyond this count (0 for no limit)")
+	sampleMaxBytes := flag.Int64("samplemaxbytes", 0, "remove the oldest sampled frames beyond this total size (0 for no limit)")
+	metadataPath := flag.String("metadatapath", "", "serving path for non-image parts of the source")
+	extensions := flag.Bool("extensions", false, "also serve the stream as .mjpg, a snapshot as .jpg and a preview as .gif")
+	sequencePath := flag.String("sequencepath", "", "serving path for frames as numbered images")
+	thumbnailPath := flag.String("thumbnailpath", "", "thumbnail stream serving path")
+	thumbnailRate := flag.Float64("thumbnailrate", 1, "thumbnail stream frame rate")
+	thumbnailScale := flag.Float64("thumbnailscale", 0.25, "thumbnail stream image scale")
+	thumbnailGray := flag.Bool("thumbnailgray", false, "convert thumbnail stream to grayscale")
 	maxprocs := flag.Int("maxprocs", 0, "limit number of CPUs used")
+	metrics := flag.Bool("metrics", false, "expose Prometheus metrics on /metrics")
 	flag.DurationVar(&frameTimeout, "frametimeout", 60*time.Second, "limit waiting for next frame")
 	flag.DurationVar(&stopDelay, "stopduration", 60*time.Second, "follow source after last client")
+	flag.DurationVar(&minSendInterval, "minsendinterval", 0, "shortest interval between frames sent to any client")
+	flag.DurationVar(&maxSendInterval, "maxsendinterval", time.Minute, "longest frame interval clients can request with fps")
 	flag.IntVar(&tcpSendBuffer, "sendbuffer", 4096, "limit buffering of frames")
+	flag.IntVar(&tcpRecvBuffer, "recvbuffer", 0, "receive buffer size of client sockets")
+	flag.DurationVar(&keepAlivePeriod, "keepaliveperiod", 0, "TCP keep-alive period of client sockets")
+	flag.IntVar(&maxConnsPerIP, "maxconnsperip", 0, "limit open connections from one client address")
+	flag.DurationVar(&startupRamp, "startupramp", 0, "spread the first connects of eager streams over this time")
+	flag.DurationVar(&watchdogTimeout, "watchdog", 0, "exit when a stream loop hangs for this long, for a supervisor to restart (0 to disable)")
+	flag.IntVar(&watchdogGoroutines, "watchdoggoroutines", 0, "with -watchdog, also exit above this many goroutines (0 for no limit)")
+	flag.StringVar(&recordDir, "recorddir", "", "directory to record the frames of all streams to, in a file per stream and hour")
+	flag.BoolVar(&recordGzip, "recordgzip", false, "compress the recorded files with gzip")
+	flag.StringVar(&eventURL, "eventurl", "", "post stream events like connect and disconnect as JSON to this URL")
+	flag.DurationVar(&auditInterval, "auditinterval", 0, "interval of logging subscriber counts to detect leaks (0 to disable)")
+	flag.IntVar(&maxSubscribersPerIP, "maxsubscribersperip", 0, "warn when one client address holds more subscriptions (0 to disable)")
+	flag.IntVar(&maxSetups, "maxsetups", 0, "limit requests being set up at the same time (0 for no limit)")
+	flag.DurationVar(&rateWindow, "ratewindow", 5*time.Second, "time constant of the averaged frame and byte rates")
+	flag.DurationVar(&statusInterval, "statusinterval", 5*time.Second, "interval of status parts requested with status=1")
+	flag.Int64Var(&memoryLimit, "memorylimit", 0, "limit memory held by frames in flight (bytes)")
+	flag.IntVar(&writeBufferSize, "writebuffer", 0, "buffer size for writing frames to clients")
+	flag.IntVar(&maxBatchFrames, "maxbatchframes", 30, "most frames a client can batch into one flush with batch")
+	flag.DurationVar(&maxBatchDelay, "maxbatchdelay", 500*time.Millisecond, "longest time a batched frame waits for the flush (0 to disable batching)")
+	flag.Int64Var(&ingestLimit, "ingestlimit", 0, "limit bytes per second read from all sources together")
+	flag.BoolVar(&upstreamReuse, "upstreamreuse", true, "reuse upstream connections across reconnects")
+	flag.StringVar(&tlsCertFile, "tlscert", "", "serve HTTPS using this certificate file, reloaded on SIGHUP")
+	flag.StringVar(&tlsKeyFile, "tlskey", "", "private key file for the HTTPS certificate")
+	clientCAs := flag.String("tlsclientca", "", "comma separated address=file pairs requiring HTTPS clients of the bind address to present a certificate signed by the CA")
+	users := flag.String("users", "", "comma separated user:password pairs allowed to view the stream")
+	realm := flag.String("realm", defaultRealm, "realm shown by browsers asking for the stream users")
+	flag.StringVar(&userHeader, "userheader", "", "request header with the user authenticated by a proxy in front, see -trustedproxies")
+	proxies := flag.String("trustedproxies", "", "comma separated addresses or networks of the proxies allowed to set -userheader, their clients are limited by -clientheader for -maxconnsperip")
+	flag.IntVar(&maxStreamsPerUser, "maxstreamsperuser", 0, "limit streams open by one authenticated user (0 for no limit)")
+	errorPageFile := flag.String("errorpagefile", "", "template file with the body of stream error responses")
+	errorPageType := flag.String("errorpagetype", "", "content type of the error page (default text/html)")
+	errorPageStatus := flag.Int("errorpagestatus", 0, "status of error page responses (0 keeps the status of the error)")
+	errorPageRedirect := flag.String("errorpageredirect", "", "redirect stream errors to this URL template instead")
+	errorPageRedirectStatus := flag.Int("errorpageredirectstatus", 0, "status of error page redirects: 301, 302, 303, 307 or 308 (default 302)")
+	stat := flag.Bool("stat", false, "enable plain text /stat endpoint")
+	frameInfo := flag.Bool("frameinfo", false, "enable /frameinfo/ endpoint describing the latest frame of each stream")
+	flag.DurationVar(&requestTimeout, "requesttimeout", 0, "limit total duration of any request (0 for no limit)")
+	flag.IntVar(&maxHeaderBytes, "maxheaderbytes", 64*1024, "limit size of client request headers")
+	flag.BoolVar(&snapshotETags, "snapshotetags", true, "answer snapshot polls with 304 Not Modified while the frame is unchanged")
+	flag.BoolVar(&snapshotShare, "snapshotshare", true, "transform a frame once for concurrent snapshot requests with the same options")
+	flag.BoolVar(&snapshotRanges, "snapshotranges", true, "answer Range requests for snapshots with partial content of the frame named by If-Range")
+	origins := flag.String("corsorigins", "", "comma separated origins allowed to embed the streams, * for any")
+	flag.BoolVar(&corsCredentials, "corscredentials", false, "allow cross-origin requests with cookies or authorization")
 	flag.StringVar(&clientHeader, "clientheader", "X-Forwarded-For", "request header with client address")
+	flag.StringVar(&adminUser, "adminuser", "admin", "admin endpoints username")
+	flag.StringVar(&adminPassword, "adminpassword", "", "admin endpoints password (disabled if empty)")
+	adminUI := flag.Bool("adminui", false, "serve an admin page on /admin/")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "ffmpeg", "ffmpeg binary used for HLS")
+	level := flag.String("loglevel", "info", "log level: debug or info")
+	logFile := flag.String("logfile", "", "write log messages to this file instead of stdout")
+	logStdout := flag.Bool("logstdout", false, "also write log messages to stdout when using -logfile")
+	logMaxSize := flag.Int64("logmaxsize", 10*1024*1024, "rotate the log file after this many bytes (0 for no limit)")
+	logMaxAge := flag.Duration("logmaxage", 0, "rotate the log file after this duration (0 for no limit)")
+	logBackups := flag.Int("logbackups", 3, "number of rotated log files to keep")
 	flag.Parse()
 
+	if *logFile != "" {
+		file, err := openRotatingFile(*logFile, *logMaxSize, *logMaxAge, *logBackups)
+		if err != nil {
+			fmt.Println("log:", err)
+			os.Exit(1)
+		}
+		logOutput = file
+		if *logStdout {
+			logOutput = io.MultiWriter(file, os.Stdout)
+		}
+	}
+
+	var err error
+	logLevel, err = parseLogLevel(*level)
+	if err != nil {
+		logf("config: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, origin := range strings.Split(*origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	if err = checkCORS(); err != nil {
+		logf("config: %s\n", err)
+		os.Exit(1)
+	}
+
+	addrs := strings.Split(*bind, ",")
+	tlsClientCAs, err = parseClientCAs(*clientCAs, addrs)
+	if err != nil {
+		logf("config: %s\n", err)
+		os.Exit(1)
+	}
+	if len(tlsClientCAs) > 0 && tlsCertFile == "" {
+		logf("config: tlsclientca requires tlscert\n")
+		os.Exit(1)
+	}
+
+	trustedProxies, err = parseTrustedProxies(*proxies)
+	if err != nil {
+		logf("config: %s\n", err)
+		os.Exit(1)
+	}
+	if userHeader != "" && len(trustedProxies) == 0 {
+		logf("config: userheader requires trustedproxies\n")
+		os.Exit(1)
+	}
+
+	if rateWindow <= 0 {
+		logf("config: ratewindow must be positive\n")
+		os.Exit(1)
+	}
+
+	if *errorPageFile != "" || *errorPageRedirect != "" {
+		defaultErrorPage, err = newErrorPage(configErrorPage{
+			Status:         *errorPageStatus,
+			ContentType:    *errorPageType,
+			File:           *errorPageFile,
+			Redirect:       *errorPageRedirect,
+			RedirectStatus: *errorPageRedirectStatus,
+		})
+		if err != nil {
+			logf("config: error page: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *maxprocs > 0 {
 		runtime.GOMAXPROCS(*maxprocs)
 	}
 
-	var err error
 	if *sources != "" {
 		err = loadConfig(*sources)
 	} else {
-		err = startSource(*source, *username, *password, *path, *digest, *rate, *duration)
+		conf := configSource{
+			Source:               *source,
+			Username:             *username,
+			Password:             *password,
+			Digest:               *digest,
+			Auth:                 *auth,
+			SourceQuery:          make(map[string]string),
+			Path:                 *path,
+			Rate:                 *rate,
+			DefaultFPS:           *defaultFPS,
+			MaxFPS:               *maxFPS,
+			DurationSeconds:      *duration,
+			EndBehavior:          *endBehavior,
+			EndImage:             *endImage,
+			SequencePath:         *sequencePath,
+			Extensions:           *extensions,
+			MetadataPath:         *metadataPath,
+			IdleTimeoutSeconds:   *idleTimeout,
+			ConnectDelaySeconds:  *connectDelay,
+			StaleIntervalSeconds: *staleInterval,
+			MaxFrameAgeSeconds:   *maxFrameAge,
+			JoinWindowSeconds:    *joinWindow,
+			Baseline:             *baseline,
+			Grayscale:            *grayscale,
+			GrayQuery:            *grayQuery,
+			TransformOrder:       strings.Split(*transformOrder, ","),
+			MaxWidth:             *maxWidth,
+			MaxHeight:            *maxHeight,
+			ValidateLength:       *validateLength,
+			ValidateJPEG:         *validateJPEG,
+			SniffBoundary:        *sniffBoundary,
+			LastGoodSeconds:      *lastGood,
+			DumpDir:              *dumpDir,
+			DumpFrames:           *dumpFrames,
+			ReadBuffer:           *readBuffer,
+			ReadBufferMax:        *readBufferMax,
+			ContentType:          *contentType,
+			Boundary:             *boundary,
+			Preamble:             *preamble,
+			Realm:                *realm,
+			PreamblePart:         *preamblePart,
+			MaxFrameErrors:       *maxFrameErrors,
+			StripMarkers:         strings.Split(*stripMarkers, ","),
+			ReportDrops:          *reportDrops,
+			FreezeOnEnd:          *freezeOnEnd,
+			Eager:                *eager,
+			MaxSubscribers:       *maxSubscribers,
+			QueueLength:          *queueLength,
+			QueueTimeoutSeconds:  *queueTimeout,
+		}
+		var query url.Values
+		query, err = url.ParseQuery(*sourceQuery)
+		if err != nil {
+			logf("config: invalid source query: %s\n", err)
+			os.Exit(1)
+		}
+		for key := range query {
+			conf.SourceQuery[key] = query.Get(key)
+		}
+		if *aliases != "" {
+			conf.Aliases = strings.Split(*aliases, ",")
+		}
+		if *users != "" {
+			conf.Users = make(map[string]string)
+			for _, pair := range strings.Split(*users, ",") {
+				user := strings.SplitN(pair, ":", 2)
+				if len(user) != 2 {
+					logf("config: invalid user, expected user:password: %s\n", user[0])
+					os.Exit(1)
+				}
+				conf.Users[user[0]] = user[1]
+			}
+		}
+		if *loginUrl != "" {
+			fields, err := url.ParseQuery(*loginFields)
+			if err != nil {
+				logf("config: invalid login fields: %s\n", err)
+				os.Exit(1)
+			}
+			conf.Login = &configLogin{URL: *loginUrl, Fields: make(map[string]string)}
+			for key := range fields {
+				conf.Login.Fields[key] = fields.Get(key)
+			}
+		}
+		if *forwardQuery != "" {
+			conf.ForwardQuery = strings.Split(*forwardQuery, ",")
+		}
+		if *thumbnailPath != "" {
+			conf.Thumbnail = &configThumbnail{
+				Path:  *thumbnailPath,
+				Rate:  *thumbnailRate,
+				Scale: *thumbnailScale,
+				Gray:  *thumbnailGray,
+			}
+		}
+		if *sheetPath != "" {
+			conf.ContactSheet = &configContactSheet{
+				Path:            *sheetPath,
+				Columns:         *sheetColumns,
+				Rows:            *sheetRows,
+				TileWidth:       *sheetTileWidth,
+				IntervalSeconds: *sheetInterval,
+			}
+		}
+		if *sampleDir != "" {
+			conf.Sample = &configSample{
+				Dir:             *sampleDir,
+				IntervalSeconds: *sampleInterval,
+				MaxFiles:        *sampleMaxFiles,
+				MaxBytes:        *sampleMaxBytes,
+			}
+		}
+		if *hlsPath != "" {
+			conf.HLS = &configHLS{
+				Path:           *hlsPath,
+				SegmentSeconds: *hlsSegment,
+				PlaylistLength: *hlsLength,
+			}
+		}
+		err = startSource(conf)
 	}
 	if err != nil {
-		fmt.Println("config:", err)
+		logf("config: %s\n", err)
 		os.Exit(1)
 	}
 
 	http.HandleFunc("/api/info", infoEndpoint)
-	err = listenAndServe(*bind)
-	if err != nil {
-		fmt.Println("server:", err)
-		os.Exit(1)
+	if *stat {
+		http.HandleFunc("/stat", statEndpoint)
+	}
+	if *frameInfo {
+		http.HandleFunc("/frameinfo/", frameInfoEndpoint)
+	}
+	if spritePath != "" {
+		if spriteTileWidth <= 0 || spriteTileWidth > contactSheetMaxTileWidth {
+			spriteTileWidth = 160
+		}
+		http.Handle(spritePath+".jpg", cors(http.HandlerFunc(spriteEndpoint)))
+		http.Handle(spritePath+".json", cors(http.HandlerFunc(spriteEndpoint)))
+	}
+	http.HandleFunc("/debug/raw/", adminHandler(debugRawEndpoint))
+	http.HandleFunc("/admin/reset", adminHandler(resetEndpoint))
+	http.HandleFunc("/admin/reset/", adminHandler(resetEndpoint))
+	http.HandleFunc("/admin/reconnect/", adminHandler(reconnectEndpoint))
+	http.HandleFunc("/admin/pause/", adminHandler(pauseEndpoint))
+	http.HandleFunc("/admin/resume/", adminHandler(pauseEndpoint))
+	http.HandleFunc("/admin/subscribers/", adminHandler(subscribersEndpoint))
+	http.HandleFunc("/admin/kick/", adminHandler(kickEndpoint))
+	if *adminUI {
+		http.HandleFunc("/admin/", adminHandler(adminUIEndpoint))
+	}
+	if *metrics {
+		http.Handle("/metrics", metricsHandler())
+	}
+	if watchdogTimeout > 0 {
+		go watchStreams(watchdogTimeout)
+	}
+	if auditInterval > 0 {
+		go auditSubscribers(auditInterval)
+	}
+	if recordDir != "" {
+		recorder, err := newFrameRecorder(recordDir, recordGzip)
+		if err != nil {
+			logf("config: record: %s\n", err)
+			os.Exit(1)
+		}
+		logf("record: recording all streams to %s\n", recordDir)
+		SubscribeAll(recorder.write)
+	}
+
+	var eagerStreams []*PubSub
+	for _, pubSub := range pubSubs {
+		if pubSub.eager {
+			eagerStreams = append(eagerStreams, pubSub)
+		}
+	}
+	startEager(eagerStreams)
+
+	errs := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			errs <- listenAndServe(addr)
+		}(addr)
 	}
+	logf("server: %s\n", <-errs)
+	os.Exit(1)
 }
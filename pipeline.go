@@ -0,0 +1,161 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Steps of the frame pipeline, in the order they run unless configured
+// otherwise.
+const (
+	stepResize    = "resize"
+	stepGrayscale = "grayscale"
+)
+
+var defaultTransformOrder = []string{stepResize, stepGrayscale}
+
+// imageStep is one operation of the pipeline. It returns the image itself
+// if there is nothing to change, and skip tells from the frame header
+// alone that this is the case.
+type imageStep struct {
+	name  string
+	apply func(img image.Image) image.Image
+	skip  func(width, height, components int) bool
+}
+
+// framePipeline decodes a frame once, applies the enabled steps in the
+// configured order and encodes the result once. Frames no step changes
+// are passed on as they are, without decoding them if the header is
+// enough to tell, unless progressive frames are to be made baseline.
+type framePipeline struct {
+	steps    []imageStep
+	baseline bool
+	names    []string // enabled steps
+}
+
+func newFramePipeline(conf configSource) (*framePipeline, error) {
+	enabled := make(map[string]imageStep)
+	if conf.MaxWidth > 0 || conf.MaxHeight > 0 {
+		enabled[stepResize] = imageStep{
+			name: stepResize,
+			apply: func(img image.Image) image.Image {
+				b := img.Bounds()
+				w, h, ok := limitSize(b.Dx(), b.Dy(), conf.MaxWidth, conf.MaxHeight)
+				if !ok {
+					return img
+				}
+				// scaling works in RGBA, keep grayscale frames single channel
+				if _, gray := img.(*image.Gray); gray {
+					return toGray(scaleImage(img, w, h))
+				}
+				return scaleImage(img, w, h)
+			},
+			skip: func(width, height, components int) bool {
+				_, _, ok := limitSize(width, height, conf.MaxWidth, conf.MaxHeight)
+				return !ok
+			},
+		}
+	}
+	if conf.Grayscale {
+		enabled[stepGrayscale] = imageStep{
+			name: stepGrayscale,
+			apply: func(img image.Image) image.Image {
+				return toGray(img)
+			},
+			skip: func(width, height, components int) bool {
+				return components == 1
+			},
+		}
+	}
+
+	// listed steps go first, the others follow in the default order
+	pipeline := &framePipeline{baseline: conf.Baseline}
+	listed := make(map[string]bool)
+	for _, name := range append(conf.TransformOrder, defaultTransformOrder...) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name != stepResize && name != stepGrayscale {
+			return nil, fmt.Errorf("unknown transform: %s", name)
+		}
+		if listed[name] {
+			continue
+		}
+		listed[name] = true
+		if step, ok := enabled[name]; ok {
+			pipeline.steps = append(pipeline.steps, step)
+			pipeline.names = append(pipeline.names, name)
+		}
+	}
+	if pipeline.baseline {
+		pipeline.names = append(pipeline.names, "baseline")
+	}
+
+	if len(pipeline.names) == 0 {
+		return nil, nil
+	}
+	return pipeline, nil
+}
+
+// process returns the transformed frame and the names of the steps that
+// changed it, for the metrics.
+func (pipeline *framePipeline) process(data []byte) ([]byte, []string, error) {
+	var applied []string
+	baseline := pipeline.baseline && jpegProgressive(data)
+	if !baseline {
+		if width, height, components, ok := jpegDimensions(data); ok {
+			skip := true
+			for _, step := range pipeline.steps {
+				skip = skip && step.skip(width, height, components)
+			}
+			if skip {
+				return data, nil, nil
+			}
+		}
+	}
+
+	img, err := decodeJPEG(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, step := range pipeline.steps {
+		out := step.apply(img)
+		if out != img {
+			applied = append(applied, step.name)
+		}
+		img = out
+	}
+	if baseline {
+		applied = append(applied, "baseline")
+	}
+	if len(applied) == 0 {
+		return data, nil, nil
+	}
+
+	out, err := encodeJPEG(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, applied, nil
+}
@@ -0,0 +1,314 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func isGray(t *testing.T, data []byte) bool {
+	t.Helper()
+
+	img, err := decodeJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := img.(*image.Gray)
+	return ok
+}
+
+func TestPipelineGrayscale(t *testing.T) {
+	pipeline, err := newFramePipeline(configSource{Grayscale: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := pipeline.process(testJPEG(t, 32, 32, color.RGBA{255, 0, 0, 255}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGray(t, out) {
+		t.Error("frame not converted to grayscale")
+	}
+}
+
+// gray=1 is only honored for streams allowing it, as it costs CPU.
+func TestGrayQuery(t *testing.T) {
+	frame := testJPEG(t, 32, 32, color.RGBA{255, 0, 0, 255})
+
+	for _, allowed := range []bool{false, true} {
+		source := newTestSource(t, frame, 20*time.Millisecond)
+		pubSub := newTestStream(t, "/grayquery", configSource{Source: source.URL, GrayQuery: allowed})
+		server := httptest.NewServer(pubSub)
+
+		resp, err := http.Get(server.URL + "/?gray=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readFrames(t, resp, 1)[0]
+		resp.Body.Close()
+		server.CloseClientConnections()
+		server.Close()
+
+		if isGray(t, got) != allowed {
+			t.Errorf("grayquery %v: got grayscale %v", allowed, !allowed)
+		}
+	}
+}
+
+// Clients asking for grayscale share one conversion of each frame.
+func TestGrayQueryShared(t *testing.T) {
+	frame := testJPEG(t, 32, 32, color.RGBA{0, 0, 255, 255})
+	source := newTestSource(t, frame, 50*time.Millisecond)
+	pubSub := newTestStream(t, "/grayshared", configSource{Source: source.URL, GrayQuery: true})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	transforms := transformCounter.WithLabelValues("/grayshared", stageOutput, "grayscale")
+	clients := 4
+	resps := make([]*http.Response, clients)
+	for i := range resps {
+		resp, err := http.Get(server.URL + "/?gray=1&fps=5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		resps[i] = resp
+	}
+	before := metricValue(t, transforms)
+	for _, resp := range resps {
+		readFrames(t, resp, 3)
+	}
+
+	// every client got 3 frames, shared they need at most a few more
+	// conversions than one client alone
+	if got := metricValue(t, transforms) - before; got >= float64(2*clients) {
+		t.Errorf("conversions for %d clients: got %v", clients, got)
+	}
+}
+
+func TestPipelineAppliedSteps(t *testing.T) {
+	large := testJPEG(t, 64, 32, color.RGBA{255, 0, 0, 255})
+	small := testJPEG(t, 16, 8, color.RGBA{255, 0, 0, 255})
+	largeGray := grayJPEG(t, 64, 32)
+
+	tests := []struct {
+		order   []string
+		frame   []byte
+		applied []string
+		width   int
+	}{
+		{nil, large, []string{stepResize, stepGrayscale}, 32},
+		{[]string{stepGrayscale}, large, []string{stepGrayscale, stepResize}, 32},
+		// steps with nothing to change do not count
+		{nil, largeGray, []string{stepResize}, 32},
+		{nil, small, []string{stepGrayscale}, 16},
+	}
+	for _, test := range tests {
+		pipeline := mustPipeline(t, configSource{MaxWidth: 32, Grayscale: true, TransformOrder: test.order})
+		out, applied, err := pipeline.process(test.frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(applied) != fmt.Sprint(test.applied) {
+			t.Errorf("order %v: got steps %v, want %v", test.order, applied, test.applied)
+		}
+		img, err := decodeJPEG(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, gray := img.(*image.Gray); !gray || img.Bounds().Dx() != test.width {
+			t.Errorf("order %v: got %T of width %d", test.order, img, img.Bounds().Dx())
+		}
+	}
+
+	// a frame no step changes is passed on as it is
+	smallGray := grayJPEG(t, 16, 8)
+	out, applied, _ := mustPipeline(t, configSource{MaxWidth: 32, Grayscale: true}).process(smallGray)
+	if len(applied) != 0 || &out[0] != &smallGray[0] {
+		t.Errorf("unchanged frame: got steps %v", applied)
+	}
+}
+
+// grayJPEG returns a single channel JPEG of the given size.
+func grayJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	data, err := encodeJPEG(image.NewGray(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func mustPipeline(t *testing.T, conf configSource) *framePipeline {
+	t.Helper()
+
+	pipeline, err := newFramePipeline(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pipeline
+}
+
+// Only transformations that changed the frame are counted.
+func TestTransformCounters(t *testing.T) {
+	transformCounter.DeletePartialMatch(prometheus.Labels{"stream": "/transformcounts"}) // from earlier runs
+	chunker, err := NewChunker("/transformcounts", configSource{
+		Source: "http://127.0.0.1/", MaxWidth: 32, Grayscale: true, StripMarkers: []string{"COM"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := func(stage, kind string) float64 {
+		return metricValue(t, transformCounter.WithLabelValues("/transformcounts", stage, kind))
+	}
+
+	chunker.process(testJPEG(t, 64, 32, color.RGBA{255, 0, 0, 255}))
+	chunker.process(grayJPEG(t, 16, 8))
+	for kind, want := range map[string]float64{stepResize: 1, stepGrayscale: 1, "strip": 0} {
+		if got := counter(stageSource, kind); got != want {
+			t.Errorf("source %s: got %g, want %g", kind, got, want)
+		}
+	}
+
+	opts := outputOptions{gray: true}
+	opts.transform("/transformcounts", grayJPEG(t, 16, 8))
+	if got := counter(stageOutput, "grayscale"); got != 0 {
+		t.Errorf("output grayscale of a gray frame: got %g", got)
+	}
+	opts.transform("/transformcounts", testJPEG(t, 16, 8, color.RGBA{255, 0, 0, 255}))
+	if got := counter(stageOutput, "grayscale"); got != 1 {
+		t.Errorf("output grayscale: got %g, want 1", got)
+	}
+}
+
+// progressiveJPEG is an 8x8 gray image of value 200 encoded progressively,
+// in a DC and an AC scan, as the encoder of Go only writes baseline.
+func progressiveJPEG() []byte {
+	data := []byte{0xff, 0xd8}
+	// quantization table of 8s
+	data = append(data, 0xff, 0xdb, 0x00, 0x43, 0x00)
+	data = append(data, bytes.Repeat([]byte{8}, 64)...)
+	// progressive frame, 8x8 with one component
+	data = append(data, 0xff, 0xc2, 0x00, 0x0b, 0x08, 0x00, 0x08, 0x00, 0x08, 0x01, 0x01, 0x11, 0x00)
+	// DC table coding only category 7 and AC table coding only EOB, both as 0
+	for _, table := range [][2]byte{{0x00, 0x07}, {0x10, 0x00}} {
+		data = append(data, 0xff, 0xc4, 0x00, 0x14, table[0], 0x01)
+		data = append(data, make([]byte, 15)...)
+		data = append(data, table[1])
+	}
+	// DC scan: the code, then 72 (576/8) in 7 bits
+	data = append(data, 0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x48)
+	// AC scan: EOB, padded with ones
+	data = append(data, 0xff, 0xda, 0x00, 0x08, 0x01, 0x01, 0x00, 0x01, 0x3f, 0x00, 0x7f)
+	return append(data, 0xff, 0xd9)
+}
+
+// Progressive frames are transcoded to baseline showing the same image.
+func TestPipelineBaseline(t *testing.T) {
+	in := progressiveJPEG()
+	if !jpegProgressive(in) {
+		t.Fatal("test frame is not progressive")
+	}
+	want, err := decodeJPEG(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, steps, err := mustPipeline(t, configSource{Baseline: true}).process(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jpegProgressive(out) {
+		t.Error("output still progressive")
+	}
+	if fmt.Sprint(steps) != "[baseline]" {
+		t.Errorf("steps: got %v", steps)
+	}
+	got, err := decodeJPEG(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds: got %v, want %v", got.Bounds(), want.Bounds())
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			g1 := color.GrayModel.Convert(got.At(x, y)).(color.Gray).Y
+			g2 := color.GrayModel.Convert(want.At(x, y)).(color.Gray).Y
+			if g1 != g2 || g2 != 200 {
+				t.Fatalf("pixel %d,%d: got %d, want %d", x, y, g1, g2)
+			}
+		}
+	}
+
+	// baseline frames are passed through
+	baseline := testJPEG(t, 8, 8, color.White)
+	out, steps, err = mustPipeline(t, configSource{Baseline: true}).process(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, baseline) || len(steps) != 0 {
+		t.Errorf("baseline frame changed by %v", steps)
+	}
+}
+
+// Frames over the maximum resolution are scaled down to fit keeping their
+// aspect ratio, frames within it are passed on untouched.
+func TestPipelineMaxResolution(t *testing.T) {
+	pipeline := mustPipeline(t, configSource{MaxWidth: 64, MaxHeight: 48})
+
+	tests := []struct {
+		width, height int
+		want          image.Point
+	}{
+		{128, 64, image.Pt(64, 32)},  // too wide
+		{64, 96, image.Pt(32, 48)},   // too high
+		{200, 100, image.Pt(64, 32)}, // both, width limits more
+		{64, 48, image.Pt(64, 48)},   // exactly the limit
+	}
+	for _, test := range tests {
+		in := testJPEG(t, test.width, test.height, color.RGBA{0, 0, 255, 255})
+		out, _, err := pipeline.process(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeJPEG(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.Bounds().Size(); got != test.want {
+			t.Errorf("%dx%d: got %v, want %v", test.width, test.height, got, test.want)
+		}
+		if test.want == image.Pt(test.width, test.height) && !bytes.Equal(out, in) {
+			t.Errorf("%dx%d: frame within the limit changed", test.width, test.height)
+		}
+	}
+}
@@ -20,59 +20,430 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"image"
+	"io"
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/textproto"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Frame is an image read from the source with the time it was received.
+type Frame struct {
+	Data     []byte
+	Captured time.Time
+	Stale    bool // the last frame repeated while the source is stalled
+}
+
 type Subscriber struct {
+	id           uint64
 	RemoteAddr   string
-	ChunkChannel chan []byte
+	ChunkChannel chan Frame
+	MustDeliver  bool // buffer frames instead of dropping them when busy
+	admitted     chan bool
+	dropped      uint64 // frames dropped since the last delivery
+	query        url.Values
+	internal     bool   // subscribed by the proxy itself, not for a request
+	path         string // pattern the stream was requested on
+	since        time.Time
+	kicked       int32 // removed by an admin, atomic
+}
+
+// SubscriberInfo describes a subscriber for the admin endpoints.
+type SubscriberInfo struct {
+	ID       uint64    `json:"id"`
+	Address  string    `json:"address"`
+	Path     string    `json:"path,omitempty"`
+	Internal bool      `json:"internal,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// kickRequest asks the loop to remove the subscriber with the id.
+type kickRequest struct {
+	id    uint64
+	reply chan bool
 }
 
 type PubSub struct {
 	id                    string
 	chunker               *Chunker
-	pubChan               chan []byte
+	pubChan               chan Frame
+	doneChan              <-chan error
+	connectChan           chan error
 	subChan               chan *Subscriber
 	unsubChan             chan *Subscriber
+	statusChan            chan chan StreamStatus
+	recentChan            chan chan [][]byte
+	latestChan            chan chan latestFrame
+	resetChan             chan chan StreamStatus
+	subscribersChan       chan chan []SubscriberInfo
+	reconnectChan         chan struct{}
+	pauseChan             chan bool
+	kickChan              chan kickRequest
+	paused                bool
 	subscribers           map[*Subscriber]struct{}
+	queue                 []*Subscriber
+	maxSubscribers        int
+	queueLength           int
+	queueTimeout          time.Duration
 	stopTimer             *time.Timer
+	connectTimer          *time.Timer
+	connectDelay          time.Duration
+	connectPending        bool
 	streamDurationSeconds float64
+	idleTimeout           time.Duration
+	staleInterval         time.Duration
+	staleTimer            *time.Timer
+	stalled               bool
+	maxFrameAge           time.Duration
+	joinWindow            time.Duration
+	joinTimer             *time.Timer
+	joining               []*Subscriber
+	endBehavior           string
+	reportDrops           bool
+	forwardQuery          []string
+	endImage              []byte
+	defaultInterval       time.Duration
+	minInterval           time.Duration
+	contentType           string
+	debugRaw              int32
+	connecting            bool // a connect to the source is in progress
+	boundary              string
+	preamble              string
+	preamblePart          string
+	boundaryWarning       int64
+	frameSize             prometheus.Observer
+	grayQuery             bool // clients may ask for grayscale frames
+	outputs               outputCache
+	framesPublished       uint64
+	bytesPublished        uint64
+	framesDropped         uint64
+	createdAt             time.Time
+	connectedAt           time.Time
+	lastFrameAt           time.Time
+	lastSubscriberAt      time.Time
+	upstream              map[string]string
+	frameRate             rateEstimator
+	egressRate            rateEstimator
+	deliveryRate          rateEstimator
+	dropRate              rateEstimator
+	callbacks             StreamCallbacks
+	freezeOnEnd           bool
+	freezeTicker          *time.Ticker
+	frozenAt              time.Time
+	lastFrame             Frame
+	disconnects           map[string]*uint64
+	users                 map[string]string
+	realm                 string
+	errorPage             *errorPage
+	eager                 bool
+	recent                [][]byte
+	recentAt              time.Time
+	recentSize            int
+	recentInterval        time.Duration
+}
+
+// StreamStatus is a snapshot of the stream state taken by the pubsub loop.
+type StreamStatus struct {
+	Subscribers     int               `json:"subscribers"`
+	Internal        int               `json:"internal_subscribers"`
+	Queued          int               `json:"queued"`
+	Connected       bool              `json:"connected"`
+	Paused          bool              `json:"paused"`
+	Frozen          bool              `json:"frozen"`
+	Stalled         bool              `json:"stalled"`
+	FramesPublished uint64            `json:"frames_published"`
+	BytesPublished  uint64            `json:"bytes_published"`
+	FramesDropped   uint64            `json:"frames_dropped"`
+	FPS             float64           `json:"fps"`
+	EgressRate      float64           `json:"egress_bytes_per_second"`
+	DropRatio       float64           `json:"drop_ratio"`
+	Upstream        map[string]string `json:"upstream,omitempty"`
+	Disconnects     map[string]uint64 `json:"disconnects"`
+	Uptime          float64           `json:"uptime"`
+	Created         time.Time         `json:"created"`
+	LastConnect     time.Time         `json:"last_connect,omitzero"`
+	LastFrame       time.Time         `json:"last_frame,omitzero"`
+	LastSubscriber  time.Time         `json:"last_subscriber,omitzero"`
+}
+
+// Reasons for admitted clients leaving a stream.
+const (
+	disconnectClient   = "client"          // client closed the connection
+	disconnectWrite    = "write_error"     // sending to the client failed
+	disconnectIdle     = "idle_timeout"    // no frames for idleTimeout
+	disconnectDuration = "duration"        // stream duration is over
+	disconnectUpstream = "upstream"        // source failed or ended
+	disconnectDeadline = "request_timeout" // request deadline reached
+	disconnectKicked   = "kicked"          // removed by an admin
+)
+
+var disconnectReasons = []string{disconnectClient, disconnectWrite, disconnectIdle,
+	disconnectDuration, disconnectUpstream, disconnectDeadline, disconnectKicked}
+
+// Ways of ending a stream once its duration is over, so clients can tell a
+// planned end from a failure.
+const (
+	endClose       = "close"       // terminate the multipart stream
+	endPlaceholder = "placeholder" // send a final image before closing
+	endTrailer     = "trailer"     // report the reason in a trailer
+)
+
+// Frozen streams repeat the last frame at this interval and try to
+// reconnect to the source every freezeRetryInterval.
+const (
+	freezeInterval      = time.Second
+	freezeRetryInterval = 10 * time.Second
+)
+
+// Frames buffered for must-deliver subscribers, so the stream never waits
+// for them and they only lose frames after falling this far behind.
+const mustDeliverBuffer = 64
+
+// Response content type, the placeholder is replaced by the boundary.
+const (
+	boundaryPlaceholder = "{boundary}"
+	defaultContentType  = "multipart/x-mixed-replace; boundary=" + boundaryPlaceholder
+)
+
+// Time a client waits in the admission queue unless configured otherwise.
+const defaultQueueTimeout = 30 * time.Second
+
+// Minimum write buffer for clients batching frames, so the batch is not
+// written out by the response buffer before the flush.
+const batchBufferSize = 256 * 1024
+
+// outputOptions control how frames are sent to the clients of a handler.
+type outputOptions struct {
+	rate  float64 // maximum frames per second, 0 for no limit
+	scale float64 // image scale factor, 0 for original size
+	gray  bool    // convert images to grayscale
+}
+
+// identity reports whether frames are sent unchanged.
+func (opts outputOptions) identity() bool {
+	return (opts.scale <= 0 || opts.scale == 1) && !opts.gray
+}
+
+func (opts outputOptions) transform(stream string, data []byte) []byte {
+	if opts.identity() {
+		return data
+	}
+	scale := opts.scale > 0 && opts.scale != 1
+
+	defer observeTransform(stream, stageOutput, time.Now())
+
+	// frames that fail to decode are passed through unchanged
+	img, err := decodeJPEG(data)
+	if err != nil {
+		return data
+	}
+	if scale {
+		countTransform(stream, stageOutput, "scale")
+		img = scaleImageBy(img, opts.scale)
+	}
+	if opts.gray {
+		if _, ok := img.(*image.Gray); ok && !scale {
+			return data
+		}
+		countTransform(stream, stageOutput, "grayscale")
+		img = toGray(img)
+	}
+
+	out, err := encodeJPEG(img)
+	if err != nil {
+		return data
+	}
+
+	return out
+}
+
+// outputCache keeps the latest output frame of each set of options, so
+// the clients of a handler share one transformation of every frame
+// instead of each repeating it.
+type outputCache struct {
+	mu      sync.Mutex
+	outputs map[outputOptions]*outputFrame
+}
+
+type outputFrame struct {
+	frame *byte // first byte of the source frame, shared by all subscribers
+	done  chan struct{}
+	data  []byte
+}
+
+// get returns the frame transformed with the options, waiting for a
+// transformation of the same frame already in progress.
+func (cache *outputCache) get(stream string, opts outputOptions, data []byte) []byte {
+	if opts.identity() || len(data) == 0 {
+		return data
+	}
+	opts.rate = 0 // does not change the frames
+
+	cache.mu.Lock()
+	if out, ok := cache.outputs[opts]; ok && out.frame == &data[0] {
+		cache.mu.Unlock()
+		<-out.done
+		return out.data
+	}
+	out := &outputFrame{frame: &data[0], done: make(chan struct{})}
+	if cache.outputs == nil {
+		cache.outputs = make(map[outputOptions]*outputFrame)
+	}
+	cache.outputs[opts] = out
+	cache.mu.Unlock()
+
+	out.data = opts.transform(stream, data)
+	close(out.done)
+	return out.data
 }
 
+// Source of the subscriber ids.
+var subscriberIDs uint64
+
 func NewSubscriber(client string) *Subscriber {
 	sub := new(Subscriber)
 
+	sub.id = atomic.AddUint64(&subscriberIDs, 1)
 	sub.RemoteAddr = client
-	sub.ChunkChannel = make(chan []byte)
+	sub.ChunkChannel = make(chan Frame)
+	sub.admitted = make(chan bool, 1)
 
 	return sub
 }
 
-func NewPubSub(id string, chunker *Chunker, streamDuration float64) *PubSub {
+// NewMustDeliverSubscriber returns a subscriber for consumers that should
+// get every frame, like encoders. It must be drained after unsubscribing,
+// the buffered frames are still accounted.
+func NewMustDeliverSubscriber(client string) *Subscriber {
+	sub := NewSubscriber(client)
+	sub.ChunkChannel = make(chan Frame, mustDeliverBuffer)
+	sub.MustDeliver = true
+
+	return sub
+}
+
+// drain releases the frames left buffered for a subscriber that is no
+// longer subscribed.
+func (s *Subscriber) drain() {
+	for {
+		select {
+		case frame, ok := <-s.ChunkChannel:
+			if !ok {
+				return
+			}
+			memoryRelease(len(frame.Data))
+		default:
+			return
+		}
+	}
+}
+
+func NewPubSub(id string, chunker *Chunker, conf configSource) *PubSub {
 	pubSub := new(PubSub)
 
 	pubSub.id = id
 	pubSub.chunker = chunker
+	pubSub.createdAt = time.Now()
 	pubSub.subChan = make(chan *Subscriber)
 	pubSub.unsubChan = make(chan *Subscriber)
+	pubSub.connectChan = make(chan error)
+	pubSub.statusChan = make(chan chan StreamStatus)
+	pubSub.recentChan = make(chan chan [][]byte)
+	pubSub.latestChan = make(chan chan latestFrame)
+	pubSub.resetChan = make(chan chan StreamStatus)
+	pubSub.subscribersChan = make(chan chan []SubscriberInfo)
+	pubSub.reconnectChan = make(chan struct{})
+	pubSub.pauseChan = make(chan bool)
+	pubSub.kickChan = make(chan kickRequest)
 	pubSub.subscribers = make(map[*Subscriber]struct{})
 	pubSub.stopTimer = time.NewTimer(0)
-	pubSub.streamDurationSeconds = streamDuration
+	pubSub.connectTimer = time.NewTimer(0)
+	pubSub.connectDelay = time.Duration(conf.ConnectDelaySeconds * float64(time.Second))
+	pubSub.streamDurationSeconds = conf.DurationSeconds
+	pubSub.idleTimeout = time.Duration(conf.IdleTimeoutSeconds * float64(time.Second))
+	pubSub.staleInterval = time.Duration(conf.StaleIntervalSeconds * float64(time.Second))
+	if pubSub.staleInterval > 0 {
+		pubSub.staleTimer = time.NewTimer(pubSub.staleInterval)
+	}
+	pubSub.grayQuery = conf.GrayQuery
+	pubSub.maxFrameAge = time.Duration(conf.MaxFrameAgeSeconds * float64(time.Second))
+	pubSub.joinWindow = time.Duration(conf.JoinWindowSeconds * float64(time.Second))
+	if pubSub.joinWindow > 0 {
+		pubSub.joinTimer = time.NewTimer(pubSub.joinWindow)
+		pubSub.joinTimer.Stop()
+	}
+	pubSub.endBehavior = conf.EndBehavior
+	pubSub.reportDrops = conf.ReportDrops
+	pubSub.freezeOnEnd = conf.FreezeOnEnd
+	pubSub.users = conf.Users
+	pubSub.realm = conf.Realm
+	if pubSub.realm == "" {
+		pubSub.realm = defaultRealm
+	}
+	pubSub.eager = conf.Eager
+	if sheet := conf.ContactSheet; sheet != nil && sheet.Path != "" {
+		grid := sheet.normalized()
+		pubSub.recentSize = grid.Columns * grid.Rows
+		pubSub.recentInterval = time.Duration(grid.IntervalSeconds * float64(time.Second))
+	}
+	pubSub.forwardQuery = conf.ForwardQuery
+	pubSub.defaultInterval = fpsInterval(conf.DefaultFPS)
+	pubSub.minInterval = fpsInterval(conf.MaxFPS)
+	pubSub.maxSubscribers = conf.MaxSubscribers
+	pubSub.queueLength = conf.QueueLength
+	pubSub.queueTimeout = time.Duration(conf.QueueTimeoutSeconds * float64(time.Second))
+	if pubSub.queueTimeout <= 0 {
+		pubSub.queueTimeout = defaultQueueTimeout
+	}
+	pubSub.boundary = conf.Boundary
+	pubSub.preamble = conf.Preamble
+	if pubSub.preamble != "" && !strings.HasSuffix(pubSub.preamble, "\n") {
+		pubSub.preamble += "\r\n" // the first boundary starts a line
+	}
+	pubSub.preamblePart = conf.PreamblePart
+	pubSub.contentType = conf.ContentType
+	if pubSub.contentType == "" {
+		pubSub.contentType = defaultContentType
+	}
+	pubSub.frameSize = frameSizeHistogram.WithLabelValues(id)
+	pubSub.disconnects = make(map[string]*uint64)
+	for _, reason := range disconnectReasons {
+		pubSub.disconnects[reason] = new(uint64)
+	}
 	<-pubSub.stopTimer.C
+	<-pubSub.connectTimer.C
 
 	return pubSub
 }
 
+// SetCallbacks registers lifecycle callbacks, it must be called before Start.
+func (pubSub *PubSub) SetCallbacks(callbacks StreamCallbacks) {
+	pubSub.callbacks = callbacks
+}
+
 func (pubSub *PubSub) Start() {
 	go pubSub.loop()
 }
 
+// Subscribe requests a subscription, the result is delivered on the
+// admitted channel of the subscriber once a slot is available. It must
+// be followed by Unsubscribe even if the subscription was not admitted.
 func (pubSub *PubSub) Subscribe(s *Subscriber) {
 	pubSub.subChan <- s
 }
@@ -81,56 +452,513 @@ func (pubSub *PubSub) Unsubscribe(s *Subscriber) {
 	pubSub.unsubChan <- s
 }
 
+// follow passes the frames of the stream to handle through an internal
+// subscriber until stop is closed or handle returns false. When the stream
+// fails it subscribes again after retry, or returns with no retry given.
+func (pubSub *PubSub) follow(name string, mustDeliver bool, retry time.Duration,
+	stop <-chan struct{}, handle func(Frame) bool) {
+	for {
+		sub := NewSubscriber(name)
+		if mustDeliver {
+			sub = NewMustDeliverSubscriber(name)
+		}
+		sub.internal = true
+		pubSub.Subscribe(sub)
+
+		admitted := false
+		select {
+		case admitted = <-sub.admitted:
+		case <-stop:
+		}
+
+		done := false
+	LOOP:
+		for admitted {
+			select {
+			case frame, ok := <-sub.ChunkChannel:
+				if !ok {
+					break LOOP
+				}
+				done = !handle(frame)
+				memoryRelease(len(frame.Data))
+				if done {
+					break LOOP
+				}
+			case <-stop:
+				break LOOP
+			}
+		}
+		pubSub.Unsubscribe(sub)
+		sub.drain()
+
+		if done || retry <= 0 {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// Status returns the current state of the stream.
+func (pubSub *PubSub) Status() StreamStatus {
+	reply := make(chan StreamStatus, 1)
+	pubSub.statusChan <- reply
+	return <-reply
+}
+
+// RecentFrames returns the frames kept for contact sheets, oldest first.
+func (pubSub *PubSub) RecentFrames() [][]byte {
+	reply := make(chan [][]byte, 1)
+	pubSub.recentChan <- reply
+	return <-reply
+}
+
+// ResetCounters sets the cumulative counters of the stream to zero and
+// returns the state from just before the reset.
+func (pubSub *PubSub) ResetCounters() StreamStatus {
+	reply := make(chan StreamStatus, 1)
+	pubSub.resetChan <- reply
+	return <-reply
+}
+
+// Subscribers lists the admitted subscribers of the stream.
+func (pubSub *PubSub) Subscribers() []SubscriberInfo {
+	reply := make(chan []SubscriberInfo, 1)
+	pubSub.subscribersChan <- reply
+	return <-reply
+}
+
+// Reconnect drops the source connection, connecting again right away if
+// the stream has subscribers.
+func (pubSub *PubSub) Reconnect() {
+	pubSub.reconnectChan <- struct{}{}
+}
+
+// SetPaused disconnects the source until the stream is resumed, keeping
+// the subscribers.
+func (pubSub *PubSub) SetPaused(paused bool) {
+	pubSub.pauseChan <- paused
+}
+
+// Kick ends the response of a subscriber, reporting whether it was found.
+func (pubSub *PubSub) Kick(id uint64) bool {
+	reply := make(chan bool, 1)
+	pubSub.kickChan <- kickRequest{id, reply}
+	return <-reply
+}
+
 func (pubSub *PubSub) loop() {
 	for {
+		var staleC <-chan time.Time
+		if pubSub.staleTimer != nil {
+			staleC = pubSub.staleTimer.C
+		}
+		var joinC <-chan time.Time
+		if pubSub.joinTimer != nil {
+			joinC = pubSub.joinTimer.C
+		}
+		var freezeC <-chan time.Time
+		if pubSub.freezeTicker != nil {
+			freezeC = pubSub.freezeTicker.C
+		}
+
 		select {
-		case data, ok := <-pubSub.pubChan:
+		case frame, ok := <-pubSub.pubChan:
 			if ok {
-				pubSub.doPublish(data)
+				pubSub.doPublish(frame)
 			} else {
-				pubSub.stopChunker()
-				pubSub.stopSubscribers()
+				err := <-pubSub.doneChan
+				if err != nil {
+					pubSub.callbacks.failed(pubSub.id, err)
+				}
+				pubSub.stopChunker(err)
+				if err == nil && pubSub.freezeOnEnd &&
+					pubSub.lastFrame.Data != nil && len(pubSub.subscribers) > 0 {
+					pubSub.freeze()
+				} else {
+					pubSub.stopSubscribers()
+				}
 			}
 
+		case <-freezeC:
+			// the repeated frame is current on purpose, so it is not
+			// skipped for its age
+			pubSub.deliver(Frame{Data: pubSub.lastFrame.Data, Captured: time.Now()})
+			if time.Since(pubSub.frozenAt) >= freezeRetryInterval {
+				pubSub.frozenAt = time.Now()
+				pubSub.startChunker()
+			}
+
+		case err := <-pubSub.connectChan:
+			pubSub.connected(err)
+
+		case <-staleC:
+			pubSub.staleTimer.Reset(pubSub.staleInterval)
+			pubSub.stale()
+
+		case <-joinC:
+			pubSub.joined()
+
 		case sub := <-pubSub.subChan:
 			pubSub.doSubscribe(sub)
 
 		case sub := <-pubSub.unsubChan:
 			pubSub.doUnsubscribe(sub)
 
+		case reply := <-pubSub.statusChan:
+			reply <- pubSub.doStatus()
+
+		case reply := <-pubSub.recentChan:
+			reply <- append([][]byte(nil), pubSub.recent...)
+
+		case reply := <-pubSub.latestChan:
+			reply <- latestFrame{pubSub.lastFrame, pubSub.framesPublished}
+
+		case reply := <-pubSub.resetChan:
+			reply <- pubSub.doStatus()
+			pubSub.doReset()
+
+		case reply := <-pubSub.subscribersChan:
+			reply <- pubSub.subscriberList()
+
+		case <-pubSub.reconnectChan:
+			pubSub.reconnect()
+
+		case paused := <-pubSub.pauseChan:
+			pubSub.setPaused(paused)
+
+		case req := <-pubSub.kickChan:
+			req.reply <- pubSub.kick(req.id)
+
 		case <-pubSub.stopTimer.C:
 			if len(pubSub.subscribers) == 0 {
-				pubSub.stopChunker()
+				pubSub.stopChunker(nil)
+				pubSub.lastFrame = Frame{}
+				pubSub.clearRecent()
+			}
+
+		case <-pubSub.connectTimer.C:
+			pubSub.connectPending = false
+			if len(pubSub.subscribers) == 0 {
+				logf("pubsub[%s]: subscribers left before connecting\n", pubSub.id)
+			} else if pubSub.pubChan == nil && !pubSub.paused {
+				pubSub.connect()
 			}
 		}
 	}
 }
 
-func (pubSub *PubSub) doPublish(data []byte) {
+func (pubSub *PubSub) doStatus() StreamStatus {
+	status := StreamStatus{
+		Subscribers:     len(pubSub.subscribers),
+		Queued:          len(pubSub.queue),
+		Connected:       pubSub.pubChan != nil,
+		Paused:          pubSub.paused,
+		Frozen:          pubSub.freezeTicker != nil,
+		Stalled:         pubSub.stalled,
+		FramesPublished: pubSub.framesPublished,
+		BytesPublished:  pubSub.bytesPublished,
+		FramesDropped:   pubSub.framesDropped,
+		Disconnects:     make(map[string]uint64),
+		Created:         pubSub.createdAt,
+		LastConnect:     pubSub.connectedAt,
+		LastFrame:       pubSub.lastFrameAt,
+		LastSubscriber:  pubSub.lastSubscriberAt,
+	}
+	if len(pubSub.subscribers) > 0 {
+		status.LastSubscriber = time.Now()
+	}
+	for reason, count := range pubSub.disconnects {
+		status.Disconnects[reason] = atomic.LoadUint64(count)
+	}
+	for s := range pubSub.subscribers {
+		if s.internal {
+			status.Internal++
+		}
+	}
+	if len(pubSub.upstream) > 0 {
+		status.Upstream = make(map[string]string)
+		for key, value := range pubSub.upstream {
+			status.Upstream[key] = value
+		}
+	}
+	if status.Connected {
+		status.Uptime = time.Since(pubSub.connectedAt).Seconds()
+		now := time.Now()
+		status.FPS = pubSub.frameRate.value(now)
+		status.EgressRate = pubSub.egressRate.value(now)
+		delivered := pubSub.deliveryRate.value(now)
+		dropped := pubSub.dropRate.value(now)
+		if delivered+dropped > 0 {
+			status.DropRatio = dropped / (delivered + dropped)
+		}
+	}
+
+	return status
+}
+
+func (pubSub *PubSub) doReset() {
+	pubSub.framesPublished = 0
+	pubSub.bytesPublished = 0
+	pubSub.framesDropped = 0
+	for _, count := range pubSub.disconnects {
+		atomic.StoreUint64(count, 0)
+	}
+}
+
+// countDisconnect is called from the client handlers, so the counters are
+// only updated atomically.
+func (pubSub *PubSub) countDisconnect(reason string) {
+	atomic.AddUint64(pubSub.disconnects[reason], 1)
+	disconnectCounter.WithLabelValues(pubSub.id, reason).Inc()
+}
+
+func (pubSub *PubSub) doPublish(frame Frame) {
+	data := frame.Data
+	pubSub.frameSize.Observe(float64(len(data)))
+	pubSub.framesPublished++
+	pubSub.bytesPublished += uint64(len(data))
+	pubSub.frameRate.add(1, time.Now())
+	pubSub.lastFrame = frame
+	pubSub.lastFrameAt = frame.Captured
+	pubSub.joining = nil // they get the new frame
+	if pubSub.staleTimer != nil {
+		pubSub.staleTimer.Reset(pubSub.staleInterval)
+		if pubSub.stalled {
+			logf("pubsub[%s]: frames resumed\n", pubSub.id)
+			pubSub.stalled = false
+		}
+	}
+	if pubSub.recentSize > 0 && time.Since(pubSub.recentAt) >= pubSub.recentInterval &&
+		!memoryExceeded() {
+		memoryAcquire(len(data))
+		pubSub.recent = append(pubSub.recent, data)
+		if len(pubSub.recent) > pubSub.recentSize {
+			memoryRelease(len(pubSub.recent[0]))
+			pubSub.recent = pubSub.recent[1:]
+		}
+		pubSub.recentAt = time.Now()
+	}
+	pubSub.deliver(frame)
+}
+
+// stale repeats the last frame marked as stale to the clients once the
+// source sent no frames for the stale interval, until frames resume.
+func (pubSub *PubSub) stale() {
+	if pubSub.lastFrame.Data == nil || pubSub.freezeTicker != nil {
+		return
+	}
+	if !pubSub.stalled {
+		logf("pubsub[%s]: no frames for %s, repeating the last one as stale\n",
+			pubSub.id, pubSub.staleInterval)
+		pubSub.stalled = true
+	}
+	// repeated frames are current on purpose, like frozen ones
+	pubSub.deliver(Frame{Data: pubSub.lastFrame.Data, Captured: time.Now(), Stale: true})
+}
+
+// joined sends the last frame to the subscribers that joined within the
+// window and got no frame since, skipping those not waiting for it.
+func (pubSub *PubSub) joined() {
+	frame := pubSub.lastFrame
+	for _, s := range pubSub.joining {
+		if _, ok := pubSub.subscribers[s]; !ok || frame.Data == nil {
+			continue
+		}
+
+		memoryAcquire(len(frame.Data))
+		select {
+		case s.ChunkChannel <- frame:
+		default:
+			memoryRelease(len(frame.Data))
+		}
+	}
+	pubSub.joining = nil
+}
+
+// clearRecent drops the frames kept for contact sheets.
+func (pubSub *PubSub) clearRecent() {
+	for _, data := range pubSub.recent {
+		memoryRelease(len(data))
+	}
+	pubSub.recent = nil
+}
+
+// deliver sends a frame to all subscribers, dropping it for those not
+// keeping up.
+func (pubSub *PubSub) deliver(frame Frame) {
+	data := frame.Data
+	now := time.Now()
+	delivered, dropped := 0, 0
+	defer func() {
+		pubSub.egressRate.add(float64(delivered*len(data)), now)
+		pubSub.deliveryRate.add(float64(delivered), now)
+		pubSub.dropRate.add(float64(dropped), now)
+	}()
+
+	// must-deliver subscribers go first, their buffered channel lets them
+	// keep every frame unless they fall a whole buffer behind
+	for s := range pubSub.subscribers {
+		if !s.MustDeliver || frame.Stale && s.internal {
+			continue
+		}
+
+		memoryAcquire(len(data))
+		select {
+		case s.ChunkChannel <- frame:
+			delivered++
+			continue
+		default:
+		}
+
+		memoryRelease(len(data))
+		atomic.AddUint64(&s.dropped, 1)
+		pubSub.framesDropped++
+		dropped++
+		logf("pubsub[%s]: subscriber %s too slow, frame dropped\n",
+			pubSub.id, s.RemoteAddr)
+	}
+
+	// shed load by dropping the frame, it counts as dropped like one for
+	// a busy subscriber
+	shed := memoryExceeded()
+
 	for s := range pubSub.subscribers {
+		if s.MustDeliver || frame.Stale && s.internal {
+			continue
+		}
+		if shed {
+			atomic.AddUint64(&s.dropped, 1)
+			pubSub.framesDropped++
+			dropped++
+			continue
+		}
+		memoryAcquire(len(data))
 		select {
-		case s.ChunkChannel <- data: // try to send
+		case s.ChunkChannel <- frame: // try to send
+			delivered++
 		default: // or skip this frame
+			memoryRelease(len(data))
+			atomic.AddUint64(&s.dropped, 1)
+			pubSub.framesDropped++
+			dropped++
+			debugf(pubSub.id, "pubsub[%s]: subscriber %s busy, frame dropped\n",
+				pubSub.id, s.RemoteAddr)
 		}
 	}
 }
 
 func (pubSub *PubSub) doSubscribe(s *Subscriber) {
+	if maxSubscribersPerIP > 0 && !s.internal {
+		pubSub.checkAddress(s.RemoteAddr)
+	}
+
+	if pubSub.maxSubscribers > 0 && len(pubSub.subscribers) >= pubSub.maxSubscribers {
+		if len(pubSub.queue) < pubSub.queueLength {
+			pubSub.queue = append(pubSub.queue, s)
+			logf("pubsub[%s]: queued subscriber %s (queued=%d)\n",
+				pubSub.id, s.RemoteAddr, len(pubSub.queue))
+		} else {
+			logf("pubsub[%s]: rejected subscriber %s (total=%d)\n",
+				pubSub.id, s.RemoteAddr, len(pubSub.subscribers))
+			s.admitted <- false
+		}
+		return
+	}
+
+	pubSub.admit(s)
+}
+
+// checkAddress warns once a client holds an implausible number of
+// subscriptions, which usually means they are not unsubscribed.
+func (pubSub *PubSub) checkAddress(addr string) {
+	host := addressHost(addr)
+	count := pubSub.subscriptions(host) + 1 // the new subscriber
+	if count == maxSubscribersPerIP+1 {
+		logf("pubsub[%s]: client %s holds %d subscriptions, possible leak\n",
+			pubSub.id, host, count)
+	}
+}
+
+// subscriptions counts the admitted and queued subscribers of a host.
+func (pubSub *PubSub) subscriptions(host string) int {
+	count := 0
+	for s := range pubSub.subscribers {
+		if addressHost(s.RemoteAddr) == host {
+			count++
+		}
+	}
+	for _, s := range pubSub.queue {
+		if addressHost(s.RemoteAddr) == host {
+			count++
+		}
+	}
+	return count
+}
+
+// addressHost strips the port from client addresses that have one.
+func addressHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admit adds a subscriber to the stream, it waits for the next published
+// frame. With a join window the last frame is sent instead, once for all
+// subscribers joining within the window, so a page loading many streams
+// at once does not cause a send of the frame per subscribe.
+func (pubSub *PubSub) admit(s *Subscriber) {
 	pubSub.subscribers[s] = struct{}{}
+	s.since = time.Now()
+	s.admitted <- true
+
+	if pubSub.joinTimer != nil && pubSub.lastFrame.Data != nil {
+		pubSub.joining = append(pubSub.joining, s)
+		if len(pubSub.joining) == 1 {
+			pubSub.joinTimer.Reset(pubSub.joinWindow)
+		}
+	}
 
-	fmt.Printf("pubsub[%s]: added subscriber %s (total=%d)\n",
+	logf("pubsub[%s]: added subscriber %s (total=%d)\n",
 		pubSub.id, s.RemoteAddr, len(pubSub.subscribers))
 
-	if pubSub.pubChan == nil {
-		if err := pubSub.startChunker(); err != nil {
-			fmt.Printf("pubsub[%s]: failed to start chunker: %s\n",
-				pubSub.id, err)
-			pubSub.stopSubscribers()
+	if len(pubSub.subscribers) == 1 {
+		pubSub.callbacks.firstSubscriber(pubSub.id)
+	}
+
+	if pubSub.pubChan == nil && pubSub.freezeTicker == nil && !pubSub.connecting && !pubSub.paused {
+		// the client starting the connection picks the forwarded
+		// parameters, later clients share the stream as it is
+		if len(pubSub.forwardQuery) > 0 {
+			pubSub.chunker.SetForwardedQuery(s.query)
 		}
+
+		// wait for short lived clients to leave before connecting
+		if pubSub.connectDelay > 0 {
+			if !pubSub.connectPending {
+				pubSub.connectPending = true
+				pubSub.connectTimer.Reset(pubSub.connectDelay)
+			}
+			return
+		}
+		pubSub.connect()
 	}
 }
 
+func (pubSub *PubSub) connect() {
+	pubSub.startChunker()
+}
+
 func (pubSub *PubSub) stopSubscribers() {
+	for _, s := range pubSub.queue {
+		s.admitted <- false
+	}
+	pubSub.queue = nil
+
 	for s := range pubSub.subscribers {
 		close(s.ChunkChannel)
 		pubSub.doUnsubscribe(s)
@@ -138,16 +966,33 @@ func (pubSub *PubSub) stopSubscribers() {
 }
 
 func (pubSub *PubSub) doUnsubscribe(s *Subscriber) {
+	for i, queued := range pubSub.queue {
+		if queued == s { // gave up waiting
+			pubSub.queue = append(pubSub.queue[:i], pubSub.queue[i+1:]...)
+			return
+		}
+	}
+
 	if _, exists := pubSub.subscribers[s]; !exists {
 		return // already unsubscribed if chunker failed
 	}
 
 	delete(pubSub.subscribers, s)
+	pubSub.lastSubscriberAt = time.Now()
 
-	fmt.Printf("pubsub[%s]: removed subscriber %s (total=%d)\n",
+	logf("pubsub[%s]: removed subscriber %s (total=%d)\n",
 		pubSub.id, s.RemoteAddr, len(pubSub.subscribers))
 
+	if len(pubSub.queue) > 0 {
+		next := pubSub.queue[0]
+		pubSub.queue = pubSub.queue[1:]
+		pubSub.admit(next)
+		return
+	}
+
 	if len(pubSub.subscribers) == 0 {
+		pubSub.callbacks.lastSubscriber(pubSub.id)
+
 		if !pubSub.stopTimer.Stop() {
 			select {
 			case <-pubSub.stopTimer.C:
@@ -158,28 +1003,189 @@ func (pubSub *PubSub) doUnsubscribe(s *Subscriber) {
 	}
 }
 
-func (pubSub *PubSub) startChunker() error {
-	if pubSub.chunker.Started() {
-		return nil
+// startChunker connects to the source in the background, so the loop
+// keeps serving status requests while an unreachable source is retried.
+// The result is handled by connected.
+func (pubSub *PubSub) startChunker() {
+	if pubSub.connecting || pubSub.chunker.Started() {
+		return
 	}
 
-	err := pubSub.chunker.Connect()
+	pubSub.connecting = true
+	go func() {
+		pubSub.connectChan <- pubSub.chunker.Connect()
+	}()
+}
+
+func (pubSub *PubSub) connected(err error) {
+	pubSub.connecting = false
 	if err != nil {
-		return err
+		if pubSub.freezeTicker != nil {
+			logf("pubsub[%s]: source still unavailable: %s\n",
+				pubSub.id, err)
+			return
+		}
+		logf("pubsub[%s]: failed to start chunker: %s\n",
+			pubSub.id, err)
+		pubSub.callbacks.failed(pubSub.id, err)
+		pubSub.stopSubscribers()
+		return
 	}
 
-	pubSub.pubChan = make(chan []byte)
-	go pubSub.chunker.Start(pubSub.pubChan)
+	pubSub.pubChan = make(chan Frame)
+	pubSub.connectedAt = time.Now()
+	pubSub.upstream = upstreamIdentity(pubSub.chunker.GetHeader())
+	if len(pubSub.upstream) > 0 {
+		logf("pubsub[%s]: upstream %v\n", pubSub.id, pubSub.upstream)
+	}
+	pubSub.frameRate.reset()
+	pubSub.egressRate.reset()
+	pubSub.deliveryRate.reset()
+	pubSub.dropRate.reset()
+	pubSub.doneChan = pubSub.chunker.Start(pubSub.pubChan)
+	pubSub.callbacks.connect(pubSub.id)
+	pubSub.unfreeze()
+
+	if pubSub.paused { // paused while connecting
+		pubSub.stopChunker(nil)
+		return
+	}
 
-	return nil
+	// the subscribers may have left while connecting
+	if len(pubSub.subscribers) == 0 {
+		pubSub.stopTimer.Reset(stopDelay)
+	}
 }
 
-func (pubSub *PubSub) stopChunker() {
+func (pubSub *PubSub) stopChunker(err error) {
 	if pubSub.pubChan != nil {
 		pubSub.chunker.Stop()
+		pubSub.callbacks.disconnect(pubSub.id, err)
 	}
 
 	pubSub.pubChan = nil
+	pubSub.doneChan = nil
+	pubSub.unfreeze()
+}
+
+// reconnect drops the source connection like a failure would, but keeps
+// the subscribers for the new connection.
+func (pubSub *PubSub) reconnect() {
+	logf("pubsub[%s]: reconnecting\n", pubSub.id)
+	pubSub.stopChunker(nil)
+	if len(pubSub.subscribers) > 0 && !pubSub.paused {
+		pubSub.connect()
+	}
+}
+
+// setPaused disconnects the source while the stream is paused, the
+// subscribers stay and get frames again once it is resumed.
+func (pubSub *PubSub) setPaused(paused bool) {
+	if paused == pubSub.paused {
+		return
+	}
+	pubSub.paused = paused
+
+	if paused {
+		logf("pubsub[%s]: paused\n", pubSub.id)
+		pubSub.stopChunker(nil)
+		return
+	}
+	logf("pubsub[%s]: resumed\n", pubSub.id)
+	if len(pubSub.subscribers) > 0 {
+		pubSub.connect()
+	}
+}
+
+// kick removes a subscriber the way a failed source does, so its handler
+// ends the response. Subscribers of the proxy itself cannot be kicked.
+func (pubSub *PubSub) kick(id uint64) bool {
+	for s := range pubSub.subscribers {
+		if s.id != id || s.internal {
+			continue
+		}
+
+		logf("pubsub[%s]: kicking subscriber %s\n", pubSub.id, s.RemoteAddr)
+		atomic.StoreInt32(&s.kicked, 1)
+		close(s.ChunkChannel)
+		pubSub.doUnsubscribe(s)
+		return true
+	}
+	return false
+}
+
+func (pubSub *PubSub) subscriberList() []SubscriberInfo {
+	list := make([]SubscriberInfo, 0, len(pubSub.subscribers))
+	for s := range pubSub.subscribers {
+		list = append(list, SubscriberInfo{
+			ID:       s.id,
+			Address:  s.RemoteAddr,
+			Path:     s.path,
+			Internal: s.internal,
+			Since:    s.since,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// freeze keeps the subscribers of a source that ended cleanly, repeating
+// the last frame until the source can be connected again.
+func (pubSub *PubSub) freeze() {
+	logf("pubsub[%s]: source ended, freezing on the last frame\n", pubSub.id)
+	pubSub.freezeTicker = time.NewTicker(freezeInterval)
+	pubSub.frozenAt = time.Now()
+}
+
+func (pubSub *PubSub) unfreeze() {
+	if pubSub.freezeTicker != nil {
+		pubSub.freezeTicker.Stop()
+		pubSub.freezeTicker = nil
+	}
+}
+
+// forwardedQuery returns the allowed client query parameters to pass on
+// to the source.
+func (pubSub *PubSub) forwardedQuery(r *http.Request) url.Values {
+	query := make(url.Values)
+	for _, key := range pubSub.forwardQuery {
+		if values, ok := r.URL.Query()[key]; ok {
+			query[key] = values
+		}
+	}
+	return query
+}
+
+// Minimum time between warnings about frames containing the boundary.
+const boundaryWarningInterval = time.Minute
+
+// boundaryCollision warns that a frame contains the fixed boundary, which
+// can confuse clients splitting the stream on the boundary alone.
+func (pubSub *PubSub) boundaryCollision() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&pubSub.boundaryWarning)
+	if now-last < int64(boundaryWarningInterval) ||
+		!atomic.CompareAndSwapInt64(&pubSub.boundaryWarning, last, now) {
+		return
+	}
+
+	logf("server[%s]: frame contains the boundary %q, clients ignoring Content-Length may break\n",
+		pubSub.id, pubSub.boundary)
+}
+
+// Response headers of the source that tell its vendor or firmware.
+var identityHeaders = []string{"Server", "X-Powered-By"}
+
+// upstreamIdentity collects the identifying headers of the source, they
+// are kept after disconnecting until the next connect replaces them.
+func upstreamIdentity(header http.Header) map[string]string {
+	identity := make(map[string]string)
+	for _, key := range identityHeaders {
+		if value := header.Get(key); value != "" {
+			identity[key] = value
+		}
+	}
+	return identity
 }
 
 func clientAddress(r *http.Request) string {
@@ -196,53 +1202,302 @@ func clientAddress(r *http.Request) string {
 	return client
 }
 
-func parseSendInterval(fps string) time.Duration {
+// parseSendInterval converts the frame rate requested by a client to the
+// interval between frames, at most maxSendInterval. An explicit 0 means no
+// limit, a missing or unparsable value is not ok so the default of the
+// stream applies instead. Negative and NaN rates are rejected. The lower
+// limits apply to every client, so they are left to the caller.
+func parseSendInterval(fps string) (time.Duration, bool, error) {
 	f, err := strconv.ParseFloat(fps, 64)
-	if err != nil {
+	if err != nil && !math.IsInf(f, 0) {
+		return 0, false, nil
+	}
+	if math.IsNaN(f) || f < 0 {
+		return 0, false, fmt.Errorf("invalid fps: %s", fps)
+	}
+	if f == 0 || math.IsInf(f, 1) {
+		return 0, true, nil
+	}
+
+	interval := time.Duration(float64(time.Second) / f)
+	if maxSendInterval > 0 && interval > maxSendInterval {
+		interval = maxSendInterval
+	}
+	return interval, true, nil
+}
+
+// frameSlot numbers the intervals since the epoch, a frame is sent to a
+// rate limited client if it is the first one in its interval.
+func frameSlot(captured time.Time, interval time.Duration) int64 {
+	if interval <= 0 {
 		return 0
 	}
+	return captured.UnixNano() / int64(interval)
+}
 
-	return time.Duration(1000.0/f) * time.Millisecond
+// sendInterval returns the interval between frames for a client asking
+// for the frame rate. The global, stream and handler limits apply to every
+// client, also to those not asking for a rate or asking for no limit.
+func (pubSub *PubSub) sendInterval(fps string, opts outputOptions) (time.Duration, error) {
+	interval, ok, err := parseSendInterval(fps)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		interval = pubSub.defaultInterval
+	}
+
+	for _, minInterval := range []time.Duration{minSendInterval, pubSub.minInterval, fpsInterval(opts.rate)} {
+		if interval < minInterval {
+			interval = minInterval
+		}
+	}
+	return interval, nil
+}
+
+// fpsInterval returns the interval between frames for a frame rate,
+// 0 if the rate is not limited.
+func fpsInterval(fps float64) time.Duration {
+	if fps <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / fps)
 }
 
 func (pubSub *PubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pubSub.serveStream(w, r, outputOptions{})
+}
+
+// handler serves the stream with additional output options applied.
+func (pubSub *PubSub) handler(opts outputOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pubSub.serveStream(w, r, opts)
+	})
+}
+
+func (pubSub *PubSub) serveStream(w http.ResponseWriter, r *http.Request, opts outputOptions) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
-		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		pubSub.httpError(w, r, errorMethod, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
 
-	// allow client to lower the frame rate
+	// allow client to lower the frame rate, probes only get the headers
+	// so they may send any query
+	probe := r.Method == http.MethodHead
 	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, "Invalid query", http.StatusBadRequest)
+	if err != nil && !probe {
+		http.Error(w, fmt.Sprintf("Invalid query: %s", err), http.StatusBadRequest)
 		return
 	}
-	sendInterval := parseSendInterval(r.FormValue("fps"))
+	sendInterval, err := pubSub.sendInterval(r.FormValue("fps"), opts)
+	if err != nil && !probe {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// grayscale frames are made once per stream and shared by the clients
+	// asking for them, still it costs CPU so it has to be enabled
+	if pubSub.grayQuery && r.FormValue("gray") == "1" {
+		opts.gray = true
+	}
 
 	// prepare response for flushing
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		fmt.Printf("server[%s]: client %s could not be flushed\n",
+		logf("server[%s]: client %s could not be flushed\n",
 			pubSub.id, r.RemoteAddr)
 		return
 	}
 
+	if memoryExceeded() {
+		logf("server[%s]: memory limit reached, rejecting client %s\n",
+			pubSub.id, clientAddress(r))
+		http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	if user := requestUser(r); user != "" {
+		logf("server[%s]: client %s authenticated as %s\n",
+			pubSub.id, clientAddress(r), user)
+	}
+	release, ok := pubSub.limitUser(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// subscribe to new chunks
 	sub := NewSubscriber(clientAddress(r))
+	sub.query = pubSub.forwardedQuery(r)
+	sub.path = r.Pattern
 	pubSub.Subscribe(sub)
 	defer pubSub.Unsubscribe(sub)
+	setupDone(r)
+
+	// wait in the queue if the stream is full
+	queueTimer := time.NewTimer(pubSub.queueTimeout)
+	select {
+	case ok := <-sub.admitted:
+		queueTimer.Stop()
+		if !ok {
+			http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+			return
+		}
+	case <-queueTimer.C:
+		logf("server[%s]: client %s queue timeout\n", pubSub.id, sub.RemoteAddr)
+		http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		queueTimer.Stop()
+		return
+	}
+
+	// count why the client left once it was admitted
+	reason := disconnectClient
+	defer func() {
+		pubSub.countDisconnect(reason)
+	}()
+
+	viewers, viewerBytes := pubSub.viewerMetrics(sub)
+	viewers.Inc()
+	defer viewers.Dec()
+
+	// clients not needing low latency can batch frames into fewer
+	// flushes, a batch is always flushed within maxBatchDelay
+	batchFrames, _ := strconv.Atoi(r.FormValue("batch"))
+	if batchFrames > maxBatchFrames {
+		batchFrames = maxBatchFrames
+	}
+	batchDelay := maxBatchDelay
+	ms, err := strconv.Atoi(r.FormValue("batchms"))
+	if err != nil || ms <= 0 {
+		ms = 0
+	} else if delay := time.Duration(ms) * time.Millisecond; delay < batchDelay {
+		batchDelay = delay
+	}
+	batching := (batchFrames > 1 || ms > 0) && batchDelay > 0
 
-	mw := multipart.NewWriter(w)
-	contentType := fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mw.Boundary())
+	// optionally buffer writes so each frame is sent with fewer syscalls
+	bufferSize := writeBufferSize
+	if batching && bufferSize < batchBufferSize {
+		bufferSize = batchBufferSize
+	}
+	var out io.Writer = w
+	var bw *bufio.Writer
+	if bufferSize > 0 {
+		bw = bufio.NewWriterSize(w, bufferSize)
+		out = bw
+		memoryAcquire(bufferSize)
+		defer memoryRelease(bufferSize)
+	}
+
+	// the random boundary of the writer is 60 hex digits, too long to
+	// turn up in frame data by chance, only fixed ones need checking
+	mw := multipart.NewWriter(out)
+	if pubSub.boundary != "" {
+		mw.SetBoundary(pubSub.boundary)
+	}
+	delimiter := []byte("--" + mw.Boundary())
+	contentType := strings.Replace(pubSub.contentType, boundaryPlaceholder, mw.Boundary(), -1)
 
 	mimeHeader := make(textproto.MIMEHeader)
 	mimeHeader.Set("Content-Type", "image/jpeg")
 
+	headersSent := false
+	sendHeaders := func() {
+		header := w.Header()
+		header.Add("Content-Type", contentType)
+		if pubSub.endBehavior == endTrailer {
+			header.Set("Trailer", "X-Stream-End")
+		}
+		w.WriteHeader(http.StatusOK)
+		headersSent = true
+
+		// some legacy clients need something before the first frame,
+		// compliant ones skip the preamble and the empty part
+		if pubSub.preamble != "" {
+			io.WriteString(out, pubSub.preamble)
+		}
+		if pubSub.preamblePart != "" {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Type", pubSub.preamblePart)
+			header.Set("Content-Length", "0")
+			mw.CreatePart(header)
+		}
+	}
+
+	var batchTimer *time.Timer
+	var batchTimeout <-chan time.Time
+	var pending int
+	if batching {
+		batchTimer = time.NewTimer(batchDelay)
+		batchTimer.Stop()
+		defer batchTimer.Stop()
+		batchTimeout = batchTimer.C
+	}
+
+	flush := func() error {
+		pending = 0
+		if batchTimer != nil {
+			batchTimer.Stop()
+		}
+
+		if bw != nil {
+			err := bw.Flush()
+			if err != nil {
+				return fmt.Errorf("buffer flush failed: %s", err)
+			}
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	writePart := func(header textproto.MIMEHeader, data []byte) error {
+		header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return fmt.Errorf("part create failed: %s", err)
+		}
+
+		_, err = part.Write(data)
+		if err != nil {
+			return fmt.Errorf("part write failed: %s", err)
+		}
+
+		pending++
+		if batching {
+			if batchFrames > 1 && pending >= batchFrames {
+				return flush()
+			}
+			if pending == 1 {
+				batchTimer.Reset(batchDelay)
+			}
+			return nil
+		}
+
+		return flush()
+	}
+
+	// optionally interleave JSON status parts with the images
+	var statusTimeout <-chan time.Time
+	var statusFrames uint64
+	var statusTime time.Time
+	if r.FormValue("status") == "1" && statusInterval > 0 {
+		statusTicker := time.NewTicker(statusInterval)
+		defer statusTicker.Stop()
+		statusTimeout = statusTicker.C
+		statusFrames = pubSub.Status().FramesPublished
+		statusTime = time.Now()
+	}
+	statusHeader := make(textproto.MIMEHeader)
+	statusHeader.Set("Content-Type", "application/json")
+
+	var frame Frame
 	var data []byte
-	var chunkOk, headersSent bool
-	var lastSendTime time.Time
+	var chunkOk bool
+	var lastSlot int64
 	var endTime time.Time
+	var expired bool
 	if pubSub.streamDurationSeconds != 0 {
 		endTime = time.Now().Add(time.Duration(pubSub.streamDurationSeconds * float64(time.Second)))
 	} else {
@@ -250,57 +1505,199 @@ func (pubSub *PubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		endTime = time.Now().Add(time.Duration(365 * 24 * time.Hour))
 	}
 
+	// close clients that receive no frames for too long
+	var idleTimer *time.Timer
+	var idleTimeout <-chan time.Time
+	var idle bool
+	if pubSub.idleTimeout > 0 {
+		idleTimer = time.NewTimer(pubSub.idleTimeout)
+		defer idleTimer.Stop()
+		idleTimeout = idleTimer.C
+	}
+
+	// frames received from the pubsub are accounted until sent or skipped
+	var held int
+	defer func() {
+		memoryRelease(held)
+	}()
+
 LOOP:
 	for {
+		memoryRelease(held)
+		held = 0
+
 		// wait for next chunk
 		select {
-		case data, chunkOk = <-sub.ChunkChannel:
+		case frame, chunkOk = <-sub.ChunkChannel:
 			if !chunkOk {
+				reason = disconnectUpstream
+				if atomic.LoadInt32(&sub.kicked) == 1 {
+					reason = disconnectKicked
+				}
 				break LOOP
 			}
+			data = frame.Data
+			held = len(data)
+			if idleTimer != nil && !frame.Stale {
+				idleTimer.Reset(pubSub.idleTimeout)
+			}
+		case <-statusTimeout:
+			if !headersSent {
+				continue
+			}
+
+			status := pubSub.Status()
+			now := time.Now()
+			if status.FramesPublished < statusFrames {
+				statusFrames = 0 // counters were reset
+			}
+			fps := float64(status.FramesPublished-statusFrames) / now.Sub(statusTime).Seconds()
+			statusFrames, statusTime = status.FramesPublished, now
+
+			statusData, err := json.Marshal(map[string]interface{}{
+				"fps":         fps,
+				"subscribers": status.Subscribers,
+				"uptime":      status.Uptime,
+			})
+			if err == nil {
+				err = writePart(statusHeader, statusData)
+			}
+			if err != nil {
+				reason = disconnectWrite
+				logf("server[%s]: %s\n", pubSub.id, err)
+				return
+			}
+			continue
+		case <-batchTimeout:
+			if pending > 0 {
+				err = flush()
+				if err != nil {
+					reason = disconnectWrite
+					logf("server[%s]: %s\n", pubSub.id, err)
+					return
+				}
+			}
+			continue
+		case <-idleTimeout:
+			logf("server[%s]: no frames for client %s in %s, closing\n",
+				pubSub.id, sub.RemoteAddr, pubSub.idleTimeout)
+			idle = true
+			reason = disconnectIdle
+			break LOOP
 		case <-r.Context().Done():
+			if r.Context().Err() == context.DeadlineExceeded {
+				logf("server[%s]: request deadline reached for client %s\n",
+					pubSub.id, sub.RemoteAddr)
+				reason = disconnectDeadline
+			}
 			break LOOP
 		}
 
+		// frames that waited too long are skipped for fresher ones
+		if pubSub.maxFrameAge > 0 && time.Since(frame.Captured) > pubSub.maxFrameAge {
+			atomic.AddUint64(&sub.dropped, 1)
+			debugf(pubSub.id, "server[%s]: skipping frame aged %s for client %s\n",
+				pubSub.id, time.Since(frame.Captured), sub.RemoteAddr)
+			continue
+		}
+
 		if time.Now().After(endTime) {
+			expired = true
+			reason = disconnectDuration
 			break LOOP
 		}
-		// send HTTP header before first chunk
+		// frames are picked by the interval their capture time falls in,
+		// so clients of the same rate pick the same frames and share
+		// their transformation
+		slot := frameSlot(frame.Captured, sendInterval)
 		if !headersSent {
-			header := w.Header()
-			header.Add("Content-Type", contentType)
-			w.WriteHeader(http.StatusOK)
-			headersSent = true
-		} else if sendInterval > 0 && time.Now().Sub(lastSendTime) < sendInterval {
+			sendHeaders()
+			if probe {
+				return // the stream works
+			}
+		} else if sendInterval > 0 && slot <= lastSlot {
 			continue // skip this chunk
 		}
 
-		lastSendTime = time.Now()
-		mimeHeader.Set("Content-Length", fmt.Sprintf("%d", len(data)))
-		part, err := mw.CreatePart(mimeHeader)
-		if err != nil {
-			fmt.Printf("server[%s]: part create failed: %s\n", pubSub.id, err)
-			return
+		lastSlot = slot
+		data = pubSub.outputs.get(pubSub.id, opts, data)
+
+		// mark the frames repeated while the source is stalled
+		if frame.Stale {
+			mimeHeader.Set("X-Stream-Stale", "true")
+		} else {
+			mimeHeader.Del("X-Stream-Stale")
+		}
+
+		// tell the client how many frames it missed for being slow
+		if pubSub.reportDrops {
+			if dropped := atomic.SwapUint64(&sub.dropped, 0); dropped > 0 {
+				mimeHeader.Set("X-Frames-Dropped", strconv.FormatUint(dropped, 10))
+			} else {
+				mimeHeader.Del("X-Frames-Dropped")
+			}
+		}
+
+		if pubSub.boundary != "" && bytes.Contains(data, delimiter) {
+			pubSub.boundaryCollision()
 		}
 
 		// send image to client
-		_, err = part.Write(data)
+		err = writePart(mimeHeader, data)
 		if err != nil {
-			fmt.Printf("server[%s]: part write failed: %s\n", pubSub.id, err)
+			reason = disconnectWrite
+			logf("server[%s]: %s\n", pubSub.id, err)
 			return
 		}
+		viewerBytes.Add(float64(len(data)))
+	}
 
-		flusher.Flush()
+	if !headersSent {
+		switch {
+		case idle:
+			pubSub.httpError(w, r, errorStreamIdle, "Stream idle timeout", http.StatusGatewayTimeout)
+			return
+		case r.Context().Err() == context.DeadlineExceeded:
+			http.Error(w, "Request timeout", http.StatusServiceUnavailable)
+			return
+		case r.Context().Err() != nil:
+			return // client is gone
+		case !chunkOk:
+			logf("server[%s]: stream failed\n", pubSub.id)
+			pubSub.httpError(w, r, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+			return
+		}
+		sendHeaders() // stream ended before the first frame
 	}
 
-	if !headersSent && !chunkOk {
-		fmt.Printf("server[%s]: stream failed\n", pubSub.id)
-		http.Error(w, "Stream failed", http.StatusServiceUnavailable)
-		return
+	if expired {
+		switch pubSub.endBehavior {
+		case endPlaceholder:
+			endHeader := make(textproto.MIMEHeader)
+			endHeader.Set("Content-Type", "image/jpeg")
+			endHeader.Set("X-Stream-End", "duration")
+			err = writePart(endHeader, pubSub.endImage)
+			if err != nil {
+				reason = disconnectWrite
+				logf("server[%s]: %s\n", pubSub.id, err)
+				return
+			}
+		case endTrailer:
+			w.Header().Set("X-Stream-End", "duration")
+		}
 	}
 
+	// every exit after the headers terminates the multipart stream once,
+	// so clients can tell a clean end from a broken connection
 	err = mw.Close()
 	if err != nil {
-		fmt.Printf("server[%s]: mime close failed: %s\n", pubSub.id, err)
+		logf("server[%s]: mime close failed: %s\n", pubSub.id, err)
+	}
+
+	if bw != nil {
+		err = bw.Flush()
+		if err != nil {
+			logf("server[%s]: buffer flush failed: %s\n", pubSub.id, err)
+		}
 	}
 }
@@ -0,0 +1,1397 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPubSub returns a stream that is not connected to any source,
+// frames are fed to it with deliver or doPublish.
+func newTestPubSub(t *testing.T, id string, conf configSource) *PubSub {
+	t.Helper()
+	return NewPubSub(id, nil, conf)
+}
+
+func TestMustDeliverDoesNotBlock(t *testing.T) {
+	pubSub := newTestPubSub(t, "/mustdeliver", configSource{})
+	sub := NewMustDeliverSubscriber("test")
+	pubSub.subscribers[sub] = struct{}{}
+
+	used := memoryUsed()
+	frame := Frame{Data: make([]byte, 100), Captured: time.Now()}
+	extra := 10
+
+	start := time.Now()
+	for i := 0; i < mustDeliverBuffer+extra; i++ {
+		pubSub.deliver(frame)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("deliver blocked for %s on a stalled subscriber", elapsed)
+	}
+
+	if got := len(sub.ChunkChannel); got != mustDeliverBuffer {
+		t.Errorf("buffered frames: got %d, want %d", got, mustDeliverBuffer)
+	}
+	if got := atomic.LoadUint64(&sub.dropped); got != uint64(extra) {
+		t.Errorf("subscriber drops: got %d, want %d", got, extra)
+	}
+	if pubSub.framesDropped != uint64(extra) {
+		t.Errorf("stream drops: got %d, want %d", pubSub.framesDropped, extra)
+	}
+
+	delete(pubSub.subscribers, sub)
+	sub.drain()
+	if got := memoryUsed(); got != used {
+		t.Errorf("memory after drain: got %d, want %d", got, used)
+	}
+}
+
+func TestDeliverDropsForBusySubscriber(t *testing.T) {
+	pubSub := newTestPubSub(t, "/busy", configSource{})
+	sub := NewSubscriber("test")
+	pubSub.subscribers[sub] = struct{}{}
+
+	pubSub.deliver(Frame{Data: []byte{1}, Captured: time.Now()})
+	if got := atomic.LoadUint64(&sub.dropped); got != 1 {
+		t.Errorf("drops: got %d, want 1", got)
+	}
+}
+
+func setSendLimits(t *testing.T, min, max time.Duration) {
+	oldMin, oldMax := minSendInterval, maxSendInterval
+	minSendInterval, maxSendInterval = min, max
+	t.Cleanup(func() { minSendInterval, maxSendInterval = oldMin, oldMax })
+}
+
+func TestParseSendInterval(t *testing.T) {
+	setSendLimits(t, 0, time.Minute)
+
+	tests := []struct {
+		fps      string
+		interval time.Duration
+		ok       bool
+		err      bool
+	}{
+		{"", 0, false, false},
+		{"abc", 0, false, false},
+		{"0", 0, true, false},
+		{"inf", 0, true, false},
+		{"+Inf", 0, true, false},
+		{"2", 500 * time.Millisecond, true, false},
+		{"0.001", time.Minute, true, false}, // clamped to maxSendInterval
+		{"-1", 0, false, true},
+		{"-inf", 0, false, true},
+		{"NaN", 0, false, true},
+	}
+
+	for _, test := range tests {
+		interval, ok, err := parseSendInterval(test.fps)
+		if interval != test.interval || ok != test.ok || (err != nil) != test.err {
+			t.Errorf("fps %q: got %s %v %v, want %s %v error %v",
+				test.fps, interval, ok, err, test.interval, test.ok, test.err)
+		}
+	}
+}
+
+// The lower limits apply whatever the client asks for, also for fps=0,
+// fps=inf and without fps.
+func TestSendIntervalLimits(t *testing.T) {
+	setSendLimits(t, 100*time.Millisecond, time.Minute)
+	pubSub := newTestPubSub(t, "/limits", configSource{MaxFPS: 5})
+
+	for _, fps := range []string{"", "0", "inf", "100"} {
+		interval, err := pubSub.sendInterval(fps, outputOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interval != 200*time.Millisecond {
+			t.Errorf("fps %q with maxfps 5: got %s", fps, interval)
+		}
+	}
+
+	pubSub = newTestPubSub(t, "/limits", configSource{})
+	for _, fps := range []string{"", "0", "inf", "100"} {
+		interval, _ := pubSub.sendInterval(fps, outputOptions{})
+		if interval != 100*time.Millisecond {
+			t.Errorf("fps %q with minsendinterval: got %s", fps, interval)
+		}
+	}
+
+	// the handler rate applies too
+	interval, _ := pubSub.sendInterval("0", outputOptions{rate: 1})
+	if interval != time.Second {
+		t.Errorf("handler rate 1: got %s", interval)
+	}
+
+	// the default of the stream only applies without fps
+	pubSub = newTestPubSub(t, "/limits", configSource{DefaultFPS: 2})
+	if interval, _ := pubSub.sendInterval("", outputOptions{}); interval != 500*time.Millisecond {
+		t.Errorf("default fps: got %s", interval)
+	}
+	if interval, _ := pubSub.sendInterval("0", outputOptions{}); interval != 100*time.Millisecond {
+		t.Errorf("fps=0 with default fps: got %s", interval)
+	}
+}
+
+// A missing fps gets the default of the stream while an explicit 0 is
+// unlimited, both only up to the max fps.
+func TestDefaultAndMaxFPS(t *testing.T) {
+	setSendLimits(t, 0, 0)
+
+	tests := []struct {
+		conf     configSource
+		fps      string
+		interval time.Duration
+	}{
+		{configSource{DefaultFPS: 2}, "", 500 * time.Millisecond},
+		{configSource{DefaultFPS: 2}, "abc", 500 * time.Millisecond},
+		{configSource{DefaultFPS: 2}, "0", 0},
+		{configSource{DefaultFPS: 2}, "4", 250 * time.Millisecond},
+		{configSource{DefaultFPS: 2, MaxFPS: 10}, "0", 100 * time.Millisecond},
+		{configSource{DefaultFPS: 2, MaxFPS: 10}, "20", 100 * time.Millisecond},
+		{configSource{DefaultFPS: 2, MaxFPS: 10}, "5", 200 * time.Millisecond},
+		{configSource{DefaultFPS: 20, MaxFPS: 10}, "", 100 * time.Millisecond},
+		{configSource{}, "", 0},
+	}
+	for _, test := range tests {
+		pubSub := newTestPubSub(t, "/fps", test.conf)
+		interval, err := pubSub.sendInterval(test.fps, outputOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interval != test.interval {
+			t.Errorf("fps %q with default %g max %g: got %s, want %s",
+				test.fps, test.conf.DefaultFPS, test.conf.MaxFPS, interval, test.interval)
+		}
+	}
+}
+
+// MaxFPS limits every client of the stream, also those asking for no rate
+// or no limit.
+func TestMaxFPSAllClients(t *testing.T) {
+	setSendLimits(t, 0, 0)
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 10*time.Millisecond)
+	pubSub := newTestStream(t, "/maxfps", configSource{
+		Source: source.URL, MaxFPS: 5, Boundary: "out", DurationSeconds: 0.6,
+	})
+
+	var wg sync.WaitGroup
+	for _, query := range []string{"", "?fps=0", "?fps=30"} {
+		wg.Add(1)
+		go func(query string) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+			// 0.6s at 5 fps, with some slack for the slot boundaries
+			if frames := strings.Count(w.Body.String(), "--out\r\n"); frames < 2 || frames > 5 {
+				t.Errorf("%q: got %d frames", query, frames)
+			}
+		}(query)
+	}
+	wg.Wait()
+}
+
+// flushRecorder is a response writer keeping the number of frames written
+// at each flush.
+type flushRecorder struct {
+	mu      sync.Mutex
+	header  http.Header
+	frames  int
+	writes  int
+	flushes []int
+	limit   int
+	done    chan struct{}
+}
+
+func newFlushRecorder(limit int) *flushRecorder {
+	return &flushRecorder{header: make(http.Header), limit: limit, done: make(chan struct{})}
+}
+
+func (fr *flushRecorder) Header() http.Header { return fr.header }
+
+func (fr *flushRecorder) WriteHeader(status int) {}
+
+func (fr *flushRecorder) Write(data []byte) (int, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.frames += bytes.Count(data, []byte("Content-Length:"))
+	fr.writes++
+	return len(data), nil
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.flushes = append(fr.flushes, fr.frames)
+	if fr.frames >= fr.limit && fr.limit > 0 {
+		select {
+		case <-fr.done:
+		default:
+			close(fr.done)
+		}
+	}
+}
+
+// batchSizes returns the frames sent with each flush.
+func (fr *flushRecorder) batchSizes() []int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	sizes := make([]int, len(fr.flushes))
+	last := 0
+	for i, frames := range fr.flushes {
+		sizes[i] = frames - last
+		last = frames
+	}
+	return sizes
+}
+
+// serveBatched streams to the recorder until it got the frames it waits
+// for or the timeout passes.
+func serveBatched(t testing.TB, pubSub *PubSub, query string, fr *flushRecorder, timeout time.Duration) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/?"+query, nil).WithContext(ctx)
+	served := make(chan struct{})
+	go func() {
+		pubSub.ServeHTTP(fr, r)
+		close(served)
+	}()
+
+	select {
+	case <-fr.done:
+	case <-time.After(timeout):
+	}
+	cancel()
+	<-served
+}
+
+func setBatchLimits(t testing.TB, frames int, delay time.Duration) {
+	oldFrames, oldDelay := maxBatchFrames, maxBatchDelay
+	maxBatchFrames, maxBatchDelay = frames, delay
+	t.Cleanup(func() { maxBatchFrames, maxBatchDelay = oldFrames, oldDelay })
+}
+
+func TestBatchFrames(t *testing.T) {
+	setBatchLimits(t, 30, time.Minute)
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 5*time.Millisecond)
+	pubSub := newTestStream(t, "/batch", configSource{Source: source.URL})
+
+	fr := newFlushRecorder(20)
+	serveBatched(t, pubSub, "batch=5", fr, 10*time.Second)
+
+	sizes := fr.batchSizes()
+	if len(sizes) < 4 {
+		t.Fatalf("flushes: got %d, want at least 4", len(sizes))
+	}
+	for i, size := range sizes[:4] {
+		if size != 5 {
+			t.Errorf("batch %d: got %d frames, want 5", i, size)
+		}
+	}
+}
+
+// A batch larger than the stream sends in maxBatchDelay is flushed by the
+// delay, also without batchms, and its size is capped.
+func TestBatchLimits(t *testing.T) {
+	setBatchLimits(t, 4, 50*time.Millisecond)
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	pubSub := newTestStream(t, "/batchlimits", configSource{Source: source.URL})
+
+	fr := newFlushRecorder(10)
+	start := time.Now()
+	serveBatched(t, pubSub, "batch=1000", fr, 10*time.Second)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("10 frames took %s", elapsed)
+	}
+
+	for i, size := range fr.batchSizes() {
+		if size > 4 {
+			t.Errorf("batch %d: got %d frames, want at most 4", i, size)
+		}
+	}
+
+	// batchms is capped by maxBatchDelay as well
+	fr = newFlushRecorder(5)
+	start = time.Now()
+	serveBatched(t, pubSub, "batchms=60000", fr, 10*time.Second)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("5 frames with batchms took %s", elapsed)
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	setBatchLimits(b, 30, 500*time.Millisecond)
+	frame := testJPEG(b, 8, 8, color.White)
+	for _, batch := range []int{1, 10} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			source := newTestSource(b, frame, time.Millisecond)
+			pubSub := newTestStream(b, "/benchbatch", configSource{Source: source.URL})
+
+			fr := newFlushRecorder(b.N)
+			b.ResetTimer()
+			serveBatched(b, pubSub, fmt.Sprintf("batch=%d", batch), fr, time.Minute)
+			b.StopTimer()
+			if sizes := fr.batchSizes(); len(sizes) > 0 {
+				b.ReportMetric(float64(b.N)/float64(len(sizes)), "frames/flush")
+			}
+		})
+	}
+}
+
+// BenchmarkWriteBuffer compares the writes needed per frame with the
+// response buffered and written directly.
+func BenchmarkWriteBuffer(b *testing.B) {
+	frame := testJPEG(b, 8, 8, color.White)
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("writebuffer=%d", size), func(b *testing.B) {
+			old := writeBufferSize
+			writeBufferSize = size
+			defer func() { writeBufferSize = old }()
+			source := newTestSource(b, frame, time.Millisecond)
+			pubSub := newTestStream(b, "/benchwritebuffer", configSource{Source: source.URL})
+
+			fr := newFlushRecorder(b.N)
+			b.ResetTimer()
+			serveBatched(b, pubSub, "", fr, time.Minute)
+			b.StopTimer()
+			fr.mu.Lock()
+			defer fr.mu.Unlock()
+			if fr.frames > 0 {
+				b.ReportMetric(float64(fr.writes)/float64(fr.frames), "writes/frame")
+			}
+		})
+	}
+}
+
+func setMemoryLimit(t *testing.T, limit int64) {
+	old := memoryLimit
+	memoryLimit = limit
+	t.Cleanup(func() { memoryLimit = old })
+}
+
+// Frames shed for the memory limit count as dropped.
+func TestMemoryLimitDrops(t *testing.T) {
+	pubSub := newTestPubSub(t, "/memorydrops", configSource{})
+	sub := NewSubscriber("test")
+	pubSub.subscribers[sub] = struct{}{}
+
+	setMemoryLimit(t, 1<<20)
+	memoryAcquire(1 << 20)
+	defer memoryRelease(1 << 20)
+	used := memoryUsed()
+
+	now := time.Now()
+	pubSub.deliver(Frame{Data: make([]byte, 256<<10), Captured: now})
+	if len(sub.ChunkChannel) != 0 {
+		t.Error("frame delivered over the memory limit")
+	}
+	if got := memoryUsed(); got != used {
+		t.Errorf("memory: got %d, want %d", got, used)
+	}
+	if pubSub.framesDropped != 1 {
+		t.Errorf("stream drops: got %d, want 1", pubSub.framesDropped)
+	}
+	if pubSub.dropRate.value(now) <= 0 {
+		t.Error("drop not in the drop rate")
+	}
+}
+
+// slowWriter is a response writer taking its time for every write, so
+// the stream drops frames for it.
+type slowWriter struct {
+	mu      sync.Mutex
+	header  http.Header
+	written bytes.Buffer
+	delay   time.Duration
+}
+
+func (sw *slowWriter) Header() http.Header { return sw.header }
+
+func (sw *slowWriter) WriteHeader(status int) {}
+
+func (sw *slowWriter) Write(data []byte) (int, error) {
+	time.Sleep(sw.delay)
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.written.Write(data)
+}
+
+func (sw *slowWriter) Flush() {}
+
+func (sw *slowWriter) contains(s string) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return bytes.Contains(sw.written.Bytes(), []byte(s))
+}
+
+func TestReportDrops(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 5*time.Millisecond)
+	pubSub := newTestStream(t, "/reportdrops", configSource{Source: source.URL, ReportDrops: true})
+
+	sw := &slowWriter{header: make(http.Header), delay: 30 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	served := make(chan struct{})
+	go func() {
+		pubSub.ServeHTTP(sw, r)
+		close(served)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !sw.contains("X-Frames-Dropped: ") {
+		if time.Now().After(deadline) {
+			t.Error("no X-Frames-Dropped header for a slow client")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-served
+}
+
+// Frames shed for the memory limit are reported to the client like those
+// dropped for being slow.
+func TestMemoryLimitReportsDrops(t *testing.T) {
+	pubSub := newTestPubSub(t, "/memoryreport", configSource{})
+	sub := NewSubscriber("test")
+	pubSub.subscribers[sub] = struct{}{}
+
+	setMemoryLimit(t, 1<<20)
+	memoryAcquire(1 << 20)
+	pubSub.deliver(Frame{Data: make([]byte, 1024), Captured: time.Now()})
+	pubSub.deliver(Frame{Data: make([]byte, 1024), Captured: time.Now()})
+	memoryRelease(1 << 20)
+
+	if got := atomic.LoadUint64(&sub.dropped); got != 2 {
+		t.Errorf("pending drops: got %d, want 2", got)
+	}
+}
+
+// newSteppedSource sends a frame for every value on the channel. Each one
+// is followed by the next boundary, so it is complete once written.
+func newSteppedSource(t *testing.T, frame []byte, send <-chan struct{}) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "--frame\r\n")
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case <-send:
+			case <-r.Context().Done():
+				return
+			}
+			_, err := fmt.Fprintf(w, "Content-Type: image/jpeg\r\n\r\n%s\r\n--frame\r\n", frame)
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return server
+}
+
+// The last frame is repeated marked as stale while the stream is stalled,
+// and live frames are sent unmarked again once the source recovers.
+func TestStaleFrames(t *testing.T) {
+	send := make(chan struct{}, 1)
+	source := newSteppedSource(t, testJPEG(t, 8, 8, color.White), send)
+	pubSub := newTestStream(t, "/stale", configSource{Source: source.URL, StaleIntervalSeconds: 0.05})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	send <- struct{}{}
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	next := func() bool {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return part.Header.Get("X-Stream-Stale") == "true"
+	}
+
+	if next() {
+		t.Error("first frame marked stale")
+	}
+	if !next() {
+		t.Error("frame during the stall not marked stale")
+	}
+	if !pubSub.Status().Stalled {
+		t.Error("stream not reported stalled")
+	}
+
+	// stale repeats may still be queued before the live frame
+	send <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for next() {
+		if time.Now().After(deadline) {
+			t.Fatal("no live frame after recovery")
+		}
+	}
+	if pubSub.Status().Stalled {
+		t.Error("stream still reported stalled after recovery")
+	}
+}
+
+// Subscribers coming and going all the time make the stream stop and
+// start its chunker over and over, run with -race.
+func TestSubscribeDuringStop(t *testing.T) {
+	camera := newTestSource(t, testJPEG(t, 8, 8, color.White), time.Millisecond)
+	var connects int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connects, 1)
+		camera.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer source.Close()
+	defer source.CloseClientConnections()
+	pubSub := newTestStream(t, "/substress", configSource{Source: source.URL})
+
+	var wg sync.WaitGroup
+	var frames int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				sub := NewSubscriber("stress")
+				pubSub.Subscribe(sub)
+				// some leave right away, while the chunker starts
+				if <-sub.admitted && (i+j)%3 != 0 {
+					select {
+					case frame, ok := <-sub.ChunkChannel:
+						if ok {
+							memoryRelease(len(frame.Data))
+							atomic.AddInt64(&frames, 1)
+						}
+					case <-time.After(5 * time.Second):
+						t.Error("no frame after subscribing")
+					}
+				}
+				pubSub.Unsubscribe(sub)
+				sub.drain()
+				// gaps let the stream run out of subscribers and stop
+				time.Sleep(time.Duration((i+j)%4) * time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if frames == 0 {
+		t.Error("no frames received")
+	}
+	if atomic.LoadInt32(&connects) < 2 {
+		t.Errorf("chunker never restarted, %d connects", connects)
+	}
+	// the loop is still responsive and has no subscribers left
+	if status := pubSub.Status(); status.Subscribers != 0 {
+		t.Errorf("subscribers left: %d", status.Subscribers)
+	}
+}
+
+// Clients getting no frames are closed once the idle timeout passes.
+func TestIdleTimeout(t *testing.T) {
+	source := newStalledSource(t)
+	pubSub := newTestStream(t, "/idle", configSource{Source: source.URL, IdleTimeoutSeconds: 0.1})
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/idle", nil))
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("closed after %s, want the 100ms timeout", elapsed)
+	}
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+}
+
+// Clients asking for status get JSON status parts between the frames.
+func TestStatusParts(t *testing.T) {
+	old := statusInterval
+	statusInterval = 30 * time.Millisecond
+	defer func() { statusInterval = old }()
+
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	pubSub := newTestStream(t, "/statusparts", configSource{Source: source.URL})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	resp, err := http.Get(server.URL + "/?status=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+
+	frames, statuses := 0, 0
+	for i := 0; i < 50 && (frames == 0 || statuses == 0); i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch part.Header.Get("Content-Type") {
+		case "image/jpeg":
+			frames++
+		case "application/json":
+			statuses++
+			var status map[string]interface{}
+			if err := json.NewDecoder(part).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"fps", "subscribers", "uptime"} {
+				if _, ok := status[key]; !ok {
+					t.Errorf("status part without %s: %v", key, status)
+				}
+			}
+		default:
+			t.Errorf("unexpected part %q", part.Header.Get("Content-Type"))
+		}
+	}
+	if frames == 0 || statuses == 0 {
+		t.Errorf("got %d frames and %d status parts", frames, statuses)
+	}
+}
+
+// The content type template is sent as configured, only with the boundary
+// filled in.
+func TestContentTypeTemplate(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	pubSub := newTestStream(t, "/contenttype", configSource{
+		Source:      source.URL,
+		Boundary:    "camframe",
+		ContentType: "multipart/x-mixed-replace;boundary=--{boundary}",
+	})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	want := "multipart/x-mixed-replace;boundary=--camframe"
+	resp, err := http.Head(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != want {
+		t.Errorf("HEAD content type: got %q, want %q", got, want)
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != want {
+		t.Errorf("GET content type: got %q, want %q", got, want)
+	}
+	mr := multipart.NewReader(resp.Body, "camframe")
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Streams ending after the headers are terminated with the closing
+// boundary exactly once, whichever way they end.
+func TestStreamTermination(t *testing.T) {
+	frame := testJPEG(t, 8, 8, color.White)
+	ending := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--frame\r\n", frame)
+	}))
+	defer ending.Close()
+	send := make(chan struct{}, 1)
+	send <- struct{}{}
+	stalled := newSteppedSource(t, frame, send)
+	live := newTestSource(t, frame, 10*time.Millisecond)
+
+	tests := []struct {
+		name string
+		conf configSource
+	}{
+		{"upstream", configSource{Source: ending.URL}},
+		{"idle", configSource{Source: stalled.URL, IdleTimeoutSeconds: 0.1}},
+		{"duration", configSource{Source: live.URL, DurationSeconds: 0.1}},
+	}
+	for _, test := range tests {
+		test.conf.Boundary = "out"
+		pubSub := newTestStream(t, "/end-"+test.name, test.conf)
+		w := httptest.NewRecorder()
+		pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.Contains(body, "--out\r\n") {
+			t.Errorf("%s: no frames sent, status %d", test.name, w.Code)
+		}
+		if n := strings.Count(body, "--out--"); n != 1 || !strings.HasSuffix(body, "--out--\r\n") {
+			t.Errorf("%s: closing boundary sent %d times, body ends %q",
+				test.name, n, body[len(body)-min(len(body), 20):])
+		}
+	}
+}
+
+// Clients over the limit wait in the queue and are admitted once a slot
+// frees, or turned away when none does in time.
+func TestAdmissionQueue(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 10*time.Millisecond)
+	pubSub := newTestStream(t, "/queue", configSource{
+		Source: source.URL, MaxSubscribers: 1, QueueLength: 1, QueueTimeoutSeconds: 0.2,
+	})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	first, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFrames(t, first, 1)
+
+	queued := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+			resp = nil
+		}
+		queued <- resp
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for pubSub.Status().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("client not queued")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	first.Body.Close()
+
+	second := <-queued
+	if second == nil {
+		t.FailNow()
+	}
+	defer second.Body.Close()
+	if second.StatusCode != http.StatusOK {
+		t.Fatalf("queued client: got status %d after the slot freed", second.StatusCode)
+	}
+	readFrames(t, second, 1)
+
+	// nobody leaves this time
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("timed out client: got status %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("turned away after %s, before the queue timeout", elapsed)
+	}
+	for pubSub.Status().Queued != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out client left in the queue")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// The request deadline ends streams that would otherwise run forever,
+// also those still waiting for their first frame.
+func TestRequestDeadline(t *testing.T) {
+	live := newTestSource(t, testJPEG(t, 8, 8, color.White), 10*time.Millisecond)
+	stalled := newStalledSource(t)
+
+	tests := []struct {
+		name   string
+		source string
+		status int
+	}{
+		{"streaming", live.URL, http.StatusOK},
+		{"waiting", stalled.URL, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		pubSub := newTestStream(t, "/deadline-"+test.name, configSource{Source: test.source})
+		handler := requestDeadline(pubSub, 150*time.Millisecond)
+
+		w := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 5*time.Second {
+			t.Errorf("%s: returned after %s, want the 150ms deadline", test.name, elapsed)
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+// Streams ending for their duration do so the configured way.
+func TestEndBehavior(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 10*time.Millisecond)
+	endImage := testJPEG(t, 8, 8, color.Black)
+
+	for _, behavior := range []string{endClose, endPlaceholder, endTrailer} {
+		pubSub := newTestStream(t, "/end-"+behavior, configSource{
+			Source: source.URL, DurationSeconds: 0.1, EndBehavior: behavior,
+		})
+		pubSub.endImage = endImage
+		server := httptest.NewServer(pubSub)
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		var last *multipart.Part
+		var lastData []byte
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", behavior, err)
+			}
+			last = part
+			if lastData, err = ioutil.ReadAll(part); err != nil {
+				t.Fatal(err)
+			}
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		if last == nil {
+			t.Fatalf("%s: no parts", behavior)
+		}
+		placeholder := last.Header.Get("X-Stream-End") == "duration"
+		if placeholder != (behavior == endPlaceholder) {
+			t.Errorf("%s: last part end header %q", behavior, last.Header.Get("X-Stream-End"))
+		}
+		if placeholder && !bytes.Equal(lastData, endImage) {
+			t.Errorf("%s: last part is not the end image", behavior)
+		}
+		trailer := resp.Trailer.Get("X-Stream-End") == "duration"
+		if trailer != (behavior == endTrailer) {
+			t.Errorf("%s: trailer %q", behavior, resp.Trailer.Get("X-Stream-End"))
+		}
+	}
+}
+
+// A client leaving within the connect delay never makes the stream connect
+// to the source, one staying does once the delay is over.
+func TestConnectDelay(t *testing.T) {
+	var connects int32
+	camera := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connects, 1)
+		camera.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer source.Close()
+	defer source.CloseClientConnections()
+	pubSub := newTestStream(t, "/connectdelay", configSource{Source: source.URL, ConnectDelaySeconds: 0.2})
+
+	subscribe := func() *Subscriber {
+		sub := NewSubscriber("test")
+		pubSub.Subscribe(sub)
+		if !<-sub.admitted {
+			t.Fatal("subscriber not admitted")
+		}
+		return sub
+	}
+
+	sub := subscribe()
+	time.Sleep(50 * time.Millisecond)
+	pubSub.Unsubscribe(sub)
+	time.Sleep(400 * time.Millisecond)
+	if n := atomic.LoadInt32(&connects); n != 0 {
+		t.Fatalf("short lived client connected %d times", n)
+	}
+
+	sub = subscribe()
+	defer pubSub.Unsubscribe(sub)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&connects); n != 0 {
+		t.Fatal("connected before the delay was over")
+	}
+	select {
+	case frame := <-sub.ChunkChannel:
+		memoryRelease(len(frame.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame after the delay")
+	}
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("got %d connects, want 1", n)
+	}
+}
+
+// Only allowlisted client parameters reach the source, encoded so they
+// cannot add parameters of their own, while static ones stay as set.
+func TestForwardedQuery(t *testing.T) {
+	queries := make(chan url.Values, 10)
+	camera := newTestSource(t, testJPEG(t, 8, 8, color.White), 20*time.Millisecond)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		camera.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer source.Close()
+	defer source.CloseClientConnections()
+
+	pubSub := newTestStream(t, "/forward", configSource{
+		Source:       source.URL + "/video?cam=1",
+		SourceQuery:  map[string]string{"res": "hd"},
+		ForwardQuery: []string{"channel"},
+	})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	resp, err := http.Get(server.URL + "/?channel=2%26res%3Dlow%26token%3Dx&res=low&token=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	readFrames(t, resp, 1)
+
+	query := <-queries
+	want := url.Values{"cam": {"1"}, "res": {"hd"}, "channel": {"2&res=low&token=x"}}
+	if query.Encode() != want.Encode() {
+		t.Errorf("source query: got %v, want %v", query, want)
+	}
+}
+
+// Frames containing the fixed boundary are still sent, with a warning.
+func TestBoundaryInFrame(t *testing.T) {
+	tests := []struct {
+		frame string
+		warn  bool
+	}{
+		{"frame data --camframe more data", true},
+		{"frame data -camframe- more data", false},
+	}
+	for _, test := range tests {
+		source := newTestSource(t, []byte(test.frame), 10*time.Millisecond)
+		pubSub := newTestStream(t, "/boundary", configSource{Source: source.URL, Boundary: "camframe"})
+		server := httptest.NewServer(pubSub)
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames := readFrames(t, resp, 2)
+		resp.Body.Close()
+		server.CloseClientConnections()
+		server.Close()
+
+		if string(frames[1]) != test.frame {
+			t.Errorf("%q: got frame %q", test.frame, frames[1])
+		}
+		if warned := atomic.LoadInt64(&pubSub.boundaryWarning) != 0; warned != test.warn {
+			t.Errorf("%q: warned %v, want %v", test.frame, warned, test.warn)
+		}
+	}
+}
+
+// HEAD probes get the headers of a working stream whatever their query
+// and a 503 for a dead one, GET with a malformed query is rejected with
+// the reason.
+func TestMalformedQuery(t *testing.T) {
+	source := newTestSource(t, testJPEG(t, 8, 8, color.White), 10*time.Millisecond)
+	pubSub := newTestStream(t, "/malformed", configSource{Source: source.URL})
+
+	w := httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/?fps=%zz", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/x-mixed-replace") {
+		t.Errorf("HEAD: got status %d with %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?fps=%zz", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid query: ") {
+		t.Errorf("GET: got status %d with %q", w.Code, w.Body.String())
+	}
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	pubSub = newTestStream(t, "/malformed-dead", configSource{Source: dead.URL})
+	w = httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/?fps=%zz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("HEAD of a dead source: got status %d", w.Code)
+	}
+}
+
+// Subscribers joining together get no frame of their own on subscribe,
+// they all share the delivery of the next published frame.
+func TestSimultaneousSubscribers(t *testing.T) {
+	send := make(chan struct{}, 1)
+	source := newSteppedSource(t, testJPEG(t, 8, 8, color.White), send)
+	pubSub := newTestStream(t, "/together", configSource{Source: source.URL})
+
+	// frames are dropped for subscribers not waiting, so all wait
+	frames := make(chan Frame, 10)
+	for i := 0; i < 10; i++ {
+		sub := NewSubscriber(fmt.Sprintf("client%d", i))
+		pubSub.Subscribe(sub)
+		defer pubSub.Unsubscribe(sub)
+		if !<-sub.admitted {
+			t.Fatal("subscriber not admitted")
+		}
+		go func() {
+			if frame, ok := <-sub.ChunkChannel; ok {
+				memoryRelease(len(frame.Data))
+				frames <- frame
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(frames) > 0 {
+		t.Fatal("frame sent before one was published")
+	}
+
+	send <- struct{}{}
+	first := <-frames
+	for i := 1; i < 10; i++ {
+		select {
+		case frame := <-frames:
+			if &frame.Data[0] != &first.Data[0] || !frame.Captured.Equal(first.Captured) {
+				t.Error("subscriber got a frame of its own")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d subscribers got no frame", 10-i)
+		}
+	}
+}
+
+// Subscribers joining within the join window get the last frame together
+// in one pass once the window ends, not one send per subscribe.
+func TestJoinWindow(t *testing.T) {
+	send := make(chan struct{}, 1)
+	source := newSteppedSource(t, testJPEG(t, 8, 8, color.White), send)
+	pubSub := newTestStream(t, "/joinwindow", configSource{Source: source.URL, JoinWindowSeconds: 0.2})
+
+	first := NewSubscriber("first")
+	pubSub.Subscribe(first)
+	defer pubSub.Unsubscribe(first)
+	if !<-first.admitted {
+		t.Fatal("first subscriber not admitted")
+	}
+	send <- struct{}{}
+	frame := <-first.ChunkChannel
+	memoryRelease(len(frame.Data))
+
+	type received struct {
+		frame Frame
+		at    time.Time
+	}
+	frames := make(chan received, 10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		sub := NewSubscriber(fmt.Sprintf("client%d", i))
+		pubSub.Subscribe(sub)
+		defer pubSub.Unsubscribe(sub)
+		if !<-sub.admitted {
+			t.Fatal("subscriber not admitted")
+		}
+		go func() {
+			if frame, ok := <-sub.ChunkChannel; ok {
+				memoryRelease(len(frame.Data))
+				frames <- received{frame, time.Now()}
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	joined := time.Since(start)
+
+	var earliest, latest time.Time
+	for i := 0; i < 10; i++ {
+		select {
+		case r := <-frames:
+			if &r.frame.Data[0] != &frame.Data[0] {
+				t.Error("subscriber did not get the last frame")
+			}
+			if earliest.IsZero() || r.at.Before(earliest) {
+				earliest = r.at
+			}
+			if r.at.After(latest) {
+				latest = r.at
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d subscribers got no frame", 10-i)
+		}
+	}
+	if spread := latest.Sub(earliest); spread >= joined/2 {
+		t.Errorf("frames sent over %s to subscribers joining over %s", spread, joined)
+	}
+}
+
+// With FreezeOnEnd clients of a source ending cleanly are kept and get the
+// last frame repeated instead of being disconnected.
+func TestFreezeOnEnd(t *testing.T) {
+	frame := testJPEG(t, 8, 8, color.White)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--frame--\r\n", frame)
+	}))
+	defer source.Close()
+	pubSub := newTestStream(t, "/freeze", configSource{Source: source.URL, FreezeOnEnd: true})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the source sends a single frame, the rest are repeats
+	for i, data := range readFrames(t, resp, 2) {
+		if !bytes.Equal(data, frame) {
+			t.Errorf("frame %d is not the last source frame", i)
+		}
+	}
+	status := pubSub.Status()
+	if !status.Frozen || status.Connected || status.Subscribers != 1 {
+		t.Errorf("status after the source ended: %+v", status)
+	}
+}
+
+// failingWriter is a client connection that is gone, every write fails.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (fw failingWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+// Clients leaving a stream are counted once, under the reason they left.
+func TestDisconnectReasons(t *testing.T) {
+	frame := testJPEG(t, 8, 8, color.White)
+	live := newTestSource(t, frame, 10*time.Millisecond)
+	stalled := newStalledSource(t)
+	ending := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+		fmt.Fprintf(w, "--frame\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--frame--\r\n", frame)
+	}))
+	defer ending.Close()
+
+	tests := []struct {
+		reason string
+		conf   configSource
+		serve  func(pubSub *PubSub)
+	}{
+		{disconnectClient, configSource{Source: live.URL}, func(pubSub *PubSub) {
+			server := httptest.NewServer(pubSub)
+			defer server.Close()
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readFrames(t, resp, 1)
+			resp.Body.Close()
+		}},
+		{disconnectWrite, configSource{Source: live.URL}, func(pubSub *PubSub) {
+			w := failingWriter{httptest.NewRecorder()}
+			pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		}},
+		{disconnectIdle, configSource{Source: stalled.URL, IdleTimeoutSeconds: 0.1}, nil},
+		{disconnectDuration, configSource{Source: live.URL, DurationSeconds: 0.1}, nil},
+		{disconnectUpstream, configSource{Source: ending.URL}, nil},
+		{disconnectDeadline, configSource{Source: live.URL}, func(pubSub *PubSub) {
+			requestDeadline(pubSub, 100*time.Millisecond).ServeHTTP(httptest.NewRecorder(),
+				httptest.NewRequest(http.MethodGet, "/", nil))
+		}},
+	}
+	for _, test := range tests {
+		pubSub := newTestStream(t, "/disconnect-"+test.reason, test.conf)
+		counter := disconnectCounter.WithLabelValues(pubSub.id, test.reason)
+		before := metricValue(t, counter)
+		if test.serve == nil {
+			pubSub.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		} else {
+			test.serve(pubSub)
+		}
+
+		// the handler of a closed connection may still be returning
+		deadline := time.Now().Add(5 * time.Second)
+		for pubSub.Status().Disconnects[test.reason] == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for reason, count := range pubSub.Status().Disconnects {
+			want := uint64(0)
+			if reason == test.reason {
+				want = 1
+			}
+			if count != want {
+				t.Errorf("%s: got %d disconnects for %s", test.reason, count, reason)
+			}
+		}
+		if got := metricValue(t, counter) - before; got != 1 {
+			t.Errorf("%s: metric counted %g", test.reason, got)
+		}
+	}
+}
+
+// Frames older than MaxFrameAgeSeconds when a client gets them are skipped
+// for the next one.
+func TestMaxFrameAge(t *testing.T) {
+	source := newStalledSource(t)
+	pubSub := newTestStream(t, "/maxage", configSource{Source: source.URL, MaxFrameAgeSeconds: 0.1})
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	// the response starts with the first frame sent
+	resps := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+			close(resps)
+			return
+		}
+		resps <- resp
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for status := pubSub.Status(); status.Subscribers == 0 || !status.Connected; status = pubSub.Status() {
+		if time.Now().After(deadline) {
+			t.Fatal("client not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the stalled source sends nothing, so the frames are fed in its place,
+	// fresh ones repeatedly as frames for a busy client are dropped
+	old, fresh := testJPEG(t, 8, 8, color.White), testJPEG(t, 8, 8, color.Black)
+	pubChan := pubSub.pubChan
+	pubChan <- Frame{Data: old, Captured: time.Now().Add(-time.Second)}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case pubChan <- Frame{Data: fresh, Captured: time.Now()}:
+				time.Sleep(10 * time.Millisecond)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// the channel is closed once the client leaves, so feeding stops first
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	resp, ok := <-resps
+	if !ok {
+		return
+	}
+	if frames := readFrames(t, resp, 1); !bytes.Equal(frames[0], fresh) {
+		t.Error("old frame sent to the client")
+	}
+}
+
+// The preamble and the empty part come before the first frame, and
+// multipart parsers skip to the frames.
+func TestPreamble(t *testing.T) {
+	frame := testJPEG(t, 8, 8, color.White)
+	source := newTestSource(t, frame, 10*time.Millisecond)
+	pubSub := newTestStream(t, "/preamble", configSource{
+		Source: source.URL, Boundary: "out", DurationSeconds: 0.1,
+		Preamble: "legacy", PreamblePart: "text/plain",
+	})
+	w := httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	body := w.Body.String()
+	want := "legacy\r\n--out\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n\r\n--out\r\n"
+	if !strings.HasPrefix(body, want) {
+		t.Errorf("body starts %q, want %q", body[:min(len(body), len(want))], want)
+	}
+
+	mr := multipart.NewReader(strings.NewReader(body), "out")
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(part); part.Header.Get("Content-Type") != "text/plain" || len(data) != 0 {
+		t.Errorf("first part %v with %d bytes", part.Header, len(data))
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(part); !bytes.Equal(data, frame) {
+		t.Error("second part is not the frame")
+	}
+
+	err = startSource(configSource{Source: source.URL, Path: "/preamble-bad", Boundary: "out", Preamble: "x\r\n--out\r\n"})
+	if err == nil || !strings.Contains(err.Error(), "preamble contains the boundary") {
+		t.Errorf("preamble with the boundary: got error %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Time constant of the moving averages used for frame and byte rates. A
+// short window follows rate changes quickly, a long one is smoother.
+var rateWindow = 5 * time.Second
+
+// rateEstimator measures a rate per second as an exponentially weighted
+// moving average. Every amount added counts n/window at first and decays
+// with the window as time constant, so after a step change the estimate
+// covers 63% of the difference within one window.
+type rateEstimator struct {
+	rate float64
+	last time.Time
+}
+
+func (e *rateEstimator) decay(now time.Time) {
+	if !e.last.IsZero() {
+		e.rate *= math.Exp(-now.Sub(e.last).Seconds() / rateWindow.Seconds())
+	}
+	e.last = now
+}
+
+func (e *rateEstimator) add(n float64, now time.Time) {
+	e.decay(now)
+	e.rate += n / rateWindow.Seconds()
+}
+
+func (e *rateEstimator) value(now time.Time) float64 {
+	if e.last.IsZero() {
+		return 0
+	}
+	return e.rate * math.Exp(-now.Sub(e.last).Seconds()/rateWindow.Seconds())
+}
+
+func (e *rateEstimator) reset() {
+	*e = rateEstimator{}
+}
+
+// syncRateEstimator is a rateEstimator shared between goroutines.
+type syncRateEstimator struct {
+	mu sync.Mutex
+	e  rateEstimator
+}
+
+func (s *syncRateEstimator) add(n float64) {
+	s.mu.Lock()
+	s.e.add(n, time.Now())
+	s.mu.Unlock()
+}
+
+func (s *syncRateEstimator) value() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.e.value(time.Now())
+}
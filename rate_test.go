@@ -0,0 +1,60 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// A steady rate is measured as it is, and decays with the time constant
+// of the window once events stop. rateWindow is left at its default, the
+// streams of other tests read it.
+func TestRateEstimatorWindow(t *testing.T) {
+	var e rateEstimator
+	start := time.Unix(1000000, 0)
+	now := start
+	if got := e.value(now); got != 0 {
+		t.Errorf("before any event: got %g", got)
+	}
+
+	// ten events a second for ten windows
+	interval := 100 * time.Millisecond
+	for now.Sub(start) < 10*rateWindow {
+		now = now.Add(interval)
+		e.add(1, now)
+	}
+	if got := e.value(now); math.Abs(got-10) > 0.6 {
+		t.Errorf("steady rate: got %g, want about 10", got)
+	}
+
+	steady := e.value(now)
+	if got, want := e.value(now.Add(rateWindow)), steady/math.E; math.Abs(got-want) > 1e-9 {
+		t.Errorf("one window later: got %g, want %g", got, want)
+	}
+
+	// a burst counts as spread over the window
+	e.reset()
+	e.add(50, start)
+	if got, want := e.value(start), 50/rateWindow.Seconds(); got != want {
+		t.Errorf("burst: got %g, want %g", got, want)
+	}
+}
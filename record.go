@@ -0,0 +1,136 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record the frames of all streams to this directory, compressed with
+// recordGzip.
+var (
+	recordDir  string
+	recordGzip bool
+)
+
+// frameRecorder appends the frames of every stream to a file per stream
+// and hour, <stream>-YYYYMMDD-HH.mjpeg, which ffmpeg reads with -f mjpeg
+// and file:// sources replay. Compressed files get a .gz suffix, with a
+// gzip member per recorder run appended, as gzip readers expect.
+// Each stream calls write from a goroutine of its own.
+type frameRecorder struct {
+	dir      string
+	compress bool
+	mu       sync.Mutex
+	files    map[string]*recordFile
+}
+
+type recordFile struct {
+	name string
+	file *os.File     // nil if the file could not be opened
+	gz   *gzip.Writer // nil unless compressing
+}
+
+func newFrameRecorder(dir string, compress bool) (*frameRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &frameRecorder{dir: dir, compress: compress, files: make(map[string]*recordFile)}, nil
+}
+
+func (f *recordFile) close() {
+	if f.gz != nil {
+		f.gz.Close()
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+}
+
+func (f *recordFile) write(data []byte) error {
+	if f.gz == nil {
+		_, err := f.file.Write(data)
+		return err
+	}
+
+	// flushed for every frame, so a crash loses at most the last one
+	_, err := f.gz.Write(data)
+	if err == nil {
+		err = f.gz.Flush()
+	}
+	return err
+}
+
+// file returns the file of the hour for the stream, nil if it could not
+// be opened. It is only used by the goroutine of the stream.
+func (rec *frameRecorder) file(stream string, captured time.Time) *recordFile {
+	name := filepath.Join(rec.dir, fmt.Sprintf("%s-%s.mjpeg",
+		statName(stream), captured.Format("20060102-15")))
+	if rec.compress {
+		name += ".gz"
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	current := rec.files[stream]
+	if current != nil && current.name == name {
+		if current.file == nil {
+			return nil
+		}
+		return current
+	}
+	if current != nil {
+		current.close()
+	}
+
+	current = &recordFile{name: name}
+	rec.files[stream] = current
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		logf("record[%s]: %s\n", stream, err)
+		return nil
+	}
+	current.file = file
+	if rec.compress {
+		current.gz, _ = gzip.NewWriterLevel(file, gzip.BestSpeed) // JPEG barely compresses
+	}
+	return current
+}
+
+func (rec *frameRecorder) write(stream string, frame Frame) {
+	captured := frame.Captured
+	if captured.IsZero() {
+		captured = time.Now()
+	}
+
+	file := rec.file(stream, captured)
+	if file == nil {
+		return
+	}
+	if err := file.write(frame.Data); err != nil {
+		logf("record[%s]: %s\n", stream, err)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFrameRecorder(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := newFrameRecorder(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := time.Date(2024, 5, 1, 10, 59, 0, 0, time.Local)
+	recorder.write("/cam/a", Frame{Data: []byte("one"), Captured: hour})
+	recorder.write("/cam/a", Frame{Data: []byte("two"), Captured: hour.Add(time.Second)})
+	recorder.write("/cam/a", Frame{Data: []byte("three"), Captured: hour.Add(time.Minute)})
+	recorder.write("/cam/b", Frame{Data: []byte("other"), Captured: hour})
+
+	want := map[string]string{
+		"cam_a-20240501-10.mjpeg": "onetwo",
+		"cam_a-20240501-11.mjpeg": "three",
+		"cam_b-20240501-10.mjpeg": "other",
+	}
+	for name, content := range want {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(data, []byte(content)) {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+}
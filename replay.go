@@ -0,0 +1,156 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frame rate of replayed recordings, which do not keep the capture times,
+// unless the source sets fps in its query.
+const defaultReplayFPS = 10
+
+const replayBoundary = "recording"
+
+// replayTransport answers file:// sources with the recording of the path
+// as a multipart stream, so replays go through the same chunker as the
+// cameras. Recordings ending in .gz are decompressed while reading.
+type replayTransport struct{}
+
+func (replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fps := float64(defaultReplayFPS)
+	if value := req.URL.Query().Get("fps"); value != "" {
+		var err error
+		fps, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(fps > 0) {
+			return nil, fmt.Errorf("invalid replay fps: %s", value)
+		}
+	}
+
+	file, err := os.Open(req.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = file
+	if strings.HasSuffix(req.URL.Path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %s", req.URL.Path, err)
+		}
+		r = gz
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer file.Close()
+		interval := time.Duration(float64(time.Second) / fps)
+		pw.CloseWithError(replay(req.Context(), bufio.NewReader(r), pw, interval))
+	}()
+
+	header := make(http.Header)
+	header.Set("Content-Type", "multipart/x-mixed-replace; boundary="+replayBoundary)
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       pr,
+		Request:    req,
+	}, nil
+}
+
+// replay writes the frames of the recording as parts at the interval. A
+// recording cut off while being written ends with its last whole frame.
+func replay(ctx context.Context, br *bufio.Reader, w io.Writer, interval time.Duration) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(replayBoundary)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "image/jpeg")
+	for {
+		data, err := nextJPEG(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return mw.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+		part, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = part.Write(data)
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// nextJPEG reads one image of a recording, which is the frames put one
+// after the other. An image ends with an EOI followed by the SOI of the
+// next one or the end of the recording, as embedded thumbnails have EOIs
+// of their own.
+func nextJPEG(br *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF && buf.Len() > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(b)
+
+		data := buf.Bytes()
+		if len(data) < 4 || b != jpegEOI || data[len(data)-2] != 0xff {
+			continue
+		}
+		next, err := br.Peek(2)
+		if len(next) == 0 && err != nil ||
+			len(next) == 2 && next[0] == 0xff && next[1] == jpegSOI {
+			return data, nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image/color"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Recorded frames, compressed or not, are replayed by a file:// source.
+// The recorder is still running, so a compressed file has no trailer yet.
+func TestReplayRecording(t *testing.T) {
+	frames := [][]byte{
+		testJPEG(t, 8, 8, color.White),
+		testJPEG(t, 8, 8, color.Black),
+		testJPEG(t, 16, 8, color.White),
+	}
+	hour := time.Date(2024, 5, 1, 10, 0, 0, 0, time.Local)
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		recorder, err := newFrameRecorder(dir, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, data := range frames {
+			recorder.write("/cam", Frame{Data: data, Captured: hour.Add(time.Duration(i) * time.Second)})
+		}
+
+		name := "cam-20240501-10.mjpeg"
+		if compress {
+			name += ".gz"
+		}
+		chunker, err := NewChunker("/replay", configSource{
+			Source: "file://" + filepath.Join(dir, name) + "?fps=100",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chunker.Connect(); err != nil {
+			t.Fatalf("compress %v: %s", compress, err)
+		}
+		pubChan := make(chan Frame)
+		done := chunker.Start(pubChan)
+		var replayed [][]byte
+		for frame := range pubChan {
+			replayed = append(replayed, frame.Data)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("compress %v: %s", compress, err)
+		}
+		chunker.Stop()
+
+		if len(replayed) != len(frames) {
+			t.Fatalf("compress %v: got %d frames, want %d", compress, len(replayed), len(frames))
+		}
+		for i := range frames {
+			if !bytes.Equal(replayed[i], frames[i]) {
+				t.Errorf("compress %v: frame %d differs", compress, i)
+			}
+		}
+	}
+}
+
+// Images end at an EOI followed by the next SOI, not at the EOI of an
+// embedded thumbnail.
+func TestNextJPEG(t *testing.T) {
+	first := []byte{0xff, 0xd8, 0xff, 0xd8, 0x01, 0xff, 0xd9, 0x02, 0xff, 0xd9}
+	second := []byte{0xff, 0xd8, 0x03, 0xff, 0xd9}
+	br := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), first...), second...)))
+
+	for _, want := range [][]byte{first, second} {
+		data, err := nextJPEG(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("got % x, want % x", data, want)
+		}
+	}
+	if _, err := nextJPEG(br); err == nil {
+		t.Error("no error at the end of the recording")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sampleRetryDelay = 5 * time.Second // subscribe again after a failure
+	sampleTimeFormat = "20060102T150405.000Z"
+)
+
+// configSample enables saving frames of a stream to a directory at a
+// fixed interval, for example to collect a dataset.
+type configSample struct {
+	Dir             string
+	IntervalSeconds float64
+	MaxFiles        int
+	MaxBytes        int64
+}
+
+// frameSampler writes frames taken from an internal subscriber of the
+// stream. As the subscriber stays, the source is followed all the time.
+// Files are named after the stream and the time of the frame, so they
+// sort by age and the oldest are removed once over the limits.
+type frameSampler struct {
+	pubSub   *PubSub
+	dir      string
+	prefix   string
+	interval time.Duration
+	maxFiles int
+	maxBytes int64
+}
+
+func newFrameSampler(pubSub *PubSub, conf configSample) (*frameSampler, error) {
+	err := os.MkdirAll(conf.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := &frameSampler{
+		pubSub:   pubSub,
+		dir:      conf.Dir,
+		prefix:   statName(pubSub.id) + "-",
+		interval: time.Duration(conf.IntervalSeconds * float64(time.Second)),
+		maxFiles: conf.MaxFiles,
+		maxBytes: conf.MaxBytes,
+	}
+	if sampler.interval <= 0 {
+		sampler.interval = 5 * time.Second
+	}
+
+	return sampler, nil
+}
+
+func (sampler *frameSampler) run() {
+	var last time.Time
+	sampler.pubSub.follow("sample", false, sampleRetryDelay, nil, func(frame Frame) bool {
+		if now := time.Now(); now.Sub(last) >= sampler.interval {
+			last = now
+			sampler.write(frame.Data, frame.Captured)
+		}
+		return true
+	})
+}
+
+// write saves the frame under a temporary name first, so readers of the
+// directory never see partial files.
+func (sampler *frameSampler) write(data []byte, now time.Time) {
+	name := sampler.prefix + now.UTC().Format(sampleTimeFormat) + ".jpg"
+	path := filepath.Join(sampler.dir, name)
+
+	err := ioutil.WriteFile(path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logf("sample[%s]: write failed: %s\n", sampler.pubSub.id, err)
+		os.Remove(path + ".tmp")
+		return
+	}
+
+	sampler.expire()
+}
+
+// expire removes the oldest samples of the stream beyond the limits.
+func (sampler *frameSampler) expire() {
+	if sampler.maxFiles <= 0 && sampler.maxBytes <= 0 {
+		return
+	}
+
+	infos, err := ioutil.ReadDir(sampler.dir)
+	if err != nil {
+		logf("sample[%s]: %s\n", sampler.pubSub.id, err)
+		return
+	}
+
+	var samples []os.FileInfo
+	var total int64
+	for _, info := range infos {
+		// the length check skips streams sharing the prefix, like a-b for a
+		name := info.Name()
+		if info.Mode().IsRegular() && strings.HasPrefix(name, sampler.prefix) &&
+			strings.HasSuffix(name, ".jpg") &&
+			len(name) == len(sampler.prefix)+len(sampleTimeFormat)+len(".jpg") {
+			samples = append(samples, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Name() < samples[j].Name()
+	})
+
+	for len(samples) > 0 &&
+		(sampler.maxFiles > 0 && len(samples) > sampler.maxFiles ||
+			sampler.maxBytes > 0 && total > sampler.maxBytes) {
+		err := os.Remove(filepath.Join(sampler.dir, samples[0].Name()))
+		if err != nil {
+			logf("sample[%s]: %s\n", sampler.pubSub.id, err)
+			return
+		}
+		total -= samples[0].Size()
+		samples = samples[1:]
+	}
+}
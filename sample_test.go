@@ -0,0 +1,64 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Samples are named by the frame time and the oldest ones of the stream
+// are removed beyond the limits, leaving other files alone.
+func TestSampleExpire(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	others := []string{"cam-b-20260101T000000.000Z.jpg", "cam-notes.txt"}
+
+	tests := []struct {
+		conf configSample
+		keep []string
+	}{
+		{configSample{MaxFiles: 2}, []string{"cam-20260101T000003.000Z.jpg", "cam-20260101T000004.000Z.jpg"}},
+		{configSample{MaxBytes: 35}, []string{"cam-20260101T000002.000Z.jpg", "cam-20260101T000003.000Z.jpg",
+			"cam-20260101T000004.000Z.jpg"}},
+	}
+	for _, test := range tests {
+		test.conf.Dir = t.TempDir()
+		for _, name := range others {
+			if err := ioutil.WriteFile(filepath.Join(test.conf.Dir, name), []byte("other"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sampler, err := newFrameSampler(newTestPubSub(t, "/cam", configSource{}), test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			sampler.write([]byte("0123456789"), start.Add(time.Duration(i)*time.Second))
+		}
+
+		want := append(test.keep, others...)
+		if got := listDir(t, test.conf.Dir); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%+v: got %v, want %v", test.conf, got, want)
+		}
+	}
+}
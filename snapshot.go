@@ -0,0 +1,200 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest time a snapshot request waits for the next frame.
+const snapshotTimeout = 10 * time.Second
+
+// Numbered image names served by the sequence handler, like 0001.jpg.
+var sequencePattern = regexp.MustCompile(`^[0-9]+\.jpe?g$`)
+
+var (
+	snapshotRanges = true // answer Range requests naming the frame with If-Range
+	snapshotETags  = true // tag snapshots so pollers can revalidate
+	snapshotShare  = true // transform a frame once for concurrent requests
+)
+
+// serveSnapshot responds with the next frame of the stream as a single
+// image. The source is connected if needed and kept for stopDelay, so
+// repeated requests do not reconnect each time.
+//
+// Byte ranges are only served for the frame named by If-Range. As every
+// request gets the next frame, a Range without If-Range is ignored and
+// answered with the whole frame and 200, even where a static file would
+// get 416 for an unsatisfiable range, so ranges of different frames are
+// never joined by the client.
+func (pubSub *PubSub) serveSnapshot(w http.ResponseWriter, r *http.Request, opts outputOptions) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+		pubSub.httpError(w, r, errorMethod, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if memoryExceeded() {
+		http.Error(w, "Server busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	release, ok := pubSub.limitUser(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// like streams, snapshots can be requested in grayscale if allowed
+	if pubSub.grayQuery && r.FormValue("gray") == "1" {
+		opts.gray = true
+	}
+
+	sub := NewSubscriber(clientAddress(r))
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	setupDone(r)
+
+	timer := time.NewTimer(snapshotTimeout)
+	defer timer.Stop()
+
+	if !waitAdmitted(w, r, sub, timer) {
+		return
+	}
+
+	var data []byte
+	select {
+	case frame, ok := <-sub.ChunkChannel:
+		if !ok {
+			pubSub.httpError(w, r, errorStreamFailed, "Stream failed", http.StatusServiceUnavailable)
+			return
+		}
+		defer memoryRelease(len(frame.Data))
+		data = frame.Data
+	case <-timer.C:
+		pubSub.httpError(w, r, errorStreamIdle, "Stream idle timeout", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	data = pubSub.snapshotTransform(opts, data)
+
+	header := w.Header()
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	header.Set("Pragma", "no-cache")
+	header.Set("Expires", "0")
+	if snapshotETags || snapshotRanges {
+		etag := frameETag(data)
+		header.Set("ETag", etag)
+		if snapshotETags && etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if !snapshotRanges {
+		header.Set("Accept-Ranges", "none")
+		header.Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(data)
+		}
+		return
+	}
+
+	// ServeContent checks If-Range against the ETag and answers the full
+	// frame if it changed, revalidation is left to the ETag option
+	r = r.Clone(r.Context())
+	if r.Header.Get("If-Range") == "" {
+		r.Header.Del("Range")
+	}
+	if !snapshotETags {
+		r.Header.Del("If-None-Match")
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// snapshotTransform transforms a snapshot frame, sharing the result with
+// the streams and other snapshots of the same frame and options.
+func (pubSub *PubSub) snapshotTransform(opts outputOptions, data []byte) []byte {
+	if !snapshotShare {
+		return opts.transform(pubSub.id, data)
+	}
+	return pubSub.outputs.get(pubSub.id, opts, data)
+}
+
+// waitAdmitted waits for the subscription of a request reading only a few
+// frames, answering the request itself if it was not admitted in time.
+func waitAdmitted(w http.ResponseWriter, r *http.Request, sub *Subscriber, timer *time.Timer) bool {
+	select {
+	case ok := <-sub.admitted:
+		if !ok {
+			http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+		}
+		return ok
+	case <-timer.C:
+		http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+// frameETag returns a strong entity tag based on the frame content, so
+// frames of a static scene encoded the same way share the tag and byte
+// ranges of the frame can be requested with If-Range.
+func frameETag(data []byte) string {
+	h := fnv.New64a()
+	h.Write(data)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// etagMatch reports whether an If-None-Match header lists the tag, using
+// the weak comparison.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sequenceHandler serves the latest frame for any numbered image below
+// its path, emulating recorders that expose frames as an image sequence.
+func (pubSub *PubSub) sequenceHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len(prefix):]
+		if !sequencePattern.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		pubSub.serveSnapshot(w, r, outputOptions{})
+	})
+}
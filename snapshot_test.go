@@ -0,0 +1,285 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSnapshotServer serves snapshots of a stream of the frame.
+func newSnapshotServer(t *testing.T, id string, frame []byte, conf configSource) *httptest.Server {
+	t.Helper()
+
+	source := newTestSource(t, frame, 20*time.Millisecond)
+	conf.Source = source.URL
+	pubSub := newTestStream(t, id, conf)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pubSub.serveSnapshot(w, r, outputOptions{})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getSnapshot(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestSnapshotGrayQuery(t *testing.T) {
+	frame := testJPEG(t, 32, 32, color.RGBA{255, 0, 0, 255})
+
+	for _, allowed := range []bool{false, true} {
+		server := newSnapshotServer(t, "/snapgray", frame, configSource{GrayQuery: allowed})
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/?gray=1", nil)
+		resp, data := getSnapshot(t, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status: got %d", resp.StatusCode)
+		}
+		if isGray(t, data) != allowed {
+			t.Errorf("grayquery %v: got grayscale %v", allowed, !allowed)
+		}
+	}
+}
+
+// Concurrent snapshots of the same frame share one transformation.
+func TestSnapshotShared(t *testing.T) {
+	frame := testJPEG(t, 64, 64, color.RGBA{0, 255, 0, 255})
+	server := newSnapshotServer(t, "/snapshared", frame, configSource{GrayQuery: true})
+	transforms := transformCounter.WithLabelValues("/snapshared", stageOutput, "grayscale")
+	before := metricValue(t, transforms)
+
+	clients := 8
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/?gray=1", nil)
+			getSnapshot(t, req)
+		}()
+	}
+	wg.Wait()
+
+	// the requests may span a few frames, but not one per request
+	if got := metricValue(t, transforms) - before; got >= float64(clients) {
+		t.Errorf("transformations for %d snapshots: got %v", clients, got)
+	}
+}
+
+func snapshotRequest(t *testing.T, url string, header map[string]string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	return req
+}
+
+// Ranges are served for the frame named by If-Range, with 416 if they
+// cannot be satisfied.
+func TestSnapshotRanges(t *testing.T) {
+	frame := testJPEG(t, 16, 16, color.White)
+	server := newSnapshotServer(t, "/ranges", frame, configSource{})
+
+	resp, data := getSnapshot(t, snapshotRequest(t, server.URL, nil))
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || len(data) != len(frame) {
+		t.Fatalf("full: got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+	if strings.HasPrefix(etag, "W/") || etag == "" {
+		t.Fatalf("ETag %q is not strong", etag)
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges: got %q", got)
+	}
+
+	// a range of the frame named by If-Range
+	resp, data = getSnapshot(t, snapshotRequest(t, server.URL,
+		map[string]string{"Range": "bytes=0-9", "If-Range": etag}))
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(data, frame[:10]) {
+		t.Errorf("range: got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+
+	// a range of another or an unknown frame gets the whole frame, even
+	// if it could not be satisfied
+	for _, header := range []map[string]string{
+		{"Range": "bytes=0-9"},
+		{"Range": "bytes=100000-"},
+		{"Range": "bytes=0-9", "If-Range": `"0000000000000000"`},
+		{"Range": "bytes=0-9", "If-Range": "W/" + etag},
+	} {
+		resp, data = getSnapshot(t, snapshotRequest(t, server.URL, header))
+		if resp.StatusCode != http.StatusOK || len(data) != len(frame) {
+			t.Errorf("%v: got status %d with %d bytes", header, resp.StatusCode, len(data))
+		}
+	}
+
+	resp, _ = getSnapshot(t, snapshotRequest(t, server.URL,
+		map[string]string{"Range": "bytes=100000-", "If-Range": etag}))
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: got status %d", resp.StatusCode)
+	}
+}
+
+// Polls naming the current frame in If-None-Match get 304 without the
+// image, any other tag gets the frame.
+func TestSnapshotNotModified(t *testing.T) {
+	frame := testJPEG(t, 16, 16, color.White)
+	server := newSnapshotServer(t, "/notmodified", frame, configSource{})
+
+	resp, _ := getSnapshot(t, snapshotRequest(t, server.URL, nil))
+	etag := resp.Header.Get("ETag")
+	if etag != frameETag(frame) {
+		t.Fatalf("ETag: got %q, want %q", etag, frameETag(frame))
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp, data := getSnapshot(t, snapshotRequest(t, server.URL,
+			map[string]string{"If-None-Match": header}))
+		if resp.StatusCode != http.StatusNotModified || len(data) != 0 {
+			t.Errorf("%s: got status %d with %d bytes", header, resp.StatusCode, len(data))
+		}
+		if got := resp.Header.Get("ETag"); got != etag {
+			t.Errorf("%s: ETag %q", header, got)
+		}
+	}
+
+	resp, data := getSnapshot(t, snapshotRequest(t, server.URL,
+		map[string]string{"If-None-Match": frameETag(testJPEG(t, 16, 16, color.Black))}))
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(data, frame) {
+		t.Errorf("changed frame: got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+}
+
+// Without ranges, Range headers are ignored and no ranges are offered.
+func TestSnapshotRangesOff(t *testing.T) {
+	old := snapshotRanges
+	snapshotRanges = false
+	defer func() { snapshotRanges = old }()
+
+	frame := testJPEG(t, 16, 16, color.White)
+	server := newSnapshotServer(t, "/rangesoff", frame, configSource{})
+
+	resp, data := getSnapshot(t, snapshotRequest(t, server.URL,
+		map[string]string{"Range": "bytes=0-9", "If-Range": frameETag(frame)}))
+	if resp.StatusCode != http.StatusOK || len(data) != len(frame) {
+		t.Errorf("got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+	if got := resp.Header.Get("Accept-Ranges"); got != "none" {
+		t.Errorf("Accept-Ranges: got %q", got)
+	}
+}
+
+// Without ETags polls always get the frame, ranges still name it.
+func TestSnapshotWithoutETags(t *testing.T) {
+	old := snapshotETags
+	snapshotETags = false
+	defer func() { snapshotETags = old }()
+
+	frame := testJPEG(t, 16, 16, color.White)
+	server := newSnapshotServer(t, "/noetags", frame, configSource{})
+
+	etag := frameETag(frame)
+	resp, data := getSnapshot(t, snapshotRequest(t, server.URL,
+		map[string]string{"If-None-Match": etag}))
+	if resp.StatusCode != http.StatusOK || len(data) != len(frame) {
+		t.Errorf("revalidation: got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+
+	resp, data = getSnapshot(t, snapshotRequest(t, server.URL,
+		map[string]string{"Range": "bytes=0-9", "If-Range": etag}))
+	if resp.StatusCode != http.StatusPartialContent || len(data) != 10 {
+		t.Errorf("range: got status %d with %d bytes", resp.StatusCode, len(data))
+	}
+}
+
+// Every numbered image of the sequence is a fresh frame, whatever the
+// number, and other names below the path are not found.
+func TestSequenceFreshFrames(t *testing.T) {
+	var frames int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=B")
+		for {
+			n := atomic.AddInt32(&frames, 1)
+			_, err := fmt.Fprintf(w, "--B\r\nContent-Type: image/jpeg\r\n\r\nframe %06d\r\n", n)
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer source.Close()
+	defer source.CloseClientConnections()
+	pubSub := newTestStream(t, "/sequence", configSource{Source: source.URL})
+	server := httptest.NewServer(pubSub.sequenceHandler("/seq/"))
+	defer server.Close()
+
+	var last string
+	for _, name := range []string{"0001.jpg", "0002.jpg", "0001.jpeg"} {
+		resp, data := getSnapshot(t, snapshotRequest(t, server.URL+"/seq/"+name, nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", name, resp.StatusCode)
+		}
+		if !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+			t.Errorf("%s: cacheable: %q", name, resp.Header.Get("Cache-Control"))
+		}
+		if string(data) <= last {
+			t.Errorf("%s: got %q after %q", name, data, last)
+		}
+		last = string(data)
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	for _, name := range []string{"", "latest.jpg", "0001.png", "01/02.jpg"} {
+		resp, _ := getSnapshot(t, snapshotRequest(t, server.URL+"/seq/"+name, nil))
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%q: got status %d", name, resp.StatusCode)
+		}
+	}
+}
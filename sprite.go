@@ -0,0 +1,225 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	spritePath      string // serves <path>.jpg and <path>.json, disabled if empty
+	spriteTileWidth int
+)
+
+// spriteTile is the place of a stream on the sprite sheet. Tiles keep the
+// aspect ratio of the frame, centered in their cell.
+type spriteTile struct {
+	Stream    string    `json:"stream"`
+	X         int       `json:"x"`
+	Y         int       `json:"y"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Available bool      `json:"available"`
+	Captured  time.Time `json:"captured,omitzero"`
+}
+
+type spriteLayout struct {
+	Generation string       `json:"generation"`
+	Columns    int          `json:"columns"`
+	Rows       int          `json:"rows"`
+	CellWidth  int          `json:"cell_width"`
+	CellHeight int          `json:"cell_height"`
+	Tiles      []spriteTile `json:"tiles"`
+
+	frames [][]byte
+}
+
+// spriteCache keeps the last composited sheet, so it is made once for
+// each generation of the latest frames however many clients poll it.
+var spriteCache struct {
+	sync.Mutex
+	generation string
+	data       []byte
+}
+
+// spriteStreams returns the streams selected by the streams query, in
+// order, or all streams. Streams with users are left out, as the sheet is
+// served without their credentials.
+func spriteStreams(r *http.Request) []*PubSub {
+	streams := pubSubs
+	if query := r.FormValue("streams"); query != "" {
+		streams = nil
+		for _, id := range strings.Split(query, ",") {
+			if pubSub := findPubSub(id); pubSub != nil {
+				streams = append(streams, pubSub)
+			}
+		}
+	}
+
+	public := make([]*PubSub, 0, len(streams))
+	for _, pubSub := range streams {
+		if len(pubSub.users) == 0 && len(public) < contactSheetMaxTiles {
+			public = append(public, pubSub)
+		}
+	}
+	return public
+}
+
+// newSpriteLayout places the latest frames of the streams on a grid of
+// cells with a 4:3 aspect ratio. Streams without a current frame, as they
+// are not connected, get an empty cell.
+func newSpriteLayout(streams []*PubSub) *spriteLayout {
+	layout := &spriteLayout{
+		Columns:    int(math.Ceil(math.Sqrt(float64(len(streams))))),
+		CellWidth:  spriteTileWidth,
+		CellHeight: spriteTileWidth * 3 / 4,
+		Tiles:      make([]spriteTile, len(streams)),
+		frames:     make([][]byte, len(streams)),
+	}
+	if layout.Columns > 0 {
+		layout.Rows = (len(streams) + layout.Columns - 1) / layout.Columns
+	}
+
+	h := fnv.New64a()
+	for i, pubSub := range streams {
+		tile := spriteTile{
+			Stream: pubSub.id,
+			X:      i % layout.Columns * layout.CellWidth,
+			Y:      i / layout.Columns * layout.CellHeight,
+		}
+
+		frame, sequence := pubSub.LatestFrame()
+		fmt.Fprintf(h, "%s %d %d\n", pubSub.id, sequence, frame.Captured.UnixNano())
+		width, height, _, ok := jpegDimensions(frame.Data)
+		if ok && width > 0 && height > 0 {
+			tile.Available = true
+			tile.Captured = frame.Captured
+			tile.Width, tile.Height = layout.CellWidth, height*layout.CellWidth/width
+			if tile.Height > layout.CellHeight {
+				tile.Width, tile.Height = width*layout.CellHeight/height, layout.CellHeight
+			}
+			tile.X += (layout.CellWidth - tile.Width) / 2
+			tile.Y += (layout.CellHeight - tile.Height) / 2
+			layout.frames[i] = frame.Data
+		}
+		layout.Tiles[i] = tile
+	}
+	fmt.Fprintf(h, "%d", layout.CellWidth)
+	layout.Generation = fmt.Sprintf("%016x", h.Sum64())
+
+	return layout
+}
+
+// cachedComposite returns the sheet of the layout, compositing it only if
+// the last sheet was made of other frames.
+func (layout *spriteLayout) cachedComposite() ([]byte, error) {
+	spriteCache.Lock()
+	defer spriteCache.Unlock()
+
+	if spriteCache.data != nil && spriteCache.generation == layout.Generation {
+		return spriteCache.data, nil
+	}
+	data, err := layout.composite()
+	if err != nil {
+		return nil, err
+	}
+	spriteCache.generation, spriteCache.data = layout.Generation, data
+	return data, nil
+}
+
+// composite draws the frames into their tiles.
+func (layout *spriteLayout) composite() ([]byte, error) {
+	out := image.NewRGBA(image.Rect(0, 0, layout.Columns*layout.CellWidth, layout.Rows*layout.CellHeight))
+	for i, tile := range layout.Tiles {
+		if !tile.Available || tile.Width < 1 || tile.Height < 1 {
+			continue
+		}
+		img, err := decodeJPEG(layout.frames[i])
+		if err != nil {
+			continue // leave the tile empty
+		}
+
+		scaled := scaleImage(img, tile.Width, tile.Height)
+		draw.Draw(out, image.Rect(tile.X, tile.Y, tile.X+tile.Width, tile.Y+tile.Height),
+			scaled, image.Point{}, draw.Src)
+	}
+
+	return encodeJPEG(out)
+}
+
+// spriteEndpoint serves the sprite sheet of the latest frames of all
+// streams as <path>.jpg and the place of each stream on it as <path>.json,
+// so overview pages need two requests instead of one per stream. Frames
+// may change between the two, so the sheet also carries its own layout in
+// the X-Sprite-Layout header, and both name their generation of frames.
+func spriteEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", fmt.Sprintf("%s, %s", http.MethodGet, http.MethodHead))
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	layout := newSpriteLayout(spriteStreams(r))
+	setupDone(r)
+	if len(layout.Tiles) == 0 {
+		http.Error(w, "No streams", http.StatusNotFound)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		header.Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(layout)
+		return
+	}
+
+	tiles, err := json.Marshal(layout)
+	if err != nil {
+		http.Error(w, "Sprite sheet failed", http.StatusInternalServerError)
+		return
+	}
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("X-Sprite-Generation", layout.Generation)
+	header.Set("X-Sprite-Layout", string(tiles))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	data, err := layout.cachedComposite()
+	if err != nil {
+		logf("server: sprite sheet failed: %s\n", err)
+		http.Error(w, "Sprite sheet failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,196 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newFrameStream returns a running stream holding the frame as its latest,
+// without a source.
+func newFrameStream(t *testing.T, id string, frame []byte, conf configSource) *PubSub {
+	t.Helper()
+
+	pubSub := newTestPubSub(t, id, conf)
+	if frame != nil {
+		pubSub.lastFrame = Frame{Data: frame, Captured: time.Now()}
+		pubSub.framesPublished = 1
+	}
+	pubSub.Start()
+	return pubSub
+}
+
+func setupSprite(t *testing.T) {
+	oldPath, oldWidth := spritePath, spriteTileWidth
+	spritePath, spriteTileWidth = "/sprite", 160
+	t.Cleanup(func() { spritePath, spriteTileWidth = oldPath, oldWidth })
+
+	spriteCache.Lock()
+	spriteCache.generation, spriteCache.data = "", nil
+	spriteCache.Unlock()
+}
+
+func TestSpriteSheet(t *testing.T) {
+	setupSprite(t)
+	setStreams(t,
+		newFrameStream(t, "/wide", testJPEG(t, 320, 120, color.RGBA{255, 0, 0, 255}), configSource{}),
+		newFrameStream(t, "/tall", testJPEG(t, 60, 120, color.RGBA{0, 0, 255, 255}), configSource{}),
+		newFrameStream(t, "/offline", nil, configSource{}),
+		newFrameStream(t, "/private", testJPEG(t, 32, 32, color.White),
+			configSource{Users: map[string]string{"user": "secret"}}),
+	)
+	server := httptest.NewServer(http.HandlerFunc(spriteEndpoint))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/sprite.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var layout spriteLayout
+	err = json.NewDecoder(resp.Body).Decode(&layout)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if layout.Columns != 2 || layout.Rows != 2 || len(layout.Tiles) != 3 {
+		t.Fatalf("grid: got %dx%d with %d tiles, want 2x2 with 3", layout.Columns, layout.Rows, len(layout.Tiles))
+	}
+	wide, tall, offline := layout.Tiles[0], layout.Tiles[1], layout.Tiles[2]
+	if !wide.Available || wide.Width != 160 || wide.Height != 60 || wide.Y != 30 {
+		t.Errorf("wide tile: got %+v", wide)
+	}
+	if !tall.Available || tall.Height != 120 || tall.Width != 60 || tall.X != 160+50 {
+		t.Errorf("tall tile: got %+v", tall)
+	}
+	if offline.Available {
+		t.Errorf("offline tile: got %+v", offline)
+	}
+
+	resp, err = http.Get(server.URL + "/sprite.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	width, height, _, ok := jpegDimensions(data)
+	if !ok || width != 320 || height != 240 {
+		t.Errorf("sheet size: got %dx%d, want 320x240", width, height)
+	}
+
+	// the sheet carries the layout it was made with
+	var sheetLayout spriteLayout
+	if err := json.Unmarshal([]byte(resp.Header.Get("X-Sprite-Layout")), &sheetLayout); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sheetLayout, layout) {
+		t.Errorf("sheet layout %+v differs from %+v", sheetLayout, layout)
+	}
+	if got := resp.Header.Get("X-Sprite-Generation"); got != layout.Generation {
+		t.Errorf("generation: got %q, want %q", got, layout.Generation)
+	}
+}
+
+func TestSpriteCached(t *testing.T) {
+	setupSprite(t)
+	setStreams(t, newFrameStream(t, "/cached", testJPEG(t, 64, 48, color.White), configSource{}))
+	req := httptest.NewRequest(http.MethodGet, "/sprite.jpg", nil)
+
+	first, err := newSpriteLayout(spriteStreams(req)).cachedComposite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newSpriteLayout(spriteStreams(req)).cachedComposite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &first[0] != &second[0] {
+		t.Error("sheet composited again for the same frames")
+	}
+}
+
+func TestSpriteHead(t *testing.T) {
+	setupSprite(t)
+	setStreams(t, newFrameStream(t, "/head", testJPEG(t, 64, 48, color.White), configSource{}))
+
+	rec := httptest.NewRecorder()
+	spriteEndpoint(rec, httptest.NewRequest(http.MethodHead, "/sprite.jpg", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Sprite-Layout") == "" {
+		t.Errorf("head: got status %d, headers %v", rec.Code, rec.Header())
+	}
+
+	spriteCache.Lock()
+	composited := spriteCache.data != nil
+	spriteCache.Unlock()
+	if composited {
+		t.Error("sheet composited for HEAD")
+	}
+}
+
+// Every tile of the sheet shows the frame of its own stream.
+func TestSpriteTilesShowStreams(t *testing.T) {
+	setupSprite(t)
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+	var streams []*PubSub
+	for i, c := range colors {
+		streams = append(streams, newFrameStream(t, fmt.Sprintf("/tile%d", i), testJPEG(t, 64, 48, c), configSource{}))
+	}
+	setStreams(t, streams...)
+
+	rec := httptest.NewRecorder()
+	spriteEndpoint(rec, httptest.NewRequest(http.MethodGet, "/sprite.jpg", nil))
+	var layout spriteLayout
+	if err := json.Unmarshal([]byte(rec.Header().Get("X-Sprite-Layout")), &layout); err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := decodeJPEG(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Tiles) != len(colors) {
+		t.Fatalf("got %d tiles, want %d", len(layout.Tiles), len(colors))
+	}
+
+	for i, tile := range layout.Tiles {
+		if tile.Stream != streams[i].id {
+			t.Errorf("tile %d: stream %s, want %s", i, tile.Stream, streams[i].id)
+		}
+		r, g, b, _ := sheet.At(tile.X+tile.Width/2, tile.Y+tile.Height/2).RGBA()
+		want := colors[i]
+		if colorDiff(r>>8, want.R) > 32 || colorDiff(g>>8, want.G) > 32 || colorDiff(b>>8, want.B) > 32 {
+			t.Errorf("tile %d: center %d,%d,%d, want %v", i, r>>8, g>>8, b>>8, want)
+		}
+	}
+}
+
+func colorDiff(a uint32, b uint8) uint32 {
+	if a > uint32(b) {
+		return a - uint32(b)
+	}
+	return uint32(b) - a
+}
@@ -0,0 +1,133 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrent clients of the same options transform each frame once.
+func TestOutputCacheShared(t *testing.T) {
+	var cache outputCache
+	frame := testJPEG(t, 64, 48, color.RGBA{200, 100, 50, 255})
+	opts := outputOptions{scale: 0.5}
+	transforms := transformCounter.WithLabelValues("/shared", stageOutput, "scale")
+	before := metricValue(t, transforms)
+
+	results := make([][]byte, 8)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cache.get("/shared", opts, frame)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := metricValue(t, transforms) - before; got != 1 {
+		t.Errorf("transformations: got %v, want 1", got)
+	}
+	for i := range results {
+		if !bytes.Equal(results[i], results[0]) {
+			t.Fatalf("client %d got a different frame", i)
+		}
+	}
+	width, height, _, _ := jpegDimensions(results[0])
+	if width != 32 || height != 24 {
+		t.Errorf("size: got %dx%d, want 32x24", width, height)
+	}
+
+	// the rate does not change the frames, so it shares the output too
+	cache.get("/shared", outputOptions{scale: 0.5, rate: 2}, frame)
+	if got := metricValue(t, transforms) - before; got != 1 {
+		t.Errorf("transformations with another rate: got %v, want 1", got)
+	}
+}
+
+func TestOutputCacheIdentity(t *testing.T) {
+	var cache outputCache
+	frame := []byte("not a jpeg")
+	if got := cache.get("/identity", outputOptions{rate: 1, scale: 1}, frame); &got[0] != &frame[0] {
+		t.Error("identity options copied the frame")
+	}
+}
+
+// Clients of the same rate pick the same frames, so a thumbnail handler
+// transforms each frame it sends once whatever the number of clients.
+func TestFrameSlot(t *testing.T) {
+	interval := time.Second
+	base := time.Unix(1000, 0)
+	if frameSlot(base.Add(990*time.Millisecond), interval) != frameSlot(base, interval) {
+		t.Error("frames within an interval in different slots")
+	}
+	if frameSlot(base.Add(time.Second), interval) != frameSlot(base, interval)+1 {
+		t.Error("frames an interval apart in the same slot")
+	}
+	if frameSlot(base, 0) != 0 {
+		t.Error("unlimited rate has slots")
+	}
+}
+
+func TestThumbnailStream(t *testing.T) {
+	frame := testJPEG(t, 64, 48, color.RGBA{10, 200, 10, 255})
+	source := newTestSource(t, frame, 20*time.Millisecond)
+	pubSub := newTestStream(t, "/thumbstream", configSource{Source: source.URL})
+	server := httptest.NewServer(pubSub.handler(outputOptions{rate: 10, scale: 0.25}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(part)
+		width, height, _, _ := jpegDimensions(buf.Bytes())
+		if width != 16 || height != 12 {
+			t.Errorf("thumbnail size: got %dx%d, want 16x12", width, height)
+		}
+		if i > 1 && time.Since(last) < 50*time.Millisecond {
+			t.Errorf("thumbnail frames %s apart at 10 fps", time.Since(last))
+		}
+		last = time.Now()
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	tlsCertFile  string
+	tlsKeyFile   string
+	tlsClientCAs map[string]string // CA file by listener address
+)
+
+// certHolder keeps the serving certificate so it can be replaced without
+// restarting the server. New connections use the current certificate while
+// established ones keep streaming.
+type certHolder struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertHolder(certFile, keyFile string) (*certHolder, error) {
+	holder := &certHolder{certFile: certFile, keyFile: keyFile}
+	err := holder.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return holder, nil
+}
+
+func (holder *certHolder) reload() error {
+	cert, err := tls.LoadX509KeyPair(holder.certFile, holder.keyFile)
+	if err != nil {
+		return err
+	}
+
+	holder.mu.Lock()
+	holder.cert = &cert
+	holder.mu.Unlock()
+	return nil
+}
+
+func (holder *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	holder.mu.RLock()
+	defer holder.mu.RUnlock()
+	return holder.cert, nil
+}
+
+// reloadOnSignal loads the certificate again on SIGHUP, keeping the old
+// one if the new files cannot be used.
+func (holder *certHolder) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			err := holder.reload()
+			if err != nil {
+				logf("tls: reload failed, keeping old certificate: %s\n", err)
+				continue
+			}
+			logf("tls: certificate reloaded from %s\n", holder.certFile)
+		}
+	}()
+}
+
+// parseClientCAs parses comma separated address=file pairs, giving the CA
+// that clients of each listener must present a certificate signed by.
+func parseClientCAs(value string, addrs []string) (map[string]string, error) {
+	cas := make(map[string]string)
+	if value == "" {
+		return cas, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid client CA %q, expected address=file", entry)
+		}
+		addr, file := entry[:i], entry[i+1:]
+		found := false
+		for _, a := range addrs {
+			found = found || a == addr
+		}
+		if !found {
+			return nil, fmt.Errorf("client CA for %s, which is not a bind address", addr)
+		}
+		cas[addr] = file
+	}
+
+	return cas, nil
+}
+
+func tlsConfig(clientCAFile string) (*tls.Config, error) {
+	holder, err := newCertHolder(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	holder.reloadOnSignal()
+
+	config := &tls.Config{GetCertificate: holder.getCertificate}
+
+	// only let clients with a certificate signed by the CA connect
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// clientIdentity returns the subject of the verified client certificate,
+// or an empty string if the client did not present one.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
@@ -0,0 +1,244 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	certFile := filepath.Join(dir, c.cert.Subject.CommonName+".crt")
+	keyFile := filepath.Join(dir, c.cert.Subject.CommonName+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveTLS serves the client identity over HTTPS with the client CA.
+func serveTLS(t *testing.T, clientCAFile string) string {
+	t.Helper()
+
+	config, err := tlsConfig(clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(clientIdentity(r)))
+		}),
+		TLSConfig: config,
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	other := newTestCert(t, "other", nil)
+	caFile, _ := ca.write(t, dir)
+
+	oldCert, oldKey := tlsCertFile, tlsKeyFile
+	tlsCertFile, tlsKeyFile = newTestCert(t, "server", ca).write(t, dir)
+	defer func() { tlsCertFile, tlsKeyFile = oldCert, oldKey }()
+
+	// only the listener configured with the CA asks for certificates
+	mtls := serveTLS(t, caFile)
+	open := serveTLS(t, "")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(url string, client *testCert) (string, error) {
+		config := &tls.Config{RootCAs: roots}
+		if client != nil {
+			config.Certificates = []tls.Certificate{client.tlsCertificate()}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := c.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if identity, err := get(mtls, newTestCert(t, "camera", ca)); err != nil {
+		t.Errorf("valid certificate: %s", err)
+	} else if identity != "CN=camera" {
+		t.Errorf("identity: got %q", identity)
+	}
+	if _, err := get(mtls, nil); err == nil {
+		t.Error("connected without a certificate")
+	}
+	if _, err := get(mtls, newTestCert(t, "intruder", other)); err == nil {
+		t.Error("connected with a certificate of another CA")
+	}
+	if _, err := get(open, nil); err != nil {
+		t.Errorf("listener without client CA: %s", err)
+	}
+}
+
+func TestParseClientCAs(t *testing.T) {
+	addrs := []string{":8080", "[::1]:8443"}
+	cas, err := parseClientCAs("[::1]:8443=/etc/ca.pem", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cas["[::1]:8443"] != "/etc/ca.pem" || cas[":8080"] != "" {
+		t.Errorf("got %v", cas)
+	}
+
+	for _, value := range []string{"/etc/ca.pem", ":9090=/etc/ca.pem", ":8080="} {
+		if _, err := parseClientCAs(value, addrs); err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+}
+
+// SIGHUP loads a renewed certificate, and a broken one keeps the old.
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "server", ca)
+	certFile, keyFile := first.write(t, dir)
+
+	holder, err := newCertHolder(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder.reloadOnSignal()
+	serving := func() []byte {
+		cert, _ := holder.getCertificate(nil)
+		return cert.Certificate[0]
+	}
+	if !bytes.Equal(serving(), first.der) {
+		t.Fatal("not serving the loaded certificate")
+	}
+
+	renewed := newTestCert(t, "server", ca)
+	renewedCert, renewedKey := renewed.write(t, t.TempDir())
+	if err := os.Rename(renewedCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(renewedKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(serving(), renewed.der) {
+		if time.Now().After(deadline) {
+			t.Fatal("renewed certificate not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.reload(); err == nil {
+		t.Error("no error for a broken certificate")
+	}
+	if !bytes.Equal(serving(), renewed.der) {
+		t.Error("broken certificate replaced the working one")
+	}
+}
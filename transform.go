@@ -0,0 +1,152 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// JPEG quality used when frames need to be re-encoded.
+const transformQuality = 85
+
+func decodeJPEG(data []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: transformQuality})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok {
+		return rgba
+	}
+
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// scaleImage resizes the image to the given size using a box filter,
+// averaging all source pixels covered by each destination pixel.
+func scaleImage(src image.Image, width, height int) image.Image {
+	in := toRGBA(src)
+	sw, sh := in.Bounds().Dx(), in.Bounds().Dy()
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				i := in.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(in.Pix[i])
+					g += int(in.Pix[i+1])
+					b += int(in.Pix[i+2])
+					a += int(in.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+
+			o := out.PixOffset(x, y)
+			out.Pix[o] = uint8(r / n)
+			out.Pix[o+1] = uint8(g / n)
+			out.Pix[o+2] = uint8(b / n)
+			out.Pix[o+3] = uint8(a / n)
+		}
+	}
+
+	return out
+}
+
+func scaleImageBy(img image.Image, scale float64) image.Image {
+	b := img.Bounds()
+	width := int(float64(b.Dx())*scale + 0.5)
+	height := int(float64(b.Dy())*scale + 0.5)
+	return scaleImage(img, width, height)
+}
+
+func scaleJPEG(data []byte, scale float64) ([]byte, error) {
+	img, err := decodeJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeJPEG(scaleImageBy(img, scale))
+}
+
+func toGray(src image.Image) *image.Gray {
+	if gray, ok := src.(*image.Gray); ok {
+		return gray
+	}
+
+	b := src.Bounds()
+	dst := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// limitSize returns the size fitting within the limits with the same
+// aspect ratio, reporting whether it differs from the given size.
+func limitSize(width, height, maxWidth, maxHeight int) (int, int, bool) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		if s := float64(maxHeight) / float64(height); s < scale {
+			scale = s
+		}
+	}
+	if scale == 1 {
+		return width, height, false
+	}
+
+	// round down so the result never exceeds the limit
+	return int(float64(width) * scale), int(float64(height) * scale), true
+}
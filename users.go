@@ -0,0 +1,196 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Realm of the stream users unless configured otherwise.
+const defaultRealm = "mjpeg-proxy"
+
+var (
+	userHeader        string       // header with the user set by an authenticating proxy
+	trustedProxies    []*net.IPNet // proxies allowed to set the user header
+	maxStreamsPerUser int
+	userStreams       = &userLimiter{streams: make(map[string]int)}
+)
+
+type userKey struct{}
+
+// authenticate requires the Basic credentials of one of the users of the
+// stream, if it has any, keeping the user in the request context.
+func (pubSub *PubSub) authenticate(handler http.Handler) http.Handler {
+	if len(pubSub.users) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		expected, known := pubSub.users[user]
+		passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+		if !ok || !known || !passwordOk {
+			w.Header().Set("WWW-Authenticate", "Basic realm="+quoteRealm(pubSub.realm)+`, charset="UTF-8"`)
+			pubSub.httpError(w, r, errorUnauthorized, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey{}, user)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// quoteRealm makes the realm a quoted string for the authentication
+// header, escaping quotes and backslashes and dropping control characters.
+func quoteRealm(realm string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range realm {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' || r == 0x7f:
+			continue
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// requestUser returns the user a request was authenticated as, by the
+// stream users, a client certificate or a proxy in front of the server.
+func requestUser(r *http.Request) string {
+	if user, ok := r.Context().Value(userKey{}).(string); ok {
+		return user
+	}
+	if identity := clientIdentity(r); identity != "" {
+		return identity
+	}
+	if userHeader != "" && fromTrustedProxy(r) {
+		return r.Header.Get(userHeader)
+	}
+	return ""
+}
+
+// parseTrustedProxies parses a comma separated list of addresses and
+// networks in CIDR notation.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// fromTrustedProxy reports whether the request was sent by one of the
+// proxies allowed to set the user header.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return trustedProxy(net.ParseIP(host))
+}
+
+func trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitUser counts the request against the streams of its user for
+// -maxstreamsperuser. It answers the request and returns false if the
+// user has too many open, otherwise release must be called when done.
+func (pubSub *PubSub) limitUser(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	user := requestUser(r)
+	if user == "" || maxStreamsPerUser <= 0 {
+		return func() {}, true
+	}
+
+	if !userStreams.acquire(user) {
+		logf("server[%s]: too many streams for %s, rejecting client %s\n",
+			pubSub.id, user, clientAddress(r))
+		http.Error(w, "Too many streams", http.StatusTooManyRequests)
+		return nil, false
+	}
+	return func() { userStreams.release(user) }, true
+}
+
+// userLimiter counts the streams each user has open over all sources.
+type userLimiter struct {
+	mu      sync.Mutex
+	streams map[string]int
+}
+
+func (l *userLimiter) acquire(user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.streams[user] >= maxStreamsPerUser {
+		return false
+	}
+	l.streams[user]++
+	return true
+}
+
+func (l *userLimiter) release(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.streams[user]--
+	if l.streams[user] <= 0 {
+		delete(l.streams, user)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setUserHeader trusts the user header from the default address of
+// httptest requests.
+func setUserHeader(t *testing.T, header string, proxies string) {
+	t.Helper()
+
+	oldHeader, oldProxies := userHeader, trustedProxies
+	networks, err := parseTrustedProxies(proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userHeader, trustedProxies = header, networks
+	t.Cleanup(func() { userHeader, trustedProxies = oldHeader, oldProxies })
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 {
+		t.Fatalf("networks: got %d, want 3", len(networks))
+	}
+
+	for _, list := range []string{"proxy", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("%q: no error", list)
+		}
+	}
+}
+
+func TestUserHeaderFromTrustedProxy(t *testing.T) {
+	setUserHeader(t, "X-User", "192.0.2.1, 10.1.0.0/16")
+
+	tests := []struct {
+		remote string
+		user   string
+	}{
+		{"192.0.2.1:1234", "alice"},
+		{"10.1.2.3:1234", "alice"},
+		{"192.0.2.2:1234", ""},
+		{"[::1]:1234", ""},
+		{"@", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		r.Header.Set("X-User", "alice")
+		if user := requestUser(r); user != test.user {
+			t.Errorf("from %s: got user %q, want %q", test.remote, user, test.user)
+		}
+	}
+}
+
+// Every handler subscribing to the stream counts against the user limit.
+func TestMaxStreamsPerUserHandlers(t *testing.T) {
+	setUserHeader(t, "X-User", "192.0.2.1")
+	oldMax := maxStreamsPerUser
+	maxStreamsPerUser = 1
+	defer func() { maxStreamsPerUser = oldMax }()
+
+	// the user has a stream open already
+	if !userStreams.acquire("alice") {
+		t.Fatal("first stream not allowed")
+	}
+	defer userStreams.release("alice")
+
+	pubSub := newTestPubSub(t, "/peruser", configSource{})
+	handlers := map[string]http.Handler{
+		"/peruser":                    pubSub,
+		"/peruser.jpg":                http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { pubSub.serveSnapshot(w, r, outputOptions{}) }),
+		"/peruser.gif":                http.HandlerFunc(pubSub.serveGIF),
+		"/peruser/metadata":           pubSub.metadataHandler(newMetadataHub()),
+		"/peruser/hls/" + hlsPlaylist: newHLSStream(pubSub, "/peruser/hls/", configHLS{}),
+		"/peruser/sheet":              newContactSheet(pubSub, configContactSheet{Path: "/peruser/sheet"}),
+	}
+	for path, handler := range handlers {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-User", "alice")
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, http.StatusTooManyRequests)
+		}
+	}
+
+	// rejected requests do not hold a stream of the user
+	userStreams.mu.Lock()
+	open := userStreams.streams["alice"]
+	userStreams.mu.Unlock()
+	if open != 1 {
+		t.Errorf("open streams: got %d, want 1", open)
+	}
+}
+
+// The 401 challenge names the configured realm as a safe quoted string.
+func TestAuthRealm(t *testing.T) {
+	tests := []struct {
+		realm string
+		want  string
+	}{
+		{"", `Basic realm="` + defaultRealm + `", charset="UTF-8"`},
+		{"Front door", `Basic realm="Front door", charset="UTF-8"`},
+		{`Cam "1" \ yard`, `Basic realm="Cam \"1\" \\ yard", charset="UTF-8"`},
+		{"Cam\r\nX-Injected: 1", `Basic realm="CamX-Injected: 1", charset="UTF-8"`},
+	}
+	for _, test := range tests {
+		pubSub := newTestPubSub(t, "/realm", configSource{
+			Users: map[string]string{"alice": "secret"}, Realm: test.realm,
+		})
+		handler := pubSub.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/realm", nil)
+		req.SetBasicAuth("alice", "wrong")
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: got status %d", test.realm, w.Code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.realm, got, test.want)
+		}
+	}
+}
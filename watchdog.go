@@ -0,0 +1,120 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+var (
+	watchdogTimeout    time.Duration // longest time a stream loop may not answer
+	watchdogGoroutines int           // most goroutines before the state is considered broken
+	watchdogExit       = os.Exit
+)
+
+// watchStreams exits the process once the loop of a stream did not answer
+// for the whole timeout, or once goroutines leaked beyond the limit, for
+// a supervisor like systemd to start it again. Sources being offline are
+// left to the reconnects, loops connect in the background so they keep
+// answering, and streams without frames are never a reason to exit.
+func watchStreams(timeout time.Duration) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !watchCheck(timeout) {
+			return
+		}
+	}
+}
+
+// watchCheck checks the streams and goroutines once, returning false if
+// the process is exiting.
+func watchCheck(timeout time.Duration) bool {
+	for _, pubSub := range pubSubs {
+		if _, ok := watchStatus(pubSub, timeout); !ok {
+			watchdogFail("stream %s did not answer for %s\n", pubSub.id, timeout)
+			return false
+		}
+	}
+
+	if goroutines := runtime.NumGoroutine(); watchdogGoroutines > 0 && goroutines > watchdogGoroutines {
+		watchdogFail("%d goroutines running, limit is %d\n", goroutines, watchdogGoroutines)
+		return false
+	}
+	return true
+}
+
+// watchStatus returns the status of the stream, unless its loop does not
+// answer in time.
+func watchStatus(pubSub *PubSub, timeout time.Duration) (StreamStatus, bool) {
+	reply := make(chan StreamStatus, 1)
+	go func() {
+		reply <- pubSub.Status()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case status := <-reply:
+		return status, true
+	case <-timer.C:
+		return StreamStatus{}, false
+	}
+}
+
+// watchdogFail logs the reason with the state of all streams and the
+// goroutines before exiting.
+func watchdogFail(format string, args ...interface{}) {
+	logf("watchdog: "+format, args...)
+
+	for _, pubSub := range pubSubs {
+		status, ok := watchStatus(pubSub, time.Second)
+		if !ok {
+			logf("watchdog: stream %s: not answering\n", pubSub.id)
+			continue
+		}
+		data, err := json.Marshal(status)
+		if err == nil {
+			logf("watchdog: stream %s: %s\n", pubSub.id, data)
+		}
+	}
+	logf("watchdog: %d goroutines, %d bytes of frames in flight\n",
+		runtime.NumGoroutine(), memoryUsed())
+
+	var stacks bytes.Buffer
+	err := pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+	if err == nil {
+		logf("watchdog: goroutines:\n%s", stacks.String())
+	}
+
+	logf("watchdog: exiting for a restart\n")
+	watchdogExit(1)
+}
@@ -0,0 +1,150 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// catchExit records watchdog exits instead of exiting.
+func catchExit(t *testing.T) *int32 {
+	exits := new(int32)
+	old := watchdogExit
+	watchdogExit = func(int) { atomic.AddInt32(exits, 1) }
+	t.Cleanup(func() { watchdogExit = old })
+	return exits
+}
+
+func TestWatchdogHungLoop(t *testing.T) {
+	exits := catchExit(t)
+	hung := newTestPubSub(t, "/hung", configSource{}) // loop never started
+	setStreams(t, hung)
+
+	if watchCheck(50 * time.Millisecond) {
+		t.Error("hung loop not detected")
+	}
+	if atomic.LoadInt32(exits) != 1 {
+		t.Error("watchdog did not exit")
+	}
+}
+
+// newBlackholeSource accepts connections but never answers them, until
+// the test ends.
+func newBlackholeSource(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return "http://" + listener.Addr().String() + "/"
+}
+
+// Connecting to a source that never answers leaves the loop serving
+// status requests, so neither the status pages nor the watchdog wait.
+func TestWatchdogBlackholedSource(t *testing.T) {
+	exits := catchExit(t)
+	pubSub := newTestStream(t, "/blackhole", configSource{Source: newBlackholeSource(t)})
+	setStreams(t, pubSub)
+
+	sub := NewSubscriber("test")
+	sub.internal = true
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	if !<-sub.admitted {
+		t.Fatal("not admitted")
+	}
+
+	for i := 0; i < 3; i++ {
+		status, ok := watchStatus(pubSub, 100*time.Millisecond)
+		if !ok {
+			t.Fatal("status waited for the source")
+		}
+		if status.Connected || status.Subscribers != 1 {
+			t.Errorf("status: got %+v", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !watchCheck(100*time.Millisecond) || atomic.LoadInt32(exits) != 0 {
+		t.Error("loop connecting to the source counted as hung")
+	}
+}
+
+// A wanted stream without frames, as its source is offline, is left to
+// the reconnects.
+func TestWatchdogIgnoresMissingFrames(t *testing.T) {
+	exits := catchExit(t)
+	source := newStalledSource(t)
+	pubSub := newTestStream(t, "/offline", configSource{Source: source.URL})
+	setStreams(t, pubSub)
+
+	sub := NewSubscriber("test")
+	sub.internal = true
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	if !<-sub.admitted {
+		t.Fatal("not admitted")
+	}
+
+	for i := 0; i < 3; i++ {
+		if !watchCheck(100 * time.Millisecond) {
+			t.Fatal("stream without frames counted as hung")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(exits) != 0 {
+		t.Error("watchdog exited")
+	}
+}
+
+func TestWatchdogGoroutineLimit(t *testing.T) {
+	exits := catchExit(t)
+	setStreams(t)
+	old := watchdogGoroutines
+	watchdogGoroutines = 1
+	defer func() { watchdogGoroutines = old }()
+
+	if watchCheck(time.Second) || atomic.LoadInt32(exits) != 1 {
+		t.Error("goroutine limit not enforced")
+	}
+}